@@ -0,0 +1,47 @@
+/*
+ * Copyright 2022  David MacKinnon (blaedd@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You may
+ * not use this file except in compliance with the License. A copy of the
+ * License is located at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0.txt
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Command optdocs regenerates the option tables in the README from the plugin option schema.
+//
+// Usage: optdocs README.md
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/blaedd/fluent-bit-pubsub-plugin/plugin"
+)
+
+func main() {
+	if len(os.Args) != 2 {
+		fmt.Fprintln(os.Stderr, "usage: optdocs README.md")
+		os.Exit(2)
+	}
+	path := os.Args[1]
+	doc, err := os.ReadFile(path)
+	if err == nil {
+		doc, err = plugin.UpdateOptionsDoc(doc)
+	}
+	if err == nil {
+		err = os.WriteFile(path, doc, 0o644)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "optdocs: %v\n", err)
+		os.Exit(1)
+	}
+}
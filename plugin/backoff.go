@@ -0,0 +1,56 @@
+/*
+ * Copyright 2022  David MacKinnon (blaedd@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You may
+ * not use this file except in compliance with the License. A copy of the
+ * License is located at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0.txt
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package plugin
+
+import (
+	"math/rand"
+	"time"
+)
+
+// backoff calculates exponentially increasing delays between retries, with jitter.
+type backoff struct {
+	min, max time.Duration
+	cur      time.Duration
+}
+
+func newBackoff(min, max time.Duration) *backoff {
+	if max < min {
+		max = min
+	}
+	return &backoff{min: min, max: max}
+}
+
+// next returns the delay before the next retry.
+//
+// Delays double with each call, up to the maximum, and a random jitter of up to 20% is subtracted.
+func (b *backoff) next() time.Duration {
+	if b.cur == 0 {
+		b.cur = b.min
+	} else if b.cur *= 2; b.cur > b.max {
+		b.cur = b.max
+	}
+	if b.cur <= 0 {
+		return 0
+	}
+	return b.cur - time.Duration(rand.Int63n(int64(b.cur)/5+1))
+}
+
+// reset restarts the delays from the minimum.
+func (b *backoff) reset() {
+	b.cur = 0
+}
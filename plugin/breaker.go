@@ -0,0 +1,198 @@
+/*
+ * Copyright 2022  David MacKinnon (blaedd@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You may
+ * not use this file except in compliance with the License. A copy of the
+ * License is located at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0.txt
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package plugin
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// BreakerConfig holds the circuit breaker settings.
+type BreakerConfig struct {
+	Failures int           // Consecutive failed publishes that open the circuit. Zero disables the breaker.
+	Cooldown time.Duration // How long the circuit stays open before probes are let through.
+	Probes   int           // Successful probes that close the circuit again.
+}
+
+// DefaultBreakerConfig holds the default circuit breaker settings.
+var DefaultBreakerConfig = BreakerConfig{Cooldown: 30 * time.Second, Probes: 1}
+
+// breakerState is the state of a circuit breaker.
+type breakerState int
+
+// Circuit breaker states.
+const (
+	breakerClosed   breakerState = iota // Publishes are let through.
+	breakerOpen                         // Publishes fail fast.
+	breakerHalfOpen                     // One probe publish at a time is let through.
+)
+
+var breakerStateNames = [...]string{"closed", "open", "half_open"}
+
+func (s breakerState) String() string {
+	return breakerStateNames[s]
+}
+
+// breaker is a circuit breaker around publishing. A nil breaker lets everything through.
+type breaker struct {
+	cfg BreakerConfig
+	l   *zerolog.Logger
+	now func() time.Time
+
+	mu        sync.Mutex
+	state     breakerState
+	failures  int       // Consecutive failures while closed.
+	openedAt  time.Time // When the circuit last opened.
+	probing   bool      // A probe is in flight.
+	successes int       // Successful probes while half open.
+	entered   [len(breakerStateNames)]int64
+	rejected  int64
+}
+
+// newBreaker creates a breaker, or returns nil if it is disabled.
+func newBreaker(cfg *BreakerConfig, l *zerolog.Logger) *breaker {
+	if cfg.Failures <= 0 {
+		return nil
+	}
+	return &breaker{cfg: *cfg, l: l, now: time.Now}
+}
+
+// setState changes the state, logging the transition. b.mu must be held.
+func (b *breaker) setState(s breakerState, reason string) {
+	if b.state == s {
+		return
+	}
+	lvl := zerolog.InfoLevel
+	if s == breakerOpen {
+		lvl = zerolog.WarnLevel
+	}
+	b.l.WithLevel(lvl).Stringer("from", b.state).Stringer("to", s).Str("reason", reason).
+		Msg("circuit breaker state changed")
+	b.state = s
+	b.entered[s]++
+	b.failures, b.successes, b.probing = 0, 0, false
+	if s == breakerOpen {
+		b.openedAt = b.now()
+	}
+}
+
+// allow reports if a publish can go ahead. Each allowed publish must be followed by a call to done.
+func (b *breaker) allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerOpen && b.now().Sub(b.openedAt) >= b.cfg.Cooldown {
+		b.setState(breakerHalfOpen, "cooldown elapsed")
+	}
+	switch b.state {
+	case breakerClosed:
+		return true
+	case breakerHalfOpen:
+		if !b.probing {
+			b.probing = true
+			return true
+		}
+	}
+	b.rejected++
+	return false
+}
+
+// breakerFailure reports if err shows that PubSub is failing. Messages rejected for their content, e.g. with
+// InvalidArgument, still made a round trip to PubSub, and chunks held back by the rate limit never left the client.
+func breakerFailure(err error) bool {
+	if err == nil || errors.Is(err, ErrRateLimited) {
+		return false
+	}
+	var perr *PublishError
+	if errors.As(err, &perr) {
+		return perr.Rejected < perr.Failed
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return true
+	}
+	return false
+}
+
+// done records the result of an allowed publish. Only errors that show PubSub is failing, see breakerFailure, count
+// as failures.
+func (b *breaker) done(err error) {
+	if b == nil {
+		return
+	}
+	failed := breakerFailure(err)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerClosed:
+		if !failed {
+			b.failures = 0
+			return
+		}
+		b.failures++
+		if b.failures >= b.cfg.Failures {
+			b.setState(breakerOpen, "consecutive publish failures")
+		}
+	case breakerHalfOpen:
+		b.probing = false
+		if failed {
+			b.setState(breakerOpen, "probe failed")
+			return
+		}
+		b.successes++
+		if b.successes >= b.cfg.Probes {
+			b.setState(breakerClosed, "probes succeeded")
+		}
+	}
+}
+
+// release gives back an allowed publish that didn't happen, without recording a result.
+func (b *breaker) release() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerHalfOpen {
+		b.probing = false
+	}
+}
+
+// breakerStats is a snapshot of the breaker state for metrics.
+type breakerStats struct {
+	state    breakerState
+	entered  [len(breakerStateNames)]int64
+	rejected int64
+}
+
+func (b *breaker) stats() breakerStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return breakerStats{state: b.state, entered: b.entered, rejected: b.rejected}
+}
@@ -0,0 +1,184 @@
+/*
+ * Copyright 2022  David MacKinnon (blaedd@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You may
+ * not use this file except in compliance with the License. A copy of the
+ * License is located at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0.txt
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package plugin
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestBreaker(t *testing.T) {
+	failed := status.Error(codes.Unavailable, "unavailable")
+	rejected := &PublishError{Err: status.Error(codes.InvalidArgument, "bad message"), Failed: 2, Rejected: 2}
+	// Each step calls allow, and if allowed, done with the error, after advancing the clock.
+	type step struct {
+		advance   time.Duration
+		err       error
+		release   bool
+		wantAllow bool
+		wantState breakerState
+	}
+	testMap := map[string][]step{
+		"staysClosed": {
+			{err: failed, wantAllow: true, wantState: breakerClosed},
+			{err: nil, wantAllow: true, wantState: breakerClosed},
+			{err: failed, wantAllow: true, wantState: breakerClosed},
+			{err: failed, wantAllow: true, wantState: breakerClosed},
+		},
+		// Messages rejected for their content don't open the circuit, and close it like a success.
+		"rejectedStaysClosed": {
+			{err: failed, wantAllow: true, wantState: breakerClosed},
+			{err: failed, wantAllow: true, wantState: breakerClosed},
+			{err: rejected, wantAllow: true, wantState: breakerClosed},
+			{err: rejected, wantAllow: true, wantState: breakerClosed},
+			{err: rejected, wantAllow: true, wantState: breakerClosed},
+			{err: errors.New("encoding failed"), wantAllow: true, wantState: breakerClosed},
+		},
+		"retryablePublishErrorOpens": {
+			{err: &PublishError{Err: failed, Failed: 1, Retryable: true}, wantAllow: true, wantState: breakerClosed},
+			{err: &PublishError{Err: failed, Failed: 2, Rejected: 1}, wantAllow: true, wantState: breakerClosed},
+			{err: context.DeadlineExceeded, wantAllow: true, wantState: breakerOpen},
+		},
+		"rejectedProbeCloses": {
+			{err: failed, wantAllow: true}, {err: failed, wantAllow: true}, {err: failed, wantAllow: true,
+				wantState: breakerOpen},
+			{advance: 10 * time.Second, err: rejected, wantAllow: true, wantState: breakerHalfOpen},
+			{err: rejected, wantAllow: true, wantState: breakerClosed},
+		},
+		"opens": {
+			{err: failed, wantAllow: true, wantState: breakerClosed},
+			{err: failed, wantAllow: true, wantState: breakerClosed},
+			{err: failed, wantAllow: true, wantState: breakerOpen},
+			{advance: 5 * time.Second, wantAllow: false, wantState: breakerOpen},
+		},
+		"probeCloses": {
+			{err: failed, wantAllow: true}, {err: failed, wantAllow: true}, {err: failed, wantAllow: true,
+				wantState: breakerOpen},
+			{advance: 10 * time.Second, err: nil, wantAllow: true, wantState: breakerHalfOpen},
+			{err: nil, wantAllow: true, wantState: breakerClosed},
+		},
+		"probeReopens": {
+			{err: failed, wantAllow: true}, {err: failed, wantAllow: true}, {err: failed, wantAllow: true,
+				wantState: breakerOpen},
+			{advance: 10 * time.Second, err: failed, wantAllow: true, wantState: breakerOpen},
+			{advance: 5 * time.Second, wantAllow: false, wantState: breakerOpen},
+		},
+		"releasedProbe": {
+			{err: failed, wantAllow: true}, {err: failed, wantAllow: true}, {err: failed, wantAllow: true,
+				wantState: breakerOpen},
+			{advance: 10 * time.Second, release: true, wantAllow: true, wantState: breakerHalfOpen},
+			{err: nil, wantAllow: true, wantState: breakerHalfOpen},
+		},
+	}
+	for k, steps := range testMap {
+		t.Run(k, func(t *testing.T) {
+			now := time.Unix(1600000000, 0)
+			l := zerolog.Nop()
+			b := newBreaker(&BreakerConfig{Failures: 3, Cooldown: 10 * time.Second, Probes: 2}, &l)
+			b.now = func() time.Time { return now }
+			for i, s := range steps {
+				now = now.Add(s.advance)
+				allowed := b.allow()
+				if allowed != s.wantAllow {
+					t.Fatalf("step %d: allow() = %v, want %v", i, allowed, s.wantAllow)
+				}
+				if allowed {
+					if s.release {
+						b.release()
+					} else {
+						b.done(s.err)
+					}
+				}
+				if got := b.stats().state; got != s.wantState {
+					t.Fatalf("step %d: state = %v, want %v", i, got, s.wantState)
+				}
+			}
+		})
+	}
+}
+
+func TestBreaker_halfOpenSingleProbe(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	l := zerolog.Nop()
+	b := newBreaker(&BreakerConfig{Failures: 1, Cooldown: time.Second, Probes: 1}, &l)
+	b.now = func() time.Time { return now }
+	b.allow()
+	b.done(status.Error(codes.Unavailable, "unavailable"))
+	now = now.Add(time.Second)
+	if !b.allow() {
+		t.Fatal("allow() = false after cooldown, want a probe")
+	}
+	if b.allow() {
+		t.Error("allow() = true with a probe in flight, want false")
+	}
+	if s := b.stats(); s.rejected != 1 || s.entered[breakerOpen] != 1 || s.entered[breakerHalfOpen] != 1 {
+		t.Errorf("stats() = %+v", s)
+	}
+	if newBreaker(&BreakerConfig{}, &l) != nil {
+		t.Error("newBreaker() with no failures set is enabled, want nil")
+	}
+	var disabled *breaker
+	if !disabled.allow() {
+		t.Error("nil breaker allow() = false, want true")
+	}
+}
+
+func TestOutputPlugin_metrics(t *testing.T) {
+	l := zerolog.Nop()
+	p := &OutputPlugin{config: &OutputPluginConfig{ID: 2, TID: "logs"}}
+	p.brk = newBreaker(&BreakerConfig{Failures: 1, Cooldown: time.Minute}, &l)
+	p.brk.allow()
+	p.brk.done(status.Error(codes.Unavailable, "unavailable"))
+	p.brk.allow()
+	p.health.outstanding.Store(7)
+
+	srv := httptest.NewServer(p.handler())
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"# TYPE fluentbit_pubsub_circuit_state gauge",
+		`fluentbit_pubsub_circuit_state{plugin_id="2",topic="logs",state="open"} 1`,
+		`fluentbit_pubsub_circuit_state{plugin_id="2",topic="logs",state="closed"} 0`,
+		`fluentbit_pubsub_circuit_transitions_total{plugin_id="2",topic="logs",state="open"} 1`,
+		`fluentbit_pubsub_circuit_rejected_total{plugin_id="2",topic="logs"} 1`,
+		`fluentbit_pubsub_outstanding_messages{plugin_id="2",topic="logs"} 7`,
+		`fluentbit_pubsub_initialized{plugin_id="2",topic="logs"} 0`,
+	} {
+		if !strings.Contains(string(b), want+"\n") {
+			t.Errorf("/metrics is missing %q:\n%s", want, b)
+		}
+	}
+}
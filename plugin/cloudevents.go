@@ -0,0 +1,174 @@
+/*
+ * Copyright 2022  David MacKinnon (blaedd@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You may
+ * not use this file except in compliance with the License. A copy of the
+ * License is located at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0.txt
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"text/template"
+	"time"
+)
+
+// CloudEvents content modes.
+//
+// See https://github.com/cloudevents/spec/blob/v1.0.2/cloudevents/bindings/pubsub-protocol-binding.md
+const (
+	CloudEventsBinary     = "binary"
+	CloudEventsStructured = "structured"
+)
+
+const (
+	ceSpecVersion       = "1.0"
+	ceJSONContentType   = "application/json"
+	ceStructContentType = "application/cloudevents+json"
+)
+
+// CloudEventsConfig holds the settings used to wrap records in a CloudEvents 1.0 envelope.
+//
+// The ID, Source, Type, Subject and Time fields are templates evaluated against [RecordData].
+type CloudEventsConfig struct {
+	Mode    string // Content mode, binary or structured.
+	ID      string // Template for the event id.
+	Source  string // Template for the event source.
+	Type    string // Template for the event type.
+	Subject string // Template for the event subject. Omitted if it renders empty.
+	Time    string // Template for the event time. Defaults to the fluent-bit timestamp.
+}
+
+// DefaultCloudEventsConfig is the CloudEventsConfig used unless overridden by the plugin configuration.
+var DefaultCloudEventsConfig = CloudEventsConfig{
+	Mode:    CloudEventsBinary,
+	ID:      "{{hash .}}",
+	Source:  "fluent-bit",
+	Type:    "io.fluentbit.record",
+	Subject: "{{.Tag}}",
+}
+
+// Validate checks the CloudEventsConfig settings.
+func (c *CloudEventsConfig) Validate() error {
+	switch c.Mode {
+	case CloudEventsBinary, CloudEventsStructured:
+	default:
+		return fmt.Errorf("cloudevents_mode must be %s or %s, not %q", CloudEventsBinary, CloudEventsStructured,
+			c.Mode)
+	}
+	if c.ID == "" || c.Source == "" || c.Type == "" {
+		return fmt.Errorf("cloudevents_id, cloudevents_source and cloudevents_type can not be empty")
+	}
+	return nil
+}
+
+// cloudEvent is the JSON representation of a structured mode CloudEvent.
+type cloudEvent struct {
+	SpecVersion     string                 `json:"specversion"`
+	ID              string                 `json:"id"`
+	Source          string                 `json:"source"`
+	Type            string                 `json:"type"`
+	Subject         string                 `json:"subject,omitempty"`
+	Time            string                 `json:"time"`
+	DataContentType string                 `json:"datacontenttype"`
+	Data            map[string]interface{} `json:"data"`
+}
+
+// cloudEventsEncoder wraps records in a CloudEvents envelope.
+type cloudEventsEncoder struct {
+	structured bool
+	id         *template.Template
+	source     *template.Template
+	typ        *template.Template
+	subject    *template.Template
+	time       *template.Template
+}
+
+func newCloudEventsEncoder(c *CloudEventsConfig) (*cloudEventsEncoder, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	e := &cloudEventsEncoder{structured: c.Mode == CloudEventsStructured}
+	for _, t := range []struct {
+		name string
+		text string
+		dst  **template.Template
+	}{
+		{"cloudevents_id", c.ID, &e.id},
+		{"cloudevents_source", c.Source, &e.source},
+		{"cloudevents_type", c.Type, &e.typ},
+		{"cloudevents_subject", c.Subject, &e.subject},
+		{"cloudevents_time", c.Time, &e.time},
+	} {
+		if t.text == "" {
+			continue
+		}
+		tmpl, err := newRecordTemplate(t.name, t.text)
+		if err != nil {
+			return nil, err
+		}
+		*t.dst = tmpl
+	}
+	return e, nil
+}
+
+func (e *cloudEventsEncoder) render(t *template.Template, data *RecordData) (string, error) {
+	if t == nil {
+		return "", nil
+	}
+	b, err := execTemplate(t, data)
+	if err != nil {
+		return "", fmt.Errorf("unable to render %s: %w", t.Name(), err)
+	}
+	return string(b), nil
+}
+
+func (e *cloudEventsEncoder) Encode(ts time.Time, tag string, record map[string]interface{}, attrs map[string]string) ([]byte, error) {
+	data := &RecordData{Tag: tag, Time: ts, Record: record}
+	ce := cloudEvent{SpecVersion: ceSpecVersion, DataContentType: ceJSONContentType, Data: record}
+	for _, f := range []struct {
+		t   *template.Template
+		dst *string
+	}{
+		{e.id, &ce.ID},
+		{e.source, &ce.Source},
+		{e.typ, &ce.Type},
+		{e.subject, &ce.Subject},
+		{e.time, &ce.Time},
+	} {
+		v, err := e.render(f.t, data)
+		if err != nil {
+			return nil, err
+		}
+		*f.dst = v
+	}
+	if ce.Time == "" {
+		ce.Time = ts.UTC().Format(time.RFC3339Nano)
+	}
+
+	if e.structured {
+		attrs["content-type"] = ceStructContentType
+		return json.Marshal(ce)
+	}
+	attrs["content-type"] = ce.DataContentType
+	attrs["ce-specversion"] = ce.SpecVersion
+	attrs["ce-id"] = ce.ID
+	attrs["ce-source"] = ce.Source
+	attrs["ce-type"] = ce.Type
+	attrs["ce-time"] = ce.Time
+	if ce.Subject != "" {
+		attrs["ce-subject"] = ce.Subject
+	}
+	return json.Marshal(record)
+}
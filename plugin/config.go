@@ -20,45 +20,126 @@ package plugin
 import (
 	"context"
 	"fmt"
+	"strings"
 	"time"
 
 	"cloud.google.com/go/pubsub"
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
 	"google.golang.org/api/option"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // ConfigStore defines an interface to the plugin configuration.
 type ConfigStore interface {
 	Bool(name string) (bool, bool)
+	Bytes(name string) (int64, bool)
 	Duration(name string) (time.Duration, bool)
 	Int(name string) (int, bool)
+	Map(name string) (map[string]string, bool)
 	String(name string) (string, bool)
 	Strings(name string) ([]string, bool)
 }
 
 // OutputPluginConfig represents the configuration used to create an [OutputPlugin]
 type OutputPluginConfig struct {
-	ID      int                    // Plugin ID.
-	PID     string                 // Google Cloud project id.
-	TID     string                 // PubSub topic ID.
-	Crds    string                 // Google Cloud credentials file.
-	TSField string                 // Field to populate/update with fluent-bit timestamp.
-	As      []string               // List of record fields to use as PubSub.Message attributes
-	KA      bool                   // If record fields used as attributes should be kept in the record.
-	PS      pubsub.PublishSettings // Pubsub PublishSettings
-	D       bool                   // Debug flag
+	ID             int                    // Plugin ID.
+	ConfigFile     string                 // File the options were partly read from.
+	EnvPrefix      string                 // Prefix of environment variables the options were partly read from.
+	PID            string                 // Google Cloud project id.
+	TID            string                 // PubSub topic ID.
+	Crds           string                 // Google Cloud credentials file.
+	CrdsJSON       string                 // Google Cloud credentials, as JSON.
+	CrdsReload     time.Duration          // How often to check the credentials file for changes. 0 disables reloading.
+	Impersonate    string                 // Service account to impersonate.
+	Delegates      []string               // Delegation chain for impersonation.
+	Scopes         []string               // OAuth scopes to request.
+	QuotaProject   string                 // Project used for quota and billing.
+	TSField        string                 // Field to populate/update with fluent-bit timestamp.
+	As             []string               // List of record fields to use as PubSub.Message attributes
+	KA             bool                   // If record fields used as attributes should be kept in the record.
+	PS             pubsub.PublishSettings // Pubsub PublishSettings
+	Retry          RetryPolicy            // Which publish errors are retried, and how.
+	RetryCodes     []codes.Code           // Status codes that are retried, used to build Retry.
+	FatalCodes     []codes.Code           // Status codes that are never retried, used to build Retry.
+	D              bool                   // Debug flag
+	Fmt            string                 // Message payload format.
+	Tmpl           string                 // Template for the message payload, used with the json format.
+	TmplFile       string                 // File containing the template for the message payload.
+	LazyInit       bool                   // Initialize the client and topic in the background.
+	InitRetryMin   time.Duration          // Initial delay between background initialization attempts.
+	InitRetryMax   time.Duration          // Maximum delay between background initialization attempts.
+	SkipTopicCheck bool                   // Don't check the topic exists at startup.
+	CreateTopic    bool                   // Create the topic if it doesn't exist.
+	TopicLabels    map[string]string      // Labels for created topics.
+	TopicRetention time.Duration          // Message retention for created topics.
+	TopicSchema    string                 // Schema for created topics.
+	TopicSchemaEnc string                 // Encoding of messages validated against TopicSchema, json or binary.
+	CE             CloudEventsConfig      // CloudEvents envelope settings, used with the cloudevents format.
+	LE             LogEntryConfig         // LogEntry mapping settings, used with the logentry format.
+	Raw            RawConfig              // Raw field settings, used with the raw format.
+	Tracing        TracingConfig          // OpenTelemetry tracing settings.
+	Log            LogConfig              // Settings for the plugin's own logs.
+	Health         HealthConfig           // Health and readiness endpoint settings.
+	Spool          SpoolConfig            // On-disk spool settings.
+	Breaker        BreakerConfig          // Circuit breaker settings.
+	RateLimit      RateLimitConfig        // Client side rate limits.
+	Sample         SampleConfig           // Record sampling settings.
+	Dedup          DedupConfig            // Duplicate suppression settings.
+	MessageID      MessageIDConfig        // Message ID attribute settings.
 }
 
-// Validate validates that all required fields are present in the OutputPluginConfig.
+// topicName returns the fully qualified name of the topic.
+func (c *OutputPluginConfig) topicName() string {
+	return fmt.Sprintf("projects/%s/topics/%s", c.PID, c.TID)
+}
+
+// Validate validates that all required fields are present in the OutputPluginConfig, and that the options are
+// consistent.
 func (c *OutputPluginConfig) Validate() error {
-	errorStr := "%s is a required parameter"
+	for _, o := range Options {
+		if err := o.validate(c); err != nil {
+			return err
+		}
+	}
 	var err error
 
-	if c.PID == "" {
-		err = fmt.Errorf(errorStr, "gcp_project_id")
-	} else if c.TID == "" {
-		err = fmt.Errorf(errorStr, "topic_id")
+	if c.Retry.Max < c.Retry.Min {
+		err = fmt.Errorf("publish_retry_max must be at least publish_retry_min")
+	} else if c.Crds != "" && c.CrdsJSON != "" {
+		err = fmt.Errorf("only one of credentials_file and credentials_json can be set")
+	} else if len(c.Delegates) > 0 && c.Impersonate == "" {
+		err = fmt.Errorf("impersonate_delegates requires impersonate_service_account")
+	} else if c.LazyInit && (c.InitRetryMin <= 0 || c.InitRetryMax < c.InitRetryMin) {
+		err = fmt.Errorf("init_retry_min must be positive, and no larger than init_retry_max")
+	} else if c.TopicRetention != 0 && (c.TopicRetention < 10*time.Minute || c.TopicRetention > 7*24*time.Hour) {
+		err = fmt.Errorf("topic_retention must be between 10m and 168h")
+	} else if c.Tmpl != "" && c.TmplFile != "" {
+		err = fmt.Errorf("only one of data_template and data_template_file can be set")
+	} else if (c.Tmpl != "" || c.TmplFile != "") && c.Fmt != "" && c.Fmt != FormatJSON {
+		err = fmt.Errorf("data_template can not be used with the %s format", c.Fmt)
+	} else if c.Fmt == FormatCloudEvents {
+		err = c.CE.Validate()
+	} else if c.Fmt == FormatLogEntry {
+		err = c.LE.Validate()
+	} else if c.Fmt == FormatRaw {
+		err = c.Raw.Validate()
+	}
+	if err == nil {
+		err = validatePublishSettings(&c.PS)
+	}
+	if err == nil {
+		err = c.Tracing.Validate()
+	}
+	if err == nil {
+		err = c.Log.Validate()
+	}
+	if err == nil {
+		err = c.Spool.Validate()
+	}
+	if err == nil {
+		err = c.Sample.Validate()
 	}
 	return err
 }
@@ -68,26 +149,75 @@ func (c *OutputPluginConfig) fetchTopic(ctx context.Context, l *zerolog.Logger,
 
 	topic := client.Topic(c.TID)
 	topic.PublishSettings = c.PS
+	if c.SkipTopicCheck {
+		if c.CreateTopic {
+			return c.createTopic(ctx, l, client)
+		}
+		l.Info().Msg("skipping topic existence check")
+		return topic, nil
+	}
 	ok, err := topic.Exists(ctx)
 	if err != nil {
+		if status.Code(err) == codes.PermissionDenied {
+			l.Error().Err(err).Msg("permission denied retrieving topic information")
+			return nil, errors.Wrapf(err, "permission denied checking if topic %s exists in project %s. "+
+				"Grant pubsub.topics.get, or set skip_topic_check", c.TID, c.PID)
+		}
 		l.Error().Err(err).Msg("unable to retrieve topic information")
 		return nil, err
 	}
 	if ok == false {
+		if c.CreateTopic {
+			return c.createTopic(ctx, l, client)
+		}
 		l.Error().Msg("topic does not exist in project")
 		return nil, errors.Errorf("topic %s does not exist in project %s", c.TID, c.PID)
 	}
 	return topic, nil
 }
 
+// createTopic creates the topic with the configured settings. An existing topic is used as is.
+func (c *OutputPluginConfig) createTopic(ctx context.Context, l *zerolog.Logger, client *pubsub.Client) (*pubsub.Topic, error) {
+	tc := &pubsub.TopicConfig{Labels: c.TopicLabels}
+	if c.TopicRetention > 0 {
+		tc.RetentionDuration = c.TopicRetention
+	}
+	if c.TopicSchema != "" {
+		schema := c.TopicSchema
+		if !strings.HasPrefix(schema, "projects/") {
+			schema = fmt.Sprintf("projects/%s/schemas/%s", c.PID, schema)
+		}
+		tc.SchemaSettings = &pubsub.SchemaSettings{Schema: schema, Encoding: pubsub.EncodingJSON}
+		if c.TopicSchemaEnc == "binary" {
+			tc.SchemaSettings.Encoding = pubsub.EncodingBinary
+		}
+	}
+	l.Info().Msg("creating topic")
+	topic, err := client.CreateTopicWithConfig(ctx, c.TID, tc)
+	switch status.Code(err) {
+	case codes.OK:
+		l.Info().Msg("topic created")
+	case codes.AlreadyExists:
+		l.Info().Msg("topic already exists")
+		topic = client.Topic(c.TID)
+	case codes.PermissionDenied:
+		l.Error().Err(err).Msg("permission denied creating topic")
+		return nil, errors.Wrapf(err, "permission denied creating topic %s in project %s. Grant pubsub.topics.create",
+			c.TID, c.PID)
+	default:
+		l.Error().Err(err).Msg("unable to create topic")
+		return nil, errors.Wrapf(err, "unable to create topic %s in project %s", c.TID, c.PID)
+	}
+	topic.PublishSettings = c.PS
+	return topic, nil
+}
+
 func (c *OutputPluginConfig) createClient(ctx context.Context, l *zerolog.Logger, opts ...option.ClientOption) (*pubsub.Client, error) {
-	if c.Crds != "" {
-		l.Info().Msg("using credentials file to authenticate")
-		opts = append(opts, option.WithCredentialsFile(c.Crds))
-	} else {
-		l.Info().Msg("no credentials file supplied. attempting to use default credentials")
+	authOpts, err := c.clientOptions(ctx, l)
+	if err != nil {
+		return nil, err
 	}
-	client, err := pubsub.NewClient(ctx, c.PID, opts...)
+	client, err := pubsub.NewClient(ctx, c.PID, append(authOpts, opts...)...)
 	if err != nil {
 		l.Error().Err(err).Msg("unable to create PubSub.Client")
 		return nil, err
@@ -95,28 +225,73 @@ func (c *OutputPluginConfig) createClient(ctx context.Context, l *zerolog.Logger
 	return client, nil
 }
 
-// BuildPluginConfig creates the OutputPluginConfig from a ConfigStore
-func BuildPluginConfig(id int, cs ConfigStore) *OutputPluginConfig {
+// parseKeyValues converts a list of key=value strings to a map. Items without a '=' map the key to itself.
+func parseKeyValues(kvs []string) map[string]string {
+	m := make(map[string]string, len(kvs))
+	for _, kv := range kvs {
+		k, v, found := strings.Cut(kv, "=")
+		if !found {
+			v = k
+		}
+		m[k] = v
+	}
+	return m
+}
+
+// limitExceededBehaviors maps publish_limit_exceeded_behavior values to pubsub.LimitExceededBehavior.
+var limitExceededBehaviors = map[string]pubsub.LimitExceededBehavior{
+	"ignore":       pubsub.FlowControlIgnore,
+	"block":        pubsub.FlowControlBlock,
+	"signal_error": pubsub.FlowControlSignalError,
+}
+
+// ParseLimitExceededBehavior parses a flow control limit exceeded behavior, one of ignore, block or signal_error.
+func ParseLimitExceededBehavior(s string) (pubsub.LimitExceededBehavior, error) {
+	b, ok := limitExceededBehaviors[strings.ToLower(s)]
+	if !ok {
+		return pubsub.FlowControlIgnore, fmt.Errorf(
+			"publish_limit_exceeded_behavior must be one of ignore, block or signal_error, not %q", s)
+	}
+	return b, nil
+}
+
+// validatePublishSettings checks the PublishSettings that depend on each other. The limits of the individual
+// settings are checked by their Option.
+func validatePublishSettings(ps *pubsub.PublishSettings) error {
+	// Flow control limits of zero or less are unlimited.
+	fc := ps.FlowControlSettings
+	if fc.LimitExceededBehavior != pubsub.FlowControlIgnore && fc.MaxOutstandingMessages <= 0 &&
+		fc.MaxOutstandingBytes <= 0 {
+		return fmt.Errorf("publish_limit_exceeded_behavior requires publish_max_outstanding_messages or " +
+			"publish_max_outstanding_bytes")
+	}
+	return nil
+}
+
+// parseCodes parses a list of gRPC status codes. The first parse error is stored in errp.
+func parseCodes(names []string, errp *error) []codes.Code {
+	cs := make([]codes.Code, 0, len(names))
+	for _, n := range names {
+		c, err := ParseCode(n)
+		if err != nil {
+			if *errp == nil {
+				*errp = err
+			}
+			continue
+		}
+		cs = append(cs, c)
+	}
+	return cs
+}
+
+// BuildPluginConfig creates the OutputPluginConfig from a ConfigStore.
+//
+// Options that are not set use their default. An error is returned if any options are set to invalid values.
+func BuildPluginConfig(id int, cs ConfigStore) (*OutputPluginConfig, error) {
 	cfg := &OutputPluginConfig{ID: id, PS: pubsub.DefaultPublishSettings}
-	cfg.PS.DelayThreshold = 1 * time.Second
-	cfg.D, _ = cs.Bool("debug")
-	cfg.PID, _ = cs.String("gcp_project_id")
-	cfg.TID, _ = cs.String("topic_id")
-	cfg.Crds, _ = cs.String("credentials_file")
-	cfg.TSField, _ = cs.String("timestamp_field")
-	cfg.As, _ = cs.Strings("attribute_fields")
-	cfg.KA, _ = cs.Bool("keep_attribute_fields")
-	if val, ok := cs.Duration("publish_delay_threshold"); ok {
-		cfg.PS.DelayThreshold = val
-	}
-	if val, ok := cs.Duration("publish_timeout"); ok {
-		cfg.PS.Timeout = val
-	}
-	if val, ok := cs.Int("publish_byte_threshold"); ok {
-		cfg.PS.ByteThreshold = val
-	}
-	if val, ok := cs.Int("publish_count_threshold"); ok {
-		cfg.PS.CountThreshold = val
-	}
-	return cfg
+	if err := loadOptions(cfg, cs); err != nil {
+		return nil, err
+	}
+	cfg.Retry.Codes = NewRetryPolicy(cfg.RetryCodes, cfg.FatalCodes).Codes
+	return cfg, nil
 }
@@ -0,0 +1,166 @@
+/*
+ * Copyright 2022  David MacKinnon (blaedd@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You may
+ * not use this file except in compliance with the License. A copy of the
+ * License is located at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0.txt
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package plugin
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+	"github.com/rs/zerolog"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// newTestClient creates a pubsub.Client connected to a fake PubSub server.
+func newTestClient(t *testing.T, opts ...pstest.ServerReactorOption) (*pubsub.Client, *pstest.Server) {
+	t.Helper()
+	srv := pstest.NewServer(opts...)
+	t.Cleanup(func() { _ = srv.Close() })
+	conn, err := grpc.Dial(srv.Addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := pubsub.NewClient(context.Background(), "proj", option.WithGRPCConn(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+	return client, srv
+}
+
+func TestOutputPluginConfig_fetchTopic(t *testing.T) {
+	l := zerolog.Nop()
+	ctx := context.Background()
+
+	type testData struct {
+		skip, create bool
+		exists       bool
+		inject       []pstest.ServerReactorOption
+		wantErr      string
+	}
+	testMap := map[string]testData{
+		"exists":           {exists: true},
+		"missing":          {wantErr: "does not exist"},
+		"missingCreate":    {create: true},
+		"existsCreate":     {create: true, exists: true},
+		"skip":             {skip: true},
+		"skipCreate":       {skip: true, create: true},
+		"skipCreateExists": {skip: true, create: true, exists: true},
+		"permissionDenied": {exists: true, wantErr: "skip_topic_check",
+			inject: []pstest.ServerReactorOption{pstest.WithErrorInjection("GetTopic", codes.PermissionDenied, "denied")}},
+		"skipPermissionDenied": {skip: true, exists: true,
+			inject: []pstest.ServerReactorOption{pstest.WithErrorInjection("GetTopic", codes.PermissionDenied, "denied")}},
+		"createPermissionDenied": {create: true, wantErr: "pubsub.topics.create",
+			inject: []pstest.ServerReactorOption{pstest.WithErrorInjection("CreateTopic", codes.PermissionDenied, "denied")}},
+	}
+	for k, tt := range testMap {
+		t.Run(k, func(t *testing.T) {
+			client, _ := newTestClient(t, tt.inject...)
+			if tt.exists {
+				if _, err := client.CreateTopic(ctx, "logs"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			cfg := &OutputPluginConfig{PID: "proj", TID: "logs", SkipTopicCheck: tt.skip, CreateTopic: tt.create,
+				TopicLabels: map[string]string{"team": "core"}, TopicSchemaEnc: "json"}
+			topic, err := cfg.fetchTopic(ctx, &l, client)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("fetchTopic() err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("fetchTopic() err = %v", err)
+			}
+			if topic.ID() != "logs" {
+				t.Errorf("fetchTopic() topic = %s", topic.ID())
+			}
+			if tt.create && !tt.exists {
+				tc, err := client.Topic("logs").Config(ctx)
+				if err != nil {
+					t.Fatalf("created topic not found: %v", err)
+				}
+				if tc.Labels["team"] != "core" {
+					t.Errorf("created topic labels = %v", tc.Labels)
+				}
+			}
+		})
+	}
+}
+
+func TestOutputPluginConfig_Validate(t *testing.T) {
+	type testData struct {
+		opts    MapConfigStore
+		wantErr string
+	}
+	testMap := map[string]testData{
+		"defaults":        {opts: MapConfigStore{}},
+		"missingProject":  {opts: MapConfigStore{"gcp_project_id": ""}, wantErr: "gcp_project_id is a required"},
+		"negativeCount":   {opts: MapConfigStore{"publish_count_threshold": "-1"}, wantErr: "publish_count_threshold can not be less than 0"},
+		"countTooLarge":   {opts: MapConfigStore{"publish_count_threshold": "1001"}, wantErr: "can not be more than 1000"},
+		"bytesTooLarge":   {opts: MapConfigStore{"publish_byte_threshold": "100000000"}, wantErr: "publish_byte_threshold"},
+		"negativeTimeout": {opts: MapConfigStore{"publish_timeout": "-1s"}, wantErr: "publish_timeout"},
+		"badFormat":       {opts: MapConfigStore{"format": "xml"}, wantErr: "format must be one of json, cloudevents"},
+		"blockLimited":    {opts: MapConfigStore{"publish_limit_exceeded_behavior": "block"}},
+		"blockUnlimited": {opts: MapConfigStore{"publish_limit_exceeded_behavior": "signal_error",
+			"publish_max_outstanding_messages": "0"}, wantErr: "requires"},
+		"retryMaxLessThanMin": {opts: MapConfigStore{"publish_retry_min": "1s", "publish_retry_max": "10ms"},
+			wantErr: "publish_retry_max"},
+		"tracePropagateNoEndpoint": {opts: MapConfigStore{"trace_propagate": "true"}, wantErr: "otel_endpoint"},
+		"badLogLevel":              {opts: MapConfigStore{"log_level": "fatal"}, wantErr: "log_level must be one of"},
+		"sampleNoPeriod": {opts: MapConfigStore{"log_sample_burst": "10", "log_sample_period": "0s"},
+			wantErr: "log_sample_period"},
+		"badSampleRate": {opts: MapConfigStore{"sample_rate": "1.5"}, wantErr: "sample_rate can not be more than 1"},
+		"negativeSampleRate": {opts: MapConfigStore{"sample_rate": "-0.5"},
+			wantErr: "sample_rate can not be less than 0"},
+		"sampleRate": {opts: MapConfigStore{"sample_rate": "0.25"}},
+		"sampleRatesNoField": {opts: MapConfigStore{"sample_rates": "debug=0.1"},
+			wantErr: "sample_rates requires sample_field"},
+		"bothCredentials": {opts: MapConfigStore{"credentials_file": "/etc/creds.json", "credentials_json": "{}"},
+			wantErr: "only one of credentials_file and credentials_json"},
+		"credentialsJSON": {opts: MapConfigStore{"credentials_json": "{}"}},
+		"delegatesNoImpersonate": {opts: MapConfigStore{"impersonate_delegates": "a@p.iam.gserviceaccount.com"},
+			wantErr: "impersonate"},
+	}
+	for k, tt := range testMap {
+		t.Run(k, func(t *testing.T) {
+			opts := MapConfigStore{"gcp_project_id": "proj", "topic_id": "logs"}
+			for k, v := range tt.opts {
+				opts[k] = v
+			}
+			cfg, err := BuildPluginConfig(0, opts)
+			if err != nil {
+				t.Fatalf("BuildPluginConfig() err = %v", err)
+			}
+			err = cfg.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("Validate() err = %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Validate() err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -18,6 +18,8 @@
 package plugin
 
 import (
+	"fmt"
+	"math"
 	"regexp"
 	"strconv"
 	"strings"
@@ -31,12 +33,18 @@ import (
 
 var (
 	// sn is a Regexp for potentially sensitive fields we shouldn't log
-	sn = regexp.MustCompile(`(?i:pass|secret|key|hash)`)
+	sn = regexp.MustCompile(`(?i:pass|secret|key|hash|token|credentials_json)`)
 	// configKeySet is a variable pointing to the function we use to retrieve config keys from the actual
 	// configuration file. Mainly here so we can easily mock it out for tests.
 	configKeyGet = output.FLBPluginConfigKey
 )
 
+// A valueErrorer is a ConfigStore that can report why a value couldn't be read, for example a missing file
+// reference.
+type valueErrorer interface {
+	ValueErr(name string) error
+}
+
 // FLBConfigStore provides access to the fluent-bit configuration for the plugin.
 type FLBConfigStore struct {
 	l   *zerolog.Logger
@@ -50,12 +58,103 @@ func NewFLBConfigStore(ctx unsafe.Pointer, l *zerolog.Logger) FLBConfigStore {
 	}
 }
 
-func (f *FLBConfigStore) getKey(name string) string {
-	return configKeyGet(f.ctx, name)
+// store returns the lookupStore for the fluent-bit configuration. fluent-bit returns an empty string for unset keys.
+func (f *FLBConfigStore) store() lookupStore {
+	return lookupStore{l: f.l, lookup: func(name string) (string, bool) {
+		sv := configKeyGet(f.ctx, name)
+		return sv, sv != ""
+	}}
+}
+
+// Bool retrieves a boolean from the plugin configuration.
+//
+// The value and if the value was found are returned.
+func (f *FLBConfigStore) Bool(name string) (bool, bool) {
+	return f.store().Bool(name)
+}
+
+// Duration retrieves a [time.Duration] from the plugin configuration.
+//
+// The value and if the value was found are returned.
+func (f *FLBConfigStore) Duration(name string) (time.Duration, bool) {
+	return f.store().Duration(name)
+}
+
+// Int retrieves an integer from the plugin configuration.
+//
+// The value and if the value was found are returned.
+func (f *FLBConfigStore) Int(name string) (int, bool) {
+	return f.store().Int(name)
+}
+
+// Bytes retrieves a size in bytes from the plugin configuration. Sizes can have a unit, e.g. 5M or 512KiB.
+//
+// The value and if the value was found are returned.
+func (f *FLBConfigStore) Bytes(name string) (int64, bool) {
+	return f.store().Bytes(name)
+}
+
+// Map retrieves a map from the plugin configuration.
+//
+// These should be comma seperated key=value pairs in the configuration file. The value and if the value was found
+// are returned.
+func (f *FLBConfigStore) Map(name string) (map[string]string, bool) {
+	return f.store().Map(name)
 }
 
-func (f *FLBConfigStore) logGetKey(n string, rv interface{}, ok bool) {
-	if e := f.l.Debug(); !e.Enabled() {
+// String retrieves a string from the plugin configuration.
+//
+// The value and if the value was found are returned.
+func (f *FLBConfigStore) String(name string) (string, bool) {
+	return f.store().String(name)
+}
+
+// Strings retrieves a list of strings from the plugin configuration.
+//
+// These should be comma seperated in the configuration file, and can be quoted. The value and if the value was found are returned.
+func (f *FLBConfigStore) Strings(name string) ([]string, bool) {
+	return f.store().Strings(name)
+}
+
+// ValueErr returns the error expanding the value of name, if any.
+func (f *FLBConfigStore) ValueErr(name string) error {
+	return f.store().ValueErr(name)
+}
+
+// lookupStore implements the typed ConfigStore accessors on top of a function looking up string values.
+//
+// References in the values are expanded by [expandValue]. Values that are found but can't be parsed are reported as
+// not found, and logged at debug level. Expansion errors are not logged, they are returned by ValueErr so that the
+// option loader fails once with the error.
+type lookupStore struct {
+	l      *zerolog.Logger
+	lookup func(name string) (string, bool)
+}
+
+// get looks up and expands a value. A value that can't be expanded is found, but empty.
+func (s lookupStore) get(name string) (string, bool, error) {
+	sv, found := s.lookup(name)
+	if !found {
+		return "", false, nil
+	}
+	sv, err := expandValue(sv)
+	if err != nil {
+		return "", true, fmt.Errorf("%s: %w", name, err)
+	}
+	return sv, true, nil
+}
+
+// ValueErr returns the error expanding the value of name, if any.
+func (s lookupStore) ValueErr(name string) error {
+	_, _, err := s.get(name)
+	return err
+}
+
+func (s lookupStore) logGetKey(n string, rv interface{}, ok bool) {
+	if s.l == nil {
+		return
+	}
+	if e := s.l.Debug(); !e.Enabled() {
 		return
 	}
 	var (
@@ -64,7 +163,8 @@ func (f *FLBConfigStore) logGetKey(n string, rv interface{}, ok bool) {
 	)
 
 	if ok {
-		if sn.Match([]byte(n)) {
+		// Redact sensitive sounding fields.
+		if isSensitive(n) {
 			evt = evt.Str("value", "********")
 		} else {
 			switch v := rv.(type) {
@@ -72,6 +172,8 @@ func (f *FLBConfigStore) logGetKey(n string, rv interface{}, ok bool) {
 				evt = evt.Bool("value", v)
 			case int:
 				evt = evt.Int("value", v)
+			case int64:
+				evt = evt.Int64("value", v)
 			case string:
 				evt = evt.Str("value", v)
 			case []string:
@@ -82,67 +184,171 @@ func (f *FLBConfigStore) logGetKey(n string, rv interface{}, ok bool) {
 				evt = evt.Interface("value", rv)
 			}
 		}
-		// Redact sensitive sounding fields.
 		msg = "found config key"
 	} else {
 		msg = "did not find config key"
 	}
-	f.l.Debug().Dict("configkey", evt).Msg(msg)
+	s.l.Debug().Dict("configkey", evt).Msg(msg)
 }
 
-// Bool retrieves a boolean from the plugin configuration.
-//
-// The value and if the value was found are returned.
-func (f *FLBConfigStore) Bool(name string) (bool, bool) {
-	sv := f.getKey(name)
+func (s lookupStore) Bool(name string) (bool, bool) {
+	sv, found, _ := s.get(name)
 	b, err := strconv.ParseBool(sv)
-	ok := err == nil && sv != ""
-	f.logGetKey(name, b, ok)
+	ok := err == nil && found
+	s.logGetKey(name, b, ok)
 	return b, ok
 }
 
-// Duration retrieves a [time.Duration] from the plugin configuration.
-//
-// The value and if the value was found are returned.
-func (f *FLBConfigStore) Duration(name string) (time.Duration, bool) {
-	sv := f.getKey(name)
+func (s lookupStore) Duration(name string) (time.Duration, bool) {
+	sv, found, _ := s.get(name)
 	d, err := time.ParseDuration(sv)
-	ok := err == nil && sv != ""
-	f.logGetKey(name, d, ok)
+	ok := err == nil && found
+	s.logGetKey(name, d, ok)
 	return d, ok
 }
 
-// Int retrieves an integer from the plugin configuration.
-//
-// The value and if the value was found are returned.
-func (f *FLBConfigStore) Int(name string) (int, bool) {
-	sv := f.getKey(name)
+func (s lookupStore) Int(name string) (int, bool) {
+	sv, found, _ := s.get(name)
 	i, err := strconv.Atoi(sv)
-	ok := err == nil && sv != ""
-	f.logGetKey(name, i, ok)
+	ok := err == nil && found
+	s.logGetKey(name, i, ok)
 	return i, ok
 }
 
-// String retrieves a string from the plugin configuration.
-//
-// The value and if the value was found are returned.
-func (f *FLBConfigStore) String(name string) (string, bool) {
-	sv := f.getKey(name)
-	ok := sv != ""
-	f.logGetKey(name, sv, ok)
+func (s lookupStore) Bytes(name string) (int64, bool) {
+	sv, found, _ := s.get(name)
+	n, err := parseBytes(sv)
+	ok := err == nil && found
+	s.logGetKey(name, n, ok)
+	return n, ok
+}
+
+func (s lookupStore) Map(name string) (map[string]string, bool) {
+	sv, _, _ := s.get(name)
+	ss, err := splitList(sv)
+	ok := err == nil && len(ss) > 0
+	m := parseKeyValues(ss)
+	s.logGetKey(name, m, ok)
+	return m, ok
+}
+
+func (s lookupStore) String(name string) (string, bool) {
+	sv, ok, _ := s.get(name)
+	s.logGetKey(name, sv, ok)
 	return sv, ok
 }
 
-// Strings retrieves a list of strings from the plugin configuration.
+func (s lookupStore) Strings(name string) ([]string, bool) {
+	sv, _, _ := s.get(name)
+	ss, err := splitList(sv)
+	ok := err == nil && len(ss) > 0
+	s.logGetKey(name, ss, ok)
+	return ss, ok
+}
+
+// splitList splits a comma or space seperated list.
 //
-// These should be comma seperated in the configuration file. The value and if the value was found are returned.
-func (f *FLBConfigStore) Strings(name string) ([]string, bool) {
-	sv := f.getKey(name)
-	spt := func(c rune) bool {
-		return unicode.IsSpace(c) || c == ','
+// Items can be quoted with double or single quotes to include commas and spaces, e.g. "a, b",'c d'. Quotes can also
+// be used inside an item, e.g. key="a b". An error is returned if a quote isn't closed.
+func splitList(s string) ([]string, error) {
+	var (
+		items  []string
+		item   strings.Builder
+		quote  rune
+		inItem bool
+	)
+	for _, c := range s {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				item.WriteRune(c)
+			}
+		case c == '"' || c == '\'':
+			quote, inItem = c, true
+		case unicode.IsSpace(c) || c == ',':
+			if inItem {
+				items = append(items, item.String())
+				item.Reset()
+				inItem = false
+			}
+		default:
+			item.WriteRune(c)
+			inItem = true
+		}
 	}
-	ss := strings.FieldsFunc(sv, spt)
-	ok := len(ss) > 0
-	f.logGetKey(name, ss, ok)
-	return ss, ok
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	}
+	if inItem {
+		items = append(items, item.String())
+	}
+	return items, nil
+}
+
+// quoteListItem quotes a list item for splitList, if needed.
+func quoteListItem(s string) string {
+	if s == "" || strings.ContainsAny(s, ", \t\n\"'") {
+		if strings.ContainsRune(s, '"') {
+			return "'" + s + "'"
+		}
+		return `"` + s + `"`
+	}
+	return s
+}
+
+// byteUnits are the multipliers of the supported size units, in lower case.
+var byteUnits = map[string]int64{
+	"": 1, "b": 1,
+	"k": 1000, "kb": 1000, "m": 1000 * 1000, "mb": 1000 * 1000, "g": 1000 * 1000 * 1000, "gb": 1000 * 1000 * 1000,
+	"kib": 1 << 10, "mib": 1 << 20, "gib": 1 << 30,
+}
+
+// parseBytes parses a size in bytes, with an optional decimal (K, M, G) or binary (KiB, MiB, GiB) unit.
+//
+// Units are case insensitive, and may have a B suffix, e.g. 5M, 5MB and 512KiB. Negative sizes and sizes that don't
+// fit in an int64 are errors.
+func parseBytes(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, func(c rune) bool {
+		return unicode.IsLetter(c)
+	})
+	num, unit := s, ""
+	if i >= 0 {
+		num, unit = strings.TrimSpace(s[:i]), s[i:]
+	}
+	mult, ok := byteUnits[strings.ToLower(unit)]
+	if !ok {
+		return 0, fmt.Errorf("unknown size unit %q", unit)
+	}
+	if n, err := strconv.ParseInt(num, 10, 64); err == nil {
+		if n < 0 {
+			return 0, fmt.Errorf("size %q can not be negative", s)
+		}
+		if n > math.MaxInt64/mult {
+			return 0, fmt.Errorf("size %q is too large", s)
+		}
+		return n * mult, nil
+	}
+	f, err := strconv.ParseFloat(num, 64)
+	if err != nil || math.IsNaN(f) {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	if f < 0 {
+		return 0, fmt.Errorf("size %q can not be negative", s)
+	}
+	// float64(math.MaxInt64) rounds up to 2^63, which doesn't fit in an int64.
+	if f*float64(mult) >= float64(math.MaxInt64) {
+		return 0, fmt.Errorf("size %q is too large", s)
+	}
+	return int64(f * float64(mult)), nil
+}
+
+// isSensitive reports if the value of the named option should be redacted from logs.
+func isSensitive(name string) bool {
+	if o := LookupOption(name); o != nil && o.Sensitive {
+		return true
+	}
+	return sn.MatchString(name)
 }
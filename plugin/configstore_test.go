@@ -18,6 +18,8 @@
 package plugin
 
 import (
+	"math"
+	"reflect"
 	"testing"
 	"time"
 	"unsafe"
@@ -232,6 +234,11 @@ func TestFLBConfigStore_Strings(t *testing.T) {
 		"notSet":                {"", nil, false},
 		"manyStrings":           {"val1,val2,val3,val4", []string{"val1", "val2", "val3", "val4"}, true},
 		"manyStringsWithSpaces": {" val1,  val2 ,val3 , val4", []string{"val1", "val2", "val3", "val4"}, true},
+		"quoted":                {`"a, b",'c d' e`, []string{"a, b", "c d", "e"}, true},
+		"quotedInItem":          {`k="a b",k2='x,y'`, []string{"k=a b", "k2=x,y"}, true},
+		"quotedEmpty":           {`"",a`, []string{"", "a"}, true},
+		"unterminated":          {`a,"b c`, nil, false},
+		"unterminatedSingle":    {`a,'b c`, nil, false},
 	}
 
 	origGetKey := configKeyGet
@@ -272,3 +279,106 @@ func TestFLBConfigStore_Strings(t *testing.T) {
 	}
 	configKeyGet = origGetKey
 }
+
+func TestFLBConfigStore_Bytes(t *testing.T) {
+	l := zerolog.Nop()
+
+	type testData struct {
+		cv   string
+		want int64
+		ok   bool
+	}
+
+	testMap := map[string]testData{
+		"plain":            {"1024", 1024, true},
+		"bytes":            {"10B", 10, true},
+		"kilo":             {"5K", 5000, true},
+		"mega":             {"5M", 5000000, true},
+		"megaBytes":        {"5MB", 5000000, true},
+		"lowerMega":        {"5m", 5000000, true},
+		"giga":             {"1G", 1000000000, true},
+		"kibi":             {"512KiB", 512 * 1024, true},
+		"mebi":             {"10MiB", 10 << 20, true},
+		"gibi":             {"2GiB", 2 << 30, true},
+		"space":            {"10 MiB", 10 << 20, true},
+		"fraction":         {"1.5K", 1500, true},
+		"negative":         {"-1", 0, false},
+		"negativeFraction": {"-1.5M", 0, false},
+		"overflow":         {"9999999999G", 0, false},
+		"overflowFraction": {"9999999999.5G", 0, false},
+		"overflowInt":      {"99999999999999999999", 0, false},
+		"maxInt":           {"9223372036854775807", math.MaxInt64, true},
+		"maxGibi":          {"8589934591GiB", 8589934591 << 30, true},
+		"badUnit":          {"5X", 0, false},
+		"notNumeric":       {"lots", 0, false},
+		"unset":            {"", 0, false},
+	}
+
+	origGetKey := configKeyGet
+	configKeyGet = func(ctx unsafe.Pointer, name string) string {
+		if val, ok := testMap[name]; ok {
+			return val.cv
+		}
+		return ""
+	}
+
+	for k, tt := range testMap {
+		t.Run(k, func(t *testing.T) {
+			f := &FLBConfigStore{
+				ctx: nil,
+				l:   &l,
+			}
+			got, got1 := f.Bytes(k)
+			if got != tt.want {
+				t.Errorf("Bytes() val = %v, want %v", got, tt.want)
+			}
+			if got1 != tt.ok {
+				t.Errorf("Bytes() ok = %v, want_ok %v", got1, tt.ok)
+			}
+		})
+	}
+	configKeyGet = origGetKey
+}
+
+func TestFLBConfigStore_Map(t *testing.T) {
+	l := zerolog.Nop()
+
+	type testData struct {
+		cv   string
+		want map[string]string
+		ok   bool
+	}
+
+	testMap := map[string]testData{
+		"pairs":   {"team=core, env=prod", map[string]string{"team": "core", "env": "prod"}, true},
+		"keyOnly": {"team", map[string]string{"team": "team"}, true},
+		"equals":  {"expr=a=b", map[string]string{"expr": "a=b"}, true},
+		"quoted":  {`desc="two words",list='a,b'`, map[string]string{"desc": "two words", "list": "a,b"}, true},
+		"unset":   {"", map[string]string{}, false},
+	}
+
+	origGetKey := configKeyGet
+	configKeyGet = func(ctx unsafe.Pointer, name string) string {
+		if val, ok := testMap[name]; ok {
+			return val.cv
+		}
+		return ""
+	}
+
+	for k, tt := range testMap {
+		t.Run(k, func(t *testing.T) {
+			f := &FLBConfigStore{
+				ctx: nil,
+				l:   &l,
+			}
+			got, got1 := f.Map(k)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Map() val = %v, want %v", got, tt.want)
+			}
+			if got1 != tt.ok {
+				t.Errorf("Map() ok = %v, want_ok %v", got1, tt.ok)
+			}
+		})
+	}
+	configKeyGet = origGetKey
+}
@@ -0,0 +1,147 @@
+/*
+ * Copyright 2022  David MacKinnon (blaedd@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You may
+ * not use this file except in compliance with the License. A copy of the
+ * License is located at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0.txt
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/rs/zerolog"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
+)
+
+// Credential sources, as reported in logs and errors.
+const (
+	credsSourceFile    = "credentials_file"
+	credsSourceJSON    = "credentials_json"
+	credsSourceDefault = "application default credentials"
+)
+
+// defaultScopes are the OAuth scopes requested unless oauth_scopes is set.
+var defaultScopes = []string{pubsub.ScopePubSub, pubsub.ScopeCloudPlatform}
+
+// credentialsType returns the type field of a JSON credentials file, e.g. service_account or external_account.
+func credentialsType(data []byte) (string, error) {
+	var f struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(data, &f); err != nil {
+		return "", fmt.Errorf("invalid JSON: %w", err)
+	}
+	if f.Type == "" {
+		return "", fmt.Errorf("missing credentials type")
+	}
+	return f.Type, nil
+}
+
+// findCredentials loads the credentials from the configured source.
+//
+// The source and the type of the credentials are returned along with the credentials.
+func (c *OutputPluginConfig) findCredentials(ctx context.Context, scopes []string) (*google.Credentials, string, string, error) {
+	var (
+		data []byte
+		src  string
+	)
+	switch {
+	case c.Crds != "":
+		src = credsSourceFile
+		b, err := os.ReadFile(c.Crds)
+		if err != nil {
+			return nil, src, "", fmt.Errorf("%s: %w", src, err)
+		}
+		data = b
+	case c.CrdsJSON != "":
+		src = credsSourceJSON
+		data = []byte(c.CrdsJSON)
+	default:
+		src = credsSourceDefault
+		creds, err := google.FindDefaultCredentials(ctx, scopes...)
+		if err != nil {
+			return nil, src, "", fmt.Errorf("%s: %w", src, err)
+		}
+		typ := "unknown"
+		if len(creds.JSON) > 0 {
+			typ, _ = credentialsType(creds.JSON)
+		} else {
+			typ = "metadata server"
+		}
+		return creds, src, typ, nil
+	}
+
+	typ, err := credentialsType(data)
+	if err != nil {
+		return nil, src, "", fmt.Errorf("%s: %w", src, err)
+	}
+	creds, err := google.CredentialsFromJSON(ctx, data, scopes...)
+	if err != nil {
+		return nil, src, typ, fmt.Errorf("%s: unable to load %s credentials: %w", src, typ, err)
+	}
+	return creds, src, typ, nil
+}
+
+// clientOptions creates the authentication related options for the PubSub client.
+func (c *OutputPluginConfig) clientOptions(ctx context.Context, l *zerolog.Logger) ([]option.ClientOption, error) {
+	if host := os.Getenv("PUBSUB_EMULATOR_HOST"); host != "" {
+		l.Info().Str("emulator", host).Msg("using PubSub emulator, ignoring credentials")
+		return nil, nil
+	}
+	scopes := c.Scopes
+	if len(scopes) == 0 {
+		scopes = defaultScopes
+	}
+	baseScopes := scopes
+	if c.Impersonate != "" {
+		// The source credentials only need to be able to create tokens for the target.
+		baseScopes = []string{pubsub.ScopeCloudPlatform}
+	}
+
+	creds, src, typ, err := c.findCredentials(ctx, baseScopes)
+	if err != nil {
+		l.Error().Err(err).Str("credentials_source", src).Msg("unable to load credentials")
+		return nil, err
+	}
+	l.Info().Str("credentials_source", src).Str("credentials_type", typ).Msg("using credentials")
+
+	var opts []option.ClientOption
+	if c.Impersonate != "" {
+		ts, err := impersonate.CredentialsTokenSource(ctx, impersonate.CredentialsConfig{
+			TargetPrincipal: c.Impersonate,
+			Scopes:          scopes,
+			Delegates:       c.Delegates,
+		}, option.WithCredentials(creds))
+		if err != nil {
+			err = fmt.Errorf("unable to impersonate %s using %s: %w", c.Impersonate, src, err)
+			l.Error().Err(err).Msg("unable to impersonate service account")
+			return nil, err
+		}
+		l.Info().Str("service_account", c.Impersonate).Strs("delegates", c.Delegates).Msg(
+			"impersonating service account")
+		opts = append(opts, option.WithTokenSource(ts))
+	} else {
+		opts = append(opts, option.WithCredentials(creds))
+	}
+	if c.QuotaProject != "" {
+		opts = append(opts, option.WithQuotaProject(c.QuotaProject))
+	}
+	return opts, nil
+}
@@ -0,0 +1,172 @@
+/*
+ * Copyright 2022  David MacKinnon (blaedd@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You may
+ * not use this file except in compliance with the License. A copy of the
+ * License is located at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0.txt
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	testServiceAccountJSON = `{"type": "service_account", "project_id": "proj", "private_key_id": "1",
+		"private_key": "not a key", "client_email": "sa@proj.iam.gserviceaccount.com", "client_id": "1",
+		"token_uri": "https://oauth2.googleapis.com/token"}`
+	testExternalAccountJSON = `{"type": "external_account",
+		"audience": "//iam.googleapis.com/projects/1/locations/global/workloadIdentityPools/pool/providers/aws",
+		"subject_token_type": "urn:ietf:params:oauth:token-type:jwt", "token_url": "https://sts.googleapis.com/v1/token",
+		"credential_source": {"file": "/var/run/token"}}`
+)
+
+func TestCredentialsType(t *testing.T) {
+	type testData struct {
+		data    string
+		want    string
+		wantErr string
+	}
+	testMap := map[string]testData{
+		"serviceAccount":  {data: testServiceAccountJSON, want: "service_account"},
+		"externalAccount": {data: testExternalAccountJSON, want: "external_account"},
+		"invalidJSON":     {data: `{"type": `, wantErr: "invalid JSON"},
+		"missingType":     {data: `{"project_id": "proj"}`, wantErr: "missing credentials type"},
+	}
+	for k, tt := range testMap {
+		t.Run(k, func(t *testing.T) {
+			got, err := credentialsType([]byte(tt.data))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("credentialsType() err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("credentialsType() err = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("credentialsType() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOutputPluginConfig_findCredentials(t *testing.T) {
+	dir := t.TempDir()
+	writeFile := func(name, data string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	saFile := writeFile("sa.json", testServiceAccountJSON)
+	extFile := writeFile("ext.json", testExternalAccountJSON)
+	badFile := writeFile("bad.json", "not json")
+
+	type testData struct {
+		cfg     OutputPluginConfig
+		wantSrc string
+		wantTyp string
+		wantErr string
+	}
+	testMap := map[string]testData{
+		"file":         {cfg: OutputPluginConfig{Crds: saFile}, wantSrc: credsSourceFile, wantTyp: "service_account"},
+		"json":         {cfg: OutputPluginConfig{CrdsJSON: testServiceAccountJSON}, wantSrc: credsSourceJSON, wantTyp: "service_account"},
+		"externalFile": {cfg: OutputPluginConfig{Crds: extFile}, wantSrc: credsSourceFile, wantTyp: "external_account"},
+		"externalJSON": {cfg: OutputPluginConfig{CrdsJSON: testExternalAccountJSON}, wantSrc: credsSourceJSON,
+			wantTyp: "external_account"},
+		"missingFile": {cfg: OutputPluginConfig{Crds: filepath.Join(dir, "missing.json")}, wantSrc: credsSourceFile,
+			wantErr: "credentials_file:"},
+		"invalidFile": {cfg: OutputPluginConfig{Crds: badFile}, wantSrc: credsSourceFile,
+			wantErr: "credentials_file: invalid JSON"},
+		"invalidJSON": {cfg: OutputPluginConfig{CrdsJSON: "{"}, wantSrc: credsSourceJSON,
+			wantErr: "credentials_json: invalid JSON"},
+		"unsupportedType": {cfg: OutputPluginConfig{CrdsJSON: `{"type": "frobnicator"}`}, wantSrc: credsSourceJSON,
+			wantTyp: "frobnicator", wantErr: "credentials_json: unable to load frobnicator credentials"},
+	}
+	for k, tt := range testMap {
+		t.Run(k, func(t *testing.T) {
+			creds, src, typ, err := tt.cfg.findCredentials(context.Background(), defaultScopes)
+			if src != tt.wantSrc || typ != tt.wantTyp {
+				t.Errorf("findCredentials() source, type = %q, %q, want %q, %q", src, typ, tt.wantSrc, tt.wantTyp)
+			}
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("findCredentials() err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("findCredentials() err = %v", err)
+			}
+			if creds == nil || creds.TokenSource == nil {
+				t.Errorf("findCredentials() credentials = %v, want a token source", creds)
+			}
+		})
+	}
+}
+
+func TestOutputPluginConfig_clientOptions(t *testing.T) {
+	type testData struct {
+		cfg      OutputPluginConfig
+		emulator string
+		want     []string // The types of the returned options.
+		wantErr  string
+	}
+	testMap := map[string]testData{
+		"credentials": {cfg: OutputPluginConfig{CrdsJSON: testServiceAccountJSON},
+			want: []string{"*option.withCreds"}},
+		"impersonate": {cfg: OutputPluginConfig{CrdsJSON: testServiceAccountJSON,
+			Impersonate: "target@proj.iam.gserviceaccount.com"}, want: []string{"option.withTokenSource"}},
+		"impersonateDelegates": {cfg: OutputPluginConfig{CrdsJSON: testServiceAccountJSON,
+			Impersonate: "target@proj.iam.gserviceaccount.com",
+			Delegates:   []string{"hop@proj.iam.gserviceaccount.com"}, QuotaProject: "billing"},
+			want: []string{"option.withTokenSource", "option.withQuotaProject"}},
+		"quotaProject": {cfg: OutputPluginConfig{CrdsJSON: testServiceAccountJSON, QuotaProject: "billing"},
+			want: []string{"*option.withCreds", "option.withQuotaProject"}},
+		"invalid":  {cfg: OutputPluginConfig{CrdsJSON: "{"}, wantErr: "credentials_json"},
+		"emulator": {cfg: OutputPluginConfig{CrdsJSON: "{"}, emulator: "localhost:8085"},
+	}
+	l := zerolog.Nop()
+	for k, tt := range testMap {
+		t.Run(k, func(t *testing.T) {
+			t.Setenv("PUBSUB_EMULATOR_HOST", tt.emulator)
+			opts, err := tt.cfg.clientOptions(context.Background(), &l)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("clientOptions() err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("clientOptions() err = %v", err)
+			}
+			got := make([]string, 0, len(opts))
+			for _, o := range opts {
+				got = append(got, fmt.Sprintf("%T", o))
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("clientOptions() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
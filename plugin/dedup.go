@@ -0,0 +1,247 @@
+/*
+ * Copyright 2022  David MacKinnon (blaedd@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You may
+ * not use this file except in compliance with the License. A copy of the
+ * License is located at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0.txt
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package plugin
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// DedupConfig holds the duplicate suppression settings.
+type DedupConfig struct {
+	Window    time.Duration // How long records are remembered. Zero disables duplicate suppression.
+	Fields    []string      // Record fields that identify duplicates. The whole record and its timestamp if empty.
+	MaxMemory int64         // Approximate memory used to remember records.
+	Attribute string        // Attribute set to the record hash. Not set if empty.
+}
+
+// DefaultDedupConfig holds the default duplicate suppression settings.
+var DefaultDedupConfig = DedupConfig{MaxMemory: 16 << 20, Attribute: "dedup_id"}
+
+// dedupEntrySize is the approximate memory used by each remembered record, including the map and list overhead.
+const dedupEntrySize = 128
+
+// dedupKey is the hash identifying a record.
+type dedupKey [16]byte
+
+func (k dedupKey) String() string {
+	return hex.EncodeToString(k[:])
+}
+
+type dedupEntry struct {
+	key  dedupKey
+	seen time.Time
+}
+
+// deduper drops records seen within a time window. A nil deduper keeps every record.
+//
+// Records are only remembered once they are published or spooled, so the records of a chunk that fluent-bit retries
+// aren't dropped as duplicates of themselves.
+type deduper struct {
+	cfg     DedupConfig
+	max     int
+	now     func() time.Time
+	dropped atomic.Int64
+
+	mu    sync.Mutex
+	seen  map[dedupKey]*list.Element
+	order *list.List // Of *dedupEntry, oldest first.
+}
+
+// newDeduper creates a deduper, or returns nil if it is disabled.
+func newDeduper(cfg *DedupConfig) *deduper {
+	if cfg.Window <= 0 {
+		return nil
+	}
+	max := int(cfg.MaxMemory / dedupEntrySize)
+	if max < 1 {
+		max = 1
+	}
+	return &deduper{cfg: *cfg, max: max, now: time.Now, seen: make(map[dedupKey]*list.Element), order: list.New()}
+}
+
+// writeValue writes a canonical encoding of v. Map keys are sorted by encoding/json.
+func writeValue(h hash.Hash, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		// Values that can't be encoded as JSON, such as maps with non-string keys, are still hashed consistently.
+		b = []byte(fmt.Sprintf("%#v", v))
+	}
+	_, _ = h.Write(b)
+}
+
+// key returns the hash of the record and its timestamp, or the configured fields of the record.
+//
+// The timestamp is part of the whole record hash so that records repeated at different times, e.g. a health check
+// logging "ok" every second, aren't dropped. Retried chunks keep their timestamps, but lines read again by the tail
+// input only do if the parser takes the time from the line.
+func (d *deduper) key(ts time.Time, record map[string]interface{}) dedupKey {
+	h := sha256.New()
+	if len(d.cfg.Fields) == 0 {
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], uint64(ts.UnixNano()))
+		_, _ = h.Write(b[:])
+		writeValue(h, record)
+	}
+	for _, f := range d.cfg.Fields {
+		_, _ = h.Write([]byte(f))
+		if v, ok := lookupField(record, f); ok {
+			_, _ = h.Write([]byte{0})
+			writeValue(h, v)
+		}
+		_, _ = h.Write([]byte{0xff})
+	}
+	var k dedupKey
+	copy(k[:], h.Sum(nil))
+	return k
+}
+
+// expire forgets records older than the window. d.mu must be held.
+func (d *deduper) expire(now time.Time) {
+	for e := d.order.Front(); e != nil; e = d.order.Front() {
+		if now.Sub(e.Value.(*dedupEntry).seen) < d.cfg.Window {
+			return
+		}
+		delete(d.seen, e.Value.(*dedupEntry).key)
+		d.order.Remove(e)
+	}
+}
+
+// duplicate reports if the record with key k was seen within the window, counting it as dropped if so.
+func (d *deduper) duplicate(k dedupKey) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.expire(d.now())
+	if _, ok := d.seen[k]; ok {
+		d.dropped.Add(1)
+		return true
+	}
+	return false
+}
+
+// remember records that the records with keys were seen. When the memory budget is used up the oldest records are
+// forgotten.
+func (d *deduper) remember(keys []dedupKey) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := d.now()
+	for _, k := range keys {
+		if _, ok := d.seen[k]; ok {
+			continue
+		}
+		if d.order.Len() >= d.max {
+			e := d.order.Front()
+			delete(d.seen, e.Value.(*dedupEntry).key)
+			d.order.Remove(e)
+		}
+		d.seen[k] = d.order.PushBack(&dedupEntry{key: k, seen: now})
+	}
+}
+
+// size returns the number of remembered records.
+func (d *deduper) size() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.order.Len()
+}
+
+// dedupBatch tracks the keys of the records in a chunk.
+type dedupBatch struct {
+	d    *deduper
+	keys map[*pubsub.Message]dedupKey
+	// seen holds the keys in the chunk, so duplicates within a chunk are also dropped.
+	seen map[dedupKey]bool
+}
+
+// batch starts tracking the records of a chunk.
+func (d *deduper) batch() *dedupBatch {
+	if d == nil {
+		return nil
+	}
+	return &dedupBatch{d: d, keys: make(map[*pubsub.Message]dedupKey), seen: make(map[dedupKey]bool)}
+}
+
+// check reports if the record with timestamp ts is a duplicate, and returns its key otherwise.
+func (b *dedupBatch) check(ts time.Time, record map[string]interface{}) (dedupKey, bool) {
+	if b == nil {
+		return dedupKey{}, false
+	}
+	k := b.d.key(ts, record)
+	if b.seen[k] {
+		b.d.dropped.Add(1)
+		return k, true
+	}
+	if b.d.duplicate(k) {
+		return k, true
+	}
+	b.seen[k] = true
+	return k, false
+}
+
+// add associates the key of a record with its message, setting the dedup attribute if configured.
+func (b *dedupBatch) add(msg *pubsub.Message, k dedupKey) {
+	if b == nil {
+		return
+	}
+	b.keys[msg] = k
+	if b.d.cfg.Attribute != "" {
+		msg.Attributes[b.d.cfg.Attribute] = k.String()
+	}
+}
+
+// done remembers the records of msgs, which have been published or spooled.
+func (b *dedupBatch) done(msgs []*pubsub.Message) {
+	if b == nil || len(msgs) == 0 {
+		return
+	}
+	keys := make([]dedupKey, 0, len(msgs))
+	for _, msg := range msgs {
+		if k, ok := b.keys[msg]; ok {
+			keys = append(keys, k)
+		}
+	}
+	b.d.remember(keys)
+}
+
+// doneExcept remembers the records of msgs, other than those that failed to publish.
+func (b *dedupBatch) doneExcept(msgs, failed []*pubsub.Message) {
+	if b == nil {
+		return
+	}
+	skip := make(map[*pubsub.Message]bool, len(failed))
+	for _, msg := range failed {
+		skip[msg] = true
+	}
+	published := make([]*pubsub.Message, 0, len(msgs))
+	for _, msg := range msgs {
+		if !skip[msg] {
+			published = append(published, msg)
+		}
+	}
+	b.done(published)
+}
@@ -0,0 +1,147 @@
+/*
+ * Copyright 2022  David MacKinnon (blaedd@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You may
+ * not use this file except in compliance with the License. A copy of the
+ * License is located at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0.txt
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package plugin
+
+import (
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+func TestDeduper_key(t *testing.T) {
+	ts := time.Unix(1600000000, 0)
+	type testData struct {
+		fields   []string
+		a, b     map[string]interface{}
+		bLater   bool // b has a later timestamp than a.
+		wantSame bool
+	}
+	testMap := map[string]testData{
+		"sameRecord": {a: map[string]interface{}{"log": "hi", "n": 1, "k": map[string]interface{}{"x": "1", "y": "2"}},
+			b: map[string]interface{}{"k": map[string]interface{}{"y": "2", "x": "1"}, "n": 1, "log": "hi"}, wantSame: true},
+		"differentRecord": {a: map[string]interface{}{"log": "hi"}, b: map[string]interface{}{"log": "hi", "n": 1}},
+		// The same line logged again later isn't a duplicate.
+		"differentTime": {a: map[string]interface{}{"log": "ok"}, b: map[string]interface{}{"log": "ok"}, bLater: true},
+		"sameFields": {fields: []string{"log", "k.pod"},
+			a:        map[string]interface{}{"log": "hi", "k": map[string]interface{}{"pod": "web"}, "offset": 1},
+			b:        map[string]interface{}{"log": "hi", "k": map[string]interface{}{"pod": "web"}, "offset": 2},
+			wantSame: true},
+		"sameFieldsDifferentTime": {fields: []string{"log"}, a: map[string]interface{}{"log": "hi"},
+			b: map[string]interface{}{"log": "hi"}, bLater: true, wantSame: true},
+		"differentFields": {fields: []string{"log", "k.pod"},
+			a: map[string]interface{}{"log": "hi", "k": map[string]interface{}{"pod": "web"}},
+			b: map[string]interface{}{"log": "hi", "k": map[string]interface{}{"pod": "db"}}},
+		// A missing field isn't the same as an empty one.
+		"missingField": {fields: []string{"log", "app"}, a: map[string]interface{}{"log": "hi"},
+			b: map[string]interface{}{"log": "hi", "app": ""}},
+	}
+	for k, tt := range testMap {
+		t.Run(k, func(t *testing.T) {
+			d := newDeduper(&DedupConfig{Window: time.Minute, Fields: tt.fields, MaxMemory: 1 << 20})
+			tsB := ts
+			if tt.bLater {
+				tsB = ts.Add(time.Second)
+			}
+			if same := d.key(ts, tt.a) == d.key(tsB, tt.b); same != tt.wantSame {
+				t.Errorf("key() of %v and %v equal = %v, want %v", tt.a, tt.b, same, tt.wantSame)
+			}
+		})
+	}
+}
+
+// flushRecords runs records through a dedup batch as Flush does, returning the messages created. Messages with
+// data in failed are treated as failing to publish.
+func flushRecords(d *deduper, logs []string, failed map[string]bool) []*pubsub.Message {
+	b := d.batch()
+	var msgs, failedMsgs []*pubsub.Message
+	for _, l := range logs {
+		k, dup := b.check(time.Unix(1600000000, 0), map[string]interface{}{"log": l})
+		if dup {
+			continue
+		}
+		msg := &pubsub.Message{Data: []byte(l), Attributes: map[string]string{}}
+		b.add(msg, k)
+		msgs = append(msgs, msg)
+		if failed[l] {
+			failedMsgs = append(failedMsgs, msg)
+		}
+	}
+	b.doneExcept(msgs, failedMsgs)
+	return msgs
+}
+
+func messageData(msgs []*pubsub.Message) []string {
+	data := make([]string, len(msgs))
+	for i, m := range msgs {
+		data[i] = string(m.Data)
+	}
+	return data
+}
+
+func TestDeduper(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	d := newDeduper(&DedupConfig{Window: time.Minute, MaxMemory: 3 * dedupEntrySize, Attribute: "dedup_id"})
+	d.now = func() time.Time { return now }
+
+	msgs := flushRecords(d, []string{"a", "b", "a", "c"}, map[string]bool{"c": true})
+	if got := messageData(msgs); len(got) != 3 {
+		t.Fatalf("first flush published %v, want a, b and c", got)
+	}
+	if id := msgs[0].Attributes["dedup_id"]; len(id) != 32 {
+		t.Errorf("dedup_id = %q, want a 32 character hash", id)
+	}
+	// The failed record is published again on retry.
+	now = now.Add(30 * time.Second)
+	if got := messageData(flushRecords(d, []string{"a", "b", "c"}, nil)); len(got) != 1 || got[0] != "c" {
+		t.Errorf("retried flush published %v, want [c]", got)
+	}
+	if n := d.dropped.Load(); n != 3 {
+		t.Errorf("dropped = %d, want 3", n)
+	}
+	// a and b expire, while c is still in the window.
+	now = now.Add(45 * time.Second)
+	if got := messageData(flushRecords(d, []string{"a", "b", "c"}, nil)); len(got) != 2 {
+		t.Errorf("flush after the window published %v, want [a b]", got)
+	}
+	// Only 3 records fit in the memory budget, so the oldest, c, is forgotten.
+	flushRecords(d, []string{"d"}, nil)
+	if n := d.size(); n != 3 {
+		t.Errorf("size() = %d, want 3", n)
+	}
+	if got := messageData(flushRecords(d, []string{"c"}, nil)); len(got) != 1 {
+		t.Errorf("flush of a forgotten record published %v, want [c]", got)
+	}
+}
+
+func TestNewDeduper_disabled(t *testing.T) {
+	d := newDeduper(&DefaultDedupConfig)
+	if d != nil {
+		t.Fatal("newDeduper() with the defaults isn't nil")
+	}
+	b := d.batch()
+	if _, dup := b.check(time.Now(), map[string]interface{}{"log": "a"}); dup {
+		t.Error("check() of a nil batch reports a duplicate")
+	}
+	msg := &pubsub.Message{Attributes: map[string]string{}}
+	b.add(msg, dedupKey{})
+	b.done([]*pubsub.Message{msg})
+	if len(msg.Attributes) != 0 {
+		t.Errorf("add() of a nil batch set attributes %v", msg.Attributes)
+	}
+}
@@ -0,0 +1,125 @@
+/*
+ * Copyright 2022  David MacKinnon (blaedd@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You may
+ * not use this file except in compliance with the License. A copy of the
+ * License is located at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0.txt
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package plugin
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// docValue formats a default or example value for a markdown table, quoting values containing template or
+// environment variable syntax.
+func docValue(s string) string {
+	if strings.Contains(s, "{{") || strings.Contains(s, "${") {
+		return "`" + s + "`"
+	}
+	return s
+}
+
+// docRow returns the markdown table cells documenting the option.
+func (o *Option) docRow(examples bool) []string {
+	name := o.Name
+	if o.Required {
+		name = "**" + name + "**"
+	}
+	desc := o.Description
+	if len(o.Values) > 0 {
+		vs := make([]string, len(o.Values))
+		for i, v := range o.Values {
+			vs[i] = "`" + v + "`"
+		}
+		desc += " One of " + strings.Join(vs[:len(vs)-1], ", ") + " or " + vs[len(vs)-1] + "."
+	}
+	def := o.DocDefault
+	if def == "" {
+		def = docValue(o.Default)
+	}
+	if def == "" {
+		def = "None"
+	}
+	row := []string{name, desc, o.Type.String(), def}
+	if examples {
+		row = append(row, docValue(o.Example))
+	}
+	return row
+}
+
+// OptionsMarkdown returns a markdown table documenting the options in group.
+func OptionsMarkdown(group string) string {
+	header := []string{"Option Name", "Description", "Type", "Default", "Example"}
+	examples := false
+	var opts []*Option
+	for _, o := range Options {
+		if o.Group == group {
+			opts = append(opts, o)
+			examples = examples || o.Example != ""
+		}
+	}
+	if !examples {
+		header = header[:4]
+	}
+	rows := [][]string{header}
+	for _, o := range opts {
+		rows = append(rows, o.docRow(examples))
+	}
+
+	widths := make([]int, len(header))
+	for _, row := range rows {
+		for i, cell := range row {
+			if n := utf8.RuneCountInString(cell); n > widths[i] {
+				widths[i] = n
+			}
+		}
+	}
+	var b strings.Builder
+	for r, row := range rows {
+		for i, cell := range row {
+			fmt.Fprintf(&b, "| %s%s ", cell, strings.Repeat(" ", widths[i]-utf8.RuneCountInString(cell)))
+		}
+		b.WriteString("|\n")
+		if r == 0 {
+			for _, w := range widths {
+				fmt.Fprintf(&b, "|%s", strings.Repeat("-", w+2))
+			}
+			b.WriteString("|\n")
+		}
+	}
+	return b.String()
+}
+
+// UpdateOptionsDoc replaces the option tables in a markdown document with the generated tables.
+//
+// Each table is between a <!-- options:GROUP --> and a <!-- /options:GROUP --> marker.
+func UpdateOptionsDoc(doc []byte) ([]byte, error) {
+	for _, group := range []string{GroupGeneral, GroupTopic, GroupRetry, GroupBatch, GroupCloudEvents,
+		GroupLogEntry, GroupRaw, GroupTracing, GroupLogging, GroupHealth, GroupSpool, GroupBreaker,
+		GroupRateLimit, GroupSampling, GroupDedup} {
+		begin := []byte(fmt.Sprintf("<!-- options:%s -->\n", group))
+		end := []byte(fmt.Sprintf("<!-- /options:%s -->", group))
+		i := bytes.Index(doc, begin)
+		j := bytes.Index(doc, end)
+		if i < 0 || j < i {
+			return nil, fmt.Errorf("missing markers for the %s options", group)
+		}
+		i += len(begin)
+		doc = append(doc[:i:i], append([]byte(OptionsMarkdown(group)), doc[j:]...)...)
+	}
+	return doc, nil
+}
@@ -0,0 +1,98 @@
+/*
+ * Copyright 2022  David MacKinnon (blaedd@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You may
+ * not use this file except in compliance with the License. A copy of the
+ * License is located at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0.txt
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/template"
+	"time"
+)
+
+// Supported message payload formats.
+const (
+	FormatJSON        = "json"
+	FormatCloudEvents = "cloudevents"
+	FormatLogEntry    = "logentry"
+	FormatRaw         = "raw"
+	FormatMsgpack     = "msgpack"
+)
+
+// A recordEncoder encodes a fluent-bit record as the data of a pubsub.Message.
+//
+// Encoders may also add to the message attributes.
+type recordEncoder interface {
+	Encode(ts time.Time, tag string, record map[string]interface{}, attrs map[string]string) ([]byte, error)
+}
+
+// jsonEncoder encodes the whole record as a JSON object.
+type jsonEncoder struct{}
+
+func (jsonEncoder) Encode(_ time.Time, _ string, record map[string]interface{}, _ map[string]string) ([]byte, error) {
+	return json.Marshal(record)
+}
+
+// templateEncoder renders records through a text/template.
+type templateEncoder struct {
+	t *template.Template
+}
+
+func newTemplateEncoder(text string) (*templateEncoder, error) {
+	t, err := newRecordTemplate("data_template", text)
+	if err != nil {
+		return nil, err
+	}
+	return &templateEncoder{t: t}, nil
+}
+
+func (e *templateEncoder) Encode(ts time.Time, tag string, record map[string]interface{}, _ map[string]string) ([]byte, error) {
+	b, err := execTemplate(e.t, &RecordData{Tag: tag, Time: ts, Record: record})
+	if err != nil {
+		return nil, fmt.Errorf("unable to render data_template: %w", err)
+	}
+	return b, nil
+}
+
+// newEncoder creates the recordEncoder for the configured payload format, reading records from r.
+func (c *OutputPluginConfig) newEncoder(r *FLBRecordReader) (recordEncoder, error) {
+	switch c.Fmt {
+	case "", FormatJSON:
+		if c.TmplFile != "" {
+			b, err := os.ReadFile(c.TmplFile)
+			if err != nil {
+				return nil, fmt.Errorf("unable to read data_template_file: %w", err)
+			}
+			return newTemplateEncoder(string(b))
+		}
+		if c.Tmpl != "" {
+			return newTemplateEncoder(c.Tmpl)
+		}
+		return jsonEncoder{}, nil
+	case FormatCloudEvents:
+		return newCloudEventsEncoder(&c.CE)
+	case FormatLogEntry:
+		return newLogEntryEncoder(&c.LE, c.PID)
+	case FormatRaw:
+		return newRawEncoder(&c.Raw)
+	case FormatMsgpack:
+		return newMsgpackEncoder(r, c.TSField), nil
+	default:
+		return nil, fmt.Errorf("unsupported format %q", c.Fmt)
+	}
+}
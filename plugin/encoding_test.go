@@ -0,0 +1,405 @@
+/*
+ * Copyright 2022  David MacKinnon (blaedd@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You may
+ * not use this file except in compliance with the License. A copy of the
+ * License is located at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0.txt
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ugorji/go/codec"
+)
+
+func TestCloudEventsEncoder(t *testing.T) {
+	ts := time.Date(2022, 8, 30, 7, 51, 57, 0, time.UTC)
+	type testData struct {
+		mode      string
+		subject   string
+		wantAttrs map[string]string
+	}
+	testMap := map[string]testData{
+		"binary": {CloudEventsBinary, "{{.Tag}}", map[string]string{
+			"content-type":   "application/json",
+			"ce-specversion": "1.0",
+			"ce-id":          "app.log-web",
+			"ce-source":      "fluent-bit",
+			"ce-type":        "io.fluentbit.record",
+			"ce-subject":     "app.log",
+			"ce-time":        "2022-08-30T07:51:57Z",
+		}},
+		"binaryNoSubject": {CloudEventsBinary, "", map[string]string{
+			"content-type":   "application/json",
+			"ce-specversion": "1.0",
+			"ce-id":          "app.log-web",
+			"ce-source":      "fluent-bit",
+			"ce-type":        "io.fluentbit.record",
+			"ce-time":        "2022-08-30T07:51:57Z",
+		}},
+		"structured": {CloudEventsStructured, "{{.Tag}}", map[string]string{
+			"content-type": "application/cloudevents+json",
+		}},
+	}
+
+	for k, tt := range testMap {
+		t.Run(k, func(t *testing.T) {
+			cfg := DefaultCloudEventsConfig
+			cfg.Mode = tt.mode
+			cfg.ID = "{{.Tag}}-{{.Record.app}}"
+			cfg.Subject = tt.subject
+			e, err := newCloudEventsEncoder(&cfg)
+			if err != nil {
+				t.Fatalf("newCloudEventsEncoder() err = %v", err)
+			}
+			attrs := make(map[string]string)
+			b, err := e.Encode(ts, "app.log", map[string]interface{}{"app": "web"}, attrs)
+			if err != nil {
+				t.Fatalf("Encode() err = %v", err)
+			}
+			if len(attrs) != len(tt.wantAttrs) {
+				t.Errorf("Encode() attrs = %v, want %v", attrs, tt.wantAttrs)
+			}
+			for ak, av := range tt.wantAttrs {
+				if attrs[ak] != av {
+					t.Errorf("Encode() attrs[%s] = %q, want %q", ak, attrs[ak], av)
+				}
+			}
+			var got map[string]interface{}
+			if err := json.Unmarshal(b, &got); err != nil {
+				t.Fatalf("Encode() produced invalid JSON: %v", err)
+			}
+			if tt.mode == CloudEventsStructured {
+				if got["id"] != "app.log-web" || got["specversion"] != "1.0" || got["subject"] != "app.log" {
+					t.Errorf("Encode() event = %v", got)
+				}
+				got, _ = got["data"].(map[string]interface{})
+			}
+			if got["app"] != "web" {
+				t.Errorf("Encode() data = %v, want record", got)
+			}
+		})
+	}
+}
+
+func TestCloudEventsEncoder_defaultID(t *testing.T) {
+	ts := time.Date(2022, 8, 30, 7, 51, 57, 0, time.UTC)
+	e, err := newCloudEventsEncoder(&DefaultCloudEventsConfig)
+	if err != nil {
+		t.Fatalf("newCloudEventsEncoder() err = %v", err)
+	}
+	id := func(ts time.Time) string {
+		attrs := make(map[string]string)
+		if _, err := e.Encode(ts, "app.log", map[string]interface{}{"log": "hello"}, attrs); err != nil {
+			t.Fatalf("Encode() err = %v", err)
+		}
+		return attrs["ce-id"]
+	}
+	// A retried record keeps its id.
+	first := id(ts)
+	if len(first) != 32 || id(ts) != first {
+		t.Errorf("Encode() ce-id = %q then %q, want the same 32 character hash", first, id(ts))
+	}
+	if id(ts.Add(time.Second)) == first {
+		t.Errorf("Encode() ce-id of a record at another time = %q, want a different id", first)
+	}
+}
+
+func TestCloudEventsConfig_Validate(t *testing.T) {
+	cfg := DefaultCloudEventsConfig
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Validate() default config err = %v", err)
+	}
+	cfg.Mode = "batched"
+	if err := cfg.Validate(); err == nil {
+		t.Errorf("Validate() accepted mode %q", cfg.Mode)
+	}
+	cfg = DefaultCloudEventsConfig
+	cfg.Type = "{{.Tag"
+	if _, err := newCloudEventsEncoder(&cfg); err == nil {
+		t.Errorf("newCloudEventsEncoder() accepted invalid template")
+	}
+}
+
+func TestLogEntryEncoder(t *testing.T) {
+	ts := time.Date(2022, 8, 30, 7, 51, 57, 0, time.UTC)
+	type testData struct {
+		record  map[string]interface{}
+		payload string
+		want    map[string]interface{}
+	}
+	k8s := func() map[string]interface{} {
+		return map[string]interface{}{
+			"log":    "hello",
+			"level":  "warn",
+			"stream": "stderr",
+			"kubernetes": map[string]interface{}{
+				"namespace_name": "default", "pod_name": "web-0", "container_name": "web"},
+			"logging.googleapis.com/trace":  "abc123",
+			"logging.googleapis.com/labels": map[string]interface{}{"team": "core"},
+		}
+	}
+	testMap := map[string]testData{
+		"kubernetesAuto": {k8s(), PayloadAuto, map[string]interface{}{
+			"logName":   "projects/proj/logs/kube.web",
+			"timestamp": "2022-08-30T07:51:57Z",
+			"severity":  "WARNING",
+			"trace":     "projects/proj/traces/abc123",
+			"resource": map[string]interface{}{"type": "k8s_container", "labels": map[string]interface{}{
+				"project_id": "proj", "namespace_name": "default", "pod_name": "web-0", "container_name": "web"}},
+			"labels": map[string]interface{}{"team": "core"},
+		}},
+		"kubernetesText": {k8s(), PayloadText, map[string]interface{}{"textPayload": "hello"}},
+		"onlyMessage": {map[string]interface{}{"message": "hi", "severity": 500}, PayloadAuto,
+			map[string]interface{}{"textPayload": "hi", "severity": "ERROR"}},
+		"timestampRFC3339": {map[string]interface{}{"message": "hi", "time": "2022-08-30T09:51:57.25+02:00"},
+			PayloadJSON, map[string]interface{}{"timestamp": "2022-08-30T07:51:57.25Z",
+				"jsonPayload": map[string]interface{}{"message": "hi"}}},
+		"timestampEpochSeconds": {map[string]interface{}{"message": "hi", "time": 1661845917.5}, PayloadAuto,
+			map[string]interface{}{"timestamp": "2022-08-30T07:51:57.5Z", "textPayload": "hi"}},
+		"timestampEpochMillis": {map[string]interface{}{"message": "hi", "time": int64(1661845917123)}, PayloadAuto,
+			map[string]interface{}{"timestamp": "2022-08-30T07:51:57.123Z", "textPayload": "hi"}},
+		"timestampEpochNanos": {map[string]interface{}{"message": "hi", "time": "1661845917000000001"}, PayloadAuto,
+			map[string]interface{}{"timestamp": "2022-08-30T07:51:57.000000001Z", "textPayload": "hi"}},
+		// Unparseable times fall back to the fluent-bit timestamp, and are left in the payload.
+		"timestampInvalid": {map[string]interface{}{"message": "hi", "time": "yesterday"}, PayloadJSON,
+			map[string]interface{}{"timestamp": "2022-08-30T07:51:57Z",
+				"jsonPayload": map[string]interface{}{"message": "hi", "time": "yesterday"}}},
+	}
+	for k, tt := range testMap {
+		t.Run(k, func(t *testing.T) {
+			cfg := DefaultLogEntryConfig
+			cfg.Payload = tt.payload
+			cfg.TimestampField = "time"
+			e, err := newLogEntryEncoder(&cfg, "proj")
+			if err != nil {
+				t.Fatalf("newLogEntryEncoder() err = %v", err)
+			}
+			b, err := e.Encode(ts, "kube.web", tt.record, nil)
+			if err != nil {
+				t.Fatalf("Encode() err = %v", err)
+			}
+			var got map[string]interface{}
+			if err := json.Unmarshal(b, &got); err != nil {
+				t.Fatalf("Encode() produced invalid JSON: %v", err)
+			}
+			for wk, wv := range tt.want {
+				if !reflect.DeepEqual(got[wk], wv) {
+					t.Errorf("Encode() %s = %v, want %v", wk, got[wk], wv)
+				}
+			}
+			if tt.want["textPayload"] == nil && got["jsonPayload"] == nil {
+				t.Errorf("Encode() has no jsonPayload: %v", got)
+			}
+		})
+	}
+}
+
+func TestLookupField(t *testing.T) {
+	record := map[string]interface{}{
+		"a":          "top",
+		"dotted.key": "dotted",
+		"nested":     map[string]interface{}{"b": map[string]interface{}{"c": "deep"}, "x.y": "nested dotted"},
+	}
+	testMap := map[string]struct {
+		want interface{}
+		ok   bool
+	}{
+		"a":            {"top", true},
+		"dotted.key":   {"dotted", true},
+		"nested.b.c":   {"deep", true},
+		"nested.x.y":   {"nested dotted", true},
+		"nested.b.d":   {nil, false},
+		"missing":      {nil, false},
+		"a.impossible": {nil, false},
+	}
+	for k, tt := range testMap {
+		t.Run(k, func(t *testing.T) {
+			got, ok := lookupField(record, k)
+			if ok != tt.ok || got != tt.want {
+				t.Errorf("lookupField() = %v, %v want %v, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestTemplateEncoder(t *testing.T) {
+	ts := time.Date(2022, 8, 30, 7, 51, 57, 0, time.UTC)
+	record := map[string]interface{}{
+		"log":        "hello world",
+		"kubernetes": map[string]interface{}{"pod_name": "web-0"},
+	}
+	testMap := map[string]struct {
+		tmpl string
+		want string
+	}{
+		"rawField": {"{{.Record.log}}", "hello world"},
+		"reshaped": {`{"msg":{{json .Record.log}},"pod":{{json (field .Record "kubernetes.pod_name")}}}`,
+			`{"msg":"hello world","pod":"web-0"}`},
+		"default":    {`{{default "none" .Record.missing}}`, "none"},
+		"formatTime": {`{{formatTime "2006-01-02" .Time}} {{formatTime "Unix" .Time}}`, "2022-08-30 1661845917"},
+		"tag":        {"{{.Tag}}", "app.log"},
+		"hash":       {"{{hash .}}", recordHash(ts, "app.log", "", record)},
+	}
+	for k, tt := range testMap {
+		t.Run(k, func(t *testing.T) {
+			e, err := newTemplateEncoder(tt.tmpl)
+			if err != nil {
+				t.Fatalf("newTemplateEncoder() err = %v", err)
+			}
+			got, err := e.Encode(ts, "app.log", record, nil)
+			if err != nil {
+				t.Fatalf("Encode() err = %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("Encode() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+	if _, err := newTemplateEncoder("{{.Record.log"); err == nil {
+		t.Errorf("newTemplateEncoder() accepted an invalid template")
+	}
+}
+
+func TestRawEncoder(t *testing.T) {
+	type testData struct {
+		cfg       RawConfig
+		record    map[string]interface{}
+		want      string
+		wantErr   error
+		wantAttrs map[string]string
+	}
+	binary := string([]byte{0x00, 0xff, 0xfe, 'a'})
+	testMap := map[string]testData{
+		"field":   {DefaultRawConfig, map[string]interface{}{"log": "hello", "app": "web"}, "hello", nil, map[string]string{}},
+		"binary":  {DefaultRawConfig, map[string]interface{}{"log": binary}, binary, nil, map[string]string{}},
+		"missing": {DefaultRawConfig, map[string]interface{}{"msg": "hi"}, `{"msg":"hi"}`, nil, map[string]string{}},
+		"missingDrop": {RawConfig{Field: "log", Missing: RawMissingDrop, Encoding: RawEncodingNone},
+			map[string]interface{}{"msg": "hi"}, "", ErrRecordDropped, map[string]string{}},
+		"attributes": {RawConfig{Field: "log", Attrs: true, Missing: RawMissingJSON, Encoding: RawEncodingNone},
+			map[string]interface{}{"log": "hello", "app": "web", "pid": int64(10), "k": map[string]interface{}{"a": "b"}},
+			"hello", nil, map[string]string{"app": "web", "pid": "10", "k": `{"a":"b"}`}},
+		"base64": {RawConfig{Field: "log", Missing: RawMissingJSON, Encoding: RawEncodingBase64},
+			map[string]interface{}{"log": "aGVsbG8="}, "hello", nil, map[string]string{}},
+	}
+	// Records over the PubSub attribute limits fail to encode.
+	attrsCfg := RawConfig{Field: "log", Attrs: true, Missing: RawMissingJSON, Encoding: RawEncodingNone}
+	wide := map[string]interface{}{"log": "hello"}
+	for i := 0; i < maxAttributes+1; i++ {
+		wide[fmt.Sprintf("f%d", i)] = "v"
+	}
+	limits := map[string]map[string]interface{}{
+		"tooManyAttributes":   wide,
+		"attributeTooLarge":   {"log": "hello", "body": strings.Repeat("x", maxAttributeValueBytes+1)},
+		"attributeKeyTooLong": {"log": "hello", strings.Repeat("k", maxAttributeKeyBytes+1): "v"},
+	}
+	for k, record := range limits {
+		t.Run(k, func(t *testing.T) {
+			e, err := newRawEncoder(&attrsCfg)
+			if err != nil {
+				t.Fatalf("newRawEncoder() err = %v", err)
+			}
+			if _, err := e.Encode(time.Time{}, "tag", record, make(map[string]string)); err == nil {
+				t.Error("Encode() err = nil, want an attribute limit error")
+			}
+		})
+	}
+	sized := map[string]interface{}{"log": "hello", "body": strings.Repeat("x", maxAttributeValueBytes)}
+	if _, err := (&rawEncoder{cfg: attrsCfg}).Encode(time.Time{}, "tag", sized, make(map[string]string)); err != nil {
+		t.Errorf("Encode() of a value at the limit err = %v", err)
+	}
+	for k, tt := range testMap {
+		t.Run(k, func(t *testing.T) {
+			e, err := newRawEncoder(&tt.cfg)
+			if err != nil {
+				t.Fatalf("newRawEncoder() err = %v", err)
+			}
+			attrs := make(map[string]string)
+			got, err := e.Encode(time.Time{}, "tag", tt.record, attrs)
+			if err != tt.wantErr {
+				t.Fatalf("Encode() err = %v, want %v", err, tt.wantErr)
+			}
+			if string(got) != tt.want {
+				t.Errorf("Encode() = %q, want %q", got, tt.want)
+			}
+			if !reflect.DeepEqual(attrs, tt.wantAttrs) {
+				t.Errorf("Encode() attrs = %v, want %v", attrs, tt.wantAttrs)
+			}
+		})
+	}
+}
+
+func TestMsgpackEncoder(t *testing.T) {
+	h := &codec.MsgpackHandle{WriteExt: true}
+	// The record map is encoded as a header and a list of entries.
+	var entries []byte
+	codec.NewEncoderBytes(&entries, h).MustEncode([]interface{}{
+		"log", "hello", "bin", []byte{0x00, 0xff}, "n", int64(-3), "app", "web"})
+	rec := append([]byte{0x84}, entries[1:]...)
+	// A fluent-bit entry, [EventTime, record]
+	entry := append([]byte{0x92, 0xd7, 0x00, 0x63, 0x0d, 0x35, 0x5d, 0x00, 0x00, 0x00, 0x00}, rec...)
+
+	testMap := map[string]struct {
+		as      []string
+		tsField string
+		want    map[interface{}]interface{}
+		same    bool
+	}{
+		"passthrough": {nil, "", map[interface{}]interface{}{
+			"log": "hello", "bin": []byte{0x00, 0xff}, "n": int64(-3), "app": "web"}, true},
+		"attributesRemoved": {[]string{"app"}, "", map[interface{}]interface{}{
+			"log": "hello", "bin": []byte{0x00, 0xff}, "n": int64(-3)}, false},
+		"timestampField": {nil, "fb_ts", map[interface{}]interface{}{
+			"log": "hello", "bin": []byte{0x00, 0xff}, "n": int64(-3), "app": "web",
+			"fb_ts": int64(1661810013000000)}, false},
+	}
+	for k, tt := range testMap {
+		t.Run(k, func(t *testing.T) {
+			r, err := NewFLBRecordReader()
+			if err != nil {
+				t.Fatalf("NewFLBRecordReader() err = %v", err)
+			}
+			p := &OutputPlugin{As: tt.as, TSField: tt.tsField, R: r, enc: newMsgpackEncoder(r, tt.tsField)}
+			r.mpdec.ResetBytes(entry)
+			ts, record, err := r.ReadRecord()
+			if err != nil {
+				t.Fatalf("ReadRecord() err = %v", err)
+			}
+			if record["log"] != "hello" || ts.Unix() != 1661810013 {
+				t.Fatalf("ReadRecord() = %v, %v", ts, record)
+			}
+			msg, err := p.CreateMessage(ts, "tag", record)
+			if err != nil {
+				t.Fatalf("CreateMessage() err = %v", err)
+			}
+			if msg.Attributes["content-type"] != msgpackContentType {
+				t.Errorf("CreateMessage() attributes = %v", msg.Attributes)
+			}
+			if tt.same != bytes.Equal(msg.Data, rec) {
+				t.Errorf("CreateMessage() passthrough = %v, want %v", !tt.same, tt.same)
+			}
+			var got map[interface{}]interface{}
+			codec.NewDecoderBytes(msg.Data, h).MustDecode(&got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("CreateMessage() data = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+/*
+ * Copyright 2022  David MacKinnon (blaedd@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You may
+ * not use this file except in compliance with the License. A copy of the
+ * License is located at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0.txt
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Stages of a flush at which a record can fail.
+const (
+	stageRead   = "read"
+	stageEncode = "encode"
+)
+
+// recordErrors aggregates the per record errors of a flush by class, so that a chunk of malformed records is
+// summarized instead of logged record by record.
+type recordErrors struct {
+	cfg     *LogConfig
+	classes map[string]*errorClass
+	order   []string
+}
+
+// errorClass counts the errors of one type at one stage, keeping the first as a sample.
+type errorClass struct {
+	stage  string
+	typ    string
+	count  int
+	err    error
+	index  int
+	ts     time.Time
+	id     string
+	record map[string]interface{}
+}
+
+func newRecordErrors(cfg *LogConfig) *recordErrors {
+	return &recordErrors{cfg: cfg, classes: make(map[string]*errorClass)}
+}
+
+// errorType returns the type of the innermost wrapped error, which identifies the class of an error independently
+// of the record specific details in its message.
+func errorType(err error) string {
+	for {
+		u := errors.Unwrap(err)
+		if u == nil {
+			return fmt.Sprintf("%T", err)
+		}
+		err = u
+	}
+}
+
+// add records an error for the record at index in the chunk. record is nil if it couldn't be read.
+func (r *recordErrors) add(stage string, err error, index int, ts time.Time, record map[string]interface{}) {
+	typ := errorType(err)
+	key := stage + "/" + typ
+	if c, ok := r.classes[key]; ok {
+		c.count++
+		return
+	}
+	c := &errorClass{stage: stage, typ: typ, count: 1, err: err, index: index, ts: ts}
+	if record != nil && r.cfg.RecordIDField != "" {
+		if v, ok := lookupField(record, r.cfg.RecordIDField); ok {
+			c.id = fmt.Sprint(v)
+		}
+	}
+	if r.cfg.RecordContents {
+		c.record = record
+	}
+	r.classes[key] = c
+	r.order = append(r.order, key)
+}
+
+// total returns the number of errors recorded.
+func (r *recordErrors) total() int {
+	n := 0
+	for _, c := range r.classes {
+		n += c.count
+	}
+	return n
+}
+
+// log emits one summary per class of error.
+func (r *recordErrors) log(l *zerolog.Logger) {
+	for _, key := range r.order {
+		c := r.classes[key]
+		sample := zerolog.Dict().Int("index", c.index).Time("log_ts", c.ts)
+		if c.id != "" {
+			sample.Str("id", c.id)
+		}
+		if c.record != nil {
+			sample.Interface("record", c.record)
+		}
+		l.Error().Err(c.err).Str("stage", c.stage).Str("error_type", c.typ).Int("count", c.count).
+			Dict("sample", sample).Msg("records failed")
+	}
+}
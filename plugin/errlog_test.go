@@ -0,0 +1,97 @@
+/*
+ * Copyright 2022  David MacKinnon (blaedd@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You may
+ * not use this file except in compliance with the License. A copy of the
+ * License is located at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0.txt
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+type testFieldError struct{ field string }
+
+func (e *testFieldError) Error() string { return "bad field " + e.field }
+
+func TestRecordErrors(t *testing.T) {
+	type testData struct {
+		cfg        LogConfig
+		wantID     string
+		wantRecord bool
+	}
+	testMap := map[string]testData{
+		"default":  {},
+		"id":       {cfg: LogConfig{RecordIDField: "req.id"}, wantID: "r1"},
+		"contents": {cfg: LogConfig{RecordContents: true}, wantRecord: true},
+	}
+	ts := time.Unix(1600000000, 0)
+	for k, tt := range testMap {
+		t.Run(k, func(t *testing.T) {
+			r := newRecordErrors(&tt.cfg)
+			for i := 0; i < 3; i++ {
+				record := map[string]interface{}{"req": map[string]interface{}{"id": fmt.Sprintf("r%d", i+1)},
+					"secret": "s3cret"}
+				r.add(stageEncode, fmt.Errorf("record %d: %w", i, &testFieldError{field: "x"}), i+1, ts, record)
+			}
+			r.add(stageRead, errors.New("short read"), 4, ts, nil)
+			if got := r.total(); got != 4 {
+				t.Errorf("total() = %d, want 4", got)
+			}
+
+			var buf bytes.Buffer
+			l := zerolog.New(&buf)
+			r.log(&l)
+			lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+			if len(lines) != 2 {
+				t.Fatalf("log() wrote %d summaries, want 2: %s", len(lines), buf.String())
+			}
+			var summary struct {
+				Error     string `json:"error"`
+				Stage     string `json:"stage"`
+				ErrorType string `json:"error_type"`
+				Count     int    `json:"count"`
+				Sample    struct {
+					Index  int                    `json:"index"`
+					ID     string                 `json:"id"`
+					Record map[string]interface{} `json:"record"`
+				} `json:"sample"`
+			}
+			if err := json.Unmarshal([]byte(lines[0]), &summary); err != nil {
+				t.Fatal(err)
+			}
+			if summary.Stage != stageEncode || summary.ErrorType != "*plugin.testFieldError" || summary.Count != 3 ||
+				summary.Error != "record 0: bad field x" || summary.Sample.Index != 1 {
+				t.Errorf("log() summary = %s", lines[0])
+			}
+			if summary.Sample.ID != tt.wantID {
+				t.Errorf("log() sample id = %q, want %q", summary.Sample.ID, tt.wantID)
+			}
+			if (summary.Sample.Record != nil) != tt.wantRecord {
+				t.Errorf("log() sample record = %v, want record %v", summary.Sample.Record, tt.wantRecord)
+			}
+			if !tt.wantRecord && strings.Contains(buf.String(), "s3cret") {
+				t.Errorf("log() leaked record contents: %s", buf.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright 2022  David MacKinnon (blaedd@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You may
+ * not use this file except in compliance with the License. A copy of the
+ * License is located at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0.txt
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package plugin
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// fileRefPrefix marks a value that is replaced by the contents of a file.
+const fileRefPrefix = "@file:"
+
+// expandValue expands the references in a configuration value.
+//
+// ${VAR} is replaced by the value of the environment variable VAR, or an empty string if it is not set.
+// ${VAR:-default} is replaced by the default if VAR is not set or empty. $${ is replaced by a literal ${.
+// After environment variables are expanded, a value of @file:/path is replaced by the contents of the file, without
+// trailing newlines.
+func expandValue(s string) (string, error) {
+	if strings.Contains(s, "${") {
+		s = expandEnv(s)
+	}
+	if strings.HasPrefix(s, fileRefPrefix) {
+		path := s[len(fileRefPrefix):]
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("unable to read %s reference: %w", fileRefPrefix, err)
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	}
+	return s, nil
+}
+
+// expandEnv expands ${VAR} and ${VAR:-default} references. Malformed references are left as is.
+func expandEnv(s string) string {
+	var b strings.Builder
+	for {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			b.WriteString(s)
+			return b.String()
+		}
+		if i > 0 && s[i-1] == '$' {
+			b.WriteString(s[:i])
+			b.WriteString("{")
+			s = s[i+2:]
+			continue
+		}
+		b.WriteString(s[:i])
+		s = s[i:]
+		end := strings.IndexByte(s, '}')
+		if end < 0 {
+			b.WriteString(s)
+			return b.String()
+		}
+		name, def, hasDef := strings.Cut(s[2:end], ":-")
+		if !isEnvName(name) {
+			b.WriteString(s[:2])
+			s = s[2:]
+			continue
+		}
+		v := os.Getenv(name)
+		if v == "" && hasDef {
+			v = def
+		}
+		b.WriteString(v)
+		s = s[end+1:]
+	}
+}
+
+// isEnvName reports if s is a valid environment variable name.
+func isEnvName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, c := range s {
+		switch {
+		case c == '_', c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
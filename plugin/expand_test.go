@@ -0,0 +1,122 @@
+/*
+ * Copyright 2022  David MacKinnon (blaedd@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You may
+ * not use this file except in compliance with the License. A copy of the
+ * License is located at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0.txt
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package plugin
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unsafe"
+
+	"github.com/rs/zerolog"
+)
+
+func Test_expandValue(t *testing.T) {
+	dir := t.TempDir()
+	secret := filepath.Join(dir, "secret")
+	if err := os.WriteFile(secret, []byte("s3cret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("EXPAND_PROJECT", "proj")
+	t.Setenv("EXPAND_EMPTY", "")
+	t.Setenv("EXPAND_DIR", dir)
+
+	type testData struct {
+		v       string
+		want    string
+		wantErr bool
+	}
+	testMap := map[string]testData{
+		"plain":         {v: "topic", want: "topic"},
+		"var":           {v: "${EXPAND_PROJECT}", want: "proj"},
+		"embedded":      {v: "projects/${EXPAND_PROJECT}/topics/logs", want: "projects/proj/topics/logs"},
+		"unset":         {v: "a${EXPAND_UNSET}b", want: "ab"},
+		"default":       {v: "${EXPAND_UNSET:-logs}", want: "logs"},
+		"emptyDefault":  {v: "${EXPAND_EMPTY:-logs}", want: "logs"},
+		"setDefault":    {v: "${EXPAND_PROJECT:-other}", want: "proj"},
+		"escaped":       {v: "$${EXPAND_PROJECT}", want: "${EXPAND_PROJECT}"},
+		"unterminated":  {v: "${EXPAND_PROJECT", want: "${EXPAND_PROJECT"},
+		"invalidName":   {v: "${1X} ${EXPAND_PROJECT}", want: "${1X} proj"},
+		"template":      {v: "{{.Tag}}", want: "{{.Tag}}"},
+		"file":          {v: "@file:" + secret, want: "s3cret"},
+		"fileVar":       {v: "@file:${EXPAND_DIR}/secret", want: "s3cret"},
+		"missingFile":   {v: "@file:" + filepath.Join(dir, "missing"), wantErr: true},
+		"notPrefixFile": {v: "x@file:" + secret, want: "x@file:" + secret},
+	}
+	for k, tt := range testMap {
+		t.Run(k, func(t *testing.T) {
+			got, err := expandValue(tt.v)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expandValue(%q) err = %v, wantErr %v", tt.v, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("expandValue(%q) = %q, want %q", tt.v, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFLBConfigStore_expansion(t *testing.T) {
+	var buf bytes.Buffer
+	l := zerolog.New(&buf).Level(zerolog.DebugLevel)
+	secret := filepath.Join(t.TempDir(), "creds.json")
+	if err := os.WriteFile(secret, []byte(`{"type": "service_account"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("EXPAND_TOPIC", "logs")
+	t.Setenv("EXPAND_FIELDS", "host,app")
+	values := map[string]string{
+		"topic_id":         "${EXPAND_TOPIC}",
+		"attribute_fields": "${EXPAND_FIELDS},tag",
+		"credentials_json": "@file:" + secret,
+		"credentials_file": "@file:/nonexistent/creds",
+	}
+	origGetKey := configKeyGet
+	configKeyGet = func(ctx unsafe.Pointer, name string) string {
+		return values[name]
+	}
+	defer func() { configKeyGet = origGetKey }()
+
+	f := &FLBConfigStore{l: &l}
+	if v, ok := f.String("topic_id"); !ok || v != "logs" {
+		t.Errorf("String() = %q, %v", v, ok)
+	}
+	if v, ok := f.Strings("attribute_fields"); !ok || strings.Join(v, ",") != "host,app,tag" {
+		t.Errorf("Strings() = %v, %v", v, ok)
+	}
+	if v, ok := f.String("credentials_json"); !ok || !strings.Contains(v, "service_account") {
+		t.Errorf("String() = %q, %v", v, ok)
+	}
+	if strings.Contains(buf.String(), "service_account") {
+		t.Errorf("expanded sensitive value was logged: %s", buf.String())
+	}
+	if err := f.ValueErr("credentials_file"); err == nil {
+		t.Errorf("ValueErr() missing file err = nil")
+	}
+
+	_, err := BuildPluginConfig(0, f)
+	if err == nil || !strings.Contains(err.Error(), "credentials_file") {
+		t.Errorf("BuildPluginConfig() err = %v, want credentials_file error", err)
+	}
+	// The error is returned by the loader, rather than logged on every lookup.
+	if strings.Contains(buf.String(), `"level":"error"`) {
+		t.Errorf("expansion error was logged: %s", buf.String())
+	}
+}
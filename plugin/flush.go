@@ -0,0 +1,213 @@
+/*
+ * Copyright 2022  David MacKinnon (blaedd@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You may
+ * not use this file except in compliance with the License. A copy of the
+ * License is located at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0.txt
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package plugin
+
+import (
+	"context"
+	"errors"
+	"io"
+	"unsafe"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/fluent/fluent-bit-go/output"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Flush encodes the records in a chunk from fluent-bit and publishes them, returning the fluent-bit status code.
+func (p *OutputPlugin) Flush(ctx context.Context, data unsafe.Pointer, length int, tag string) int {
+	logger := log.Ctx(ctx)
+	ctx, span := p.trc.start(ctx, "flush", trace.WithAttributes(attribute.String("fluentbit.tag", tag),
+		attribute.Int("fluentbit.chunk.bytes", length)))
+	defer span.End()
+
+	ready := p.Ready()
+	if !ready && p.spool == nil {
+		logger.Warn().Msg("PubSub client not initialized yet. Will retry.")
+		span.SetStatus(otelcodes.Error, "client not initialized")
+		return output.FLB_RETRY
+	}
+	allowed := ready && p.brk.allow()
+	if !allowed && p.spool == nil {
+		logger.Warn().Msg("circuit breaker open. Will retry.")
+		span.SetStatus(otelcodes.Error, "circuit breaker open")
+		return output.FLB_RETRY
+	}
+	logger.Debug().Int("bytes", length).Msg("receiving log entries")
+	msgs, links, dups := p.decode(ctx, data, length, tag)
+	if p.spool != nil {
+		// Keep messages in order behind any spooled backlog.
+		var reason string
+		switch {
+		case !ready:
+			reason = "client not initialized"
+		case !allowed:
+			reason = "circuit breaker open"
+		case p.spool.Len() > 0:
+			reason = "spool not drained"
+		}
+		if reason != "" {
+			if allowed {
+				p.brk.release()
+			}
+			status := p.spoolMessages(logger, msgs, reason)
+			if status == output.FLB_OK {
+				dups.done(msgs)
+			}
+			return status
+		}
+	}
+	if len(msgs) == 0 {
+		p.brk.release()
+		return output.FLB_OK
+	}
+
+	opts := append(linkOptions(links), trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(attribute.String("messaging.system", "gcp_pubsub"),
+			attribute.String("messaging.destination.name", p.config.TID),
+			attribute.Int("messaging.batch.message_count", len(msgs))))
+	ctx, pspan := p.trc.start(ctx, "publish", opts...)
+	defer pspan.End()
+	err := p.PublishMessages(ctx, msgs)
+	p.published(err)
+	if err != nil {
+		pspan.RecordError(err)
+		pspan.SetStatus(otelcodes.Error, "publish failed")
+		var perr *PublishError
+		if errors.As(err, &perr) {
+			dups.doneExcept(msgs, perr.Msgs)
+		}
+		if p.spool != nil && perr != nil && perr.Retryable {
+			logger.Warn().Err(err).Msg("retryable error. Spooling failed messages.")
+			status := p.spoolMessages(logger, perr.Msgs, "publish failed")
+			if status == output.FLB_OK {
+				dups.done(perr.Msgs)
+			}
+			return status
+		}
+		if IsRetryable(err) {
+			logger.Warn().Err(err).Msg("retryable error. Will retry.")
+			return output.FLB_RETRY
+		}
+		logger.Warn().Err(err).Msg("unrecoverable Publish error")
+		return output.FLB_ERROR
+	}
+	dups.done(msgs)
+	return output.FLB_OK
+}
+
+// published records the result of publishing a chunk for the health endpoints and the circuit breaker. Chunks held
+// back by the client side rate limit say nothing about PubSub, so they aren't counted.
+func (p *OutputPlugin) published(err error) {
+	if errors.Is(err, ErrRateLimited) {
+		p.brk.release()
+		return
+	}
+	p.health.flushed(err)
+	p.brk.done(err)
+}
+
+// decode reads the records in a chunk and creates their messages. Links to the spans referenced by the records, and
+// the batch tracking their duplicate keys, are also returned.
+func (p *OutputPlugin) decode(ctx context.Context, data unsafe.Pointer, length int, tag string) (
+	[]*pubsub.Message, []trace.Link, *dedupBatch) {
+	logger := log.Ctx(ctx)
+	// Per record errors tend to repeat for every record in a chunk. They are logged at debug level, sampled if
+	// configured, and summarized by recordErrors.
+	recLogger := logger
+	if p.recSampler != nil {
+		l := logger.Sample(p.recSampler)
+		recLogger = &l
+	}
+	_, span := p.trc.start(ctx, "decode")
+	defer span.End()
+
+	p.R.ResetReader(data, length)
+	msgs := make([]*pubsub.Message, 0, 100)
+	var (
+		links   []trace.Link
+		seen    = make(map[[2]string]bool)
+		dropped int
+		sampled int
+		dupes   int
+		dups    = p.dedup.batch()
+		recErrs = newRecordErrors(&p.config.Log)
+	)
+	for i := 0; ; i++ {
+		ts, record, err := p.R.ReadRecord()
+		if err == io.EOF {
+			logger.Info().Msg("End of File")
+			break
+		}
+		if err != nil {
+			recErrs.add(stageRead, err, i, ts, nil)
+			recLogger.Debug().Err(err).Int("index", i).Time("log_ts", ts).Msg("error while reading a record")
+			continue
+		}
+		if link, ok := p.trc.link(record); ok {
+			key := [2]string{link.SpanContext.TraceID().String(), link.SpanContext.SpanID().String()}
+			if !seen[key] {
+				seen[key] = true
+				links = append(links, link)
+			}
+		}
+		keep, rate := p.smp.sample(record)
+		if !keep {
+			sampled++
+			continue
+		}
+		// The record is hashed before CreateMessage changes it.
+		key, dup := dups.check(ts, record)
+		if dup {
+			dupes++
+			continue
+		}
+		msg, err := p.CreateMessage(ts, tag, record)
+		if errors.Is(err, ErrRecordDropped) {
+			dropped++
+			logger.Debug().Time("log_ts", ts).Msg("record dropped")
+			continue
+		}
+		if err != nil {
+			recErrs.add(stageEncode, err, i, ts, record)
+			e := recLogger.Debug().Err(err).Int("index", i).Time("log_ts", ts)
+			if p.config.Log.RecordContents {
+				e = e.Interface("record", record)
+			}
+			e.Msg("error while creating pubsub.Message from record")
+			continue
+		}
+		p.smp.annotate(msg.Attributes, rate)
+		dups.add(msg, key)
+		msgs = append(msgs, msg)
+	}
+	recErrs.log(logger)
+	errs := recErrs.total()
+	span.SetAttributes(attribute.Int("fluentbit.records.encoded", len(msgs)),
+		attribute.Int("fluentbit.records.dropped", dropped), attribute.Int("fluentbit.records.sampled_out", sampled),
+		attribute.Int("fluentbit.records.duplicates", dupes), attribute.Int("fluentbit.records.failed", errs))
+	if errs > 0 {
+		span.SetStatus(otelcodes.Error, "records failed to decode or encode")
+	}
+	if dupes > 0 {
+		logger.Debug().Int("duplicates", dupes).Msg("dropped duplicate records")
+	}
+	return msgs, links, dups
+}
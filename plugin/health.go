@@ -0,0 +1,179 @@
+/*
+ * Copyright 2022  David MacKinnon (blaedd@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You may
+ * not use this file except in compliance with the License. A copy of the
+ * License is located at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0.txt
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// HealthConfig holds the settings for the health and readiness HTTP endpoints.
+type HealthConfig struct {
+	Listen         string        // Address of the HTTP server. The server is disabled if empty.
+	MaxFailures    int           // Consecutive failed flushes after which /healthz reports unhealthy.
+	MaxPublishAge  time.Duration // How long publishes can fail before /readyz reports not ready. Zero disables.
+	MaxOutstanding int           // Outstanding messages above which /readyz reports not ready. Zero disables.
+}
+
+// DefaultHealthConfig holds the default health settings.
+var DefaultHealthConfig = HealthConfig{MaxFailures: 5}
+
+// health tracks the state reported by the health and readiness endpoints. The zero value is ready to use.
+type health struct {
+	started     time.Time
+	failures    atomic.Int64 // Consecutive failed flushes.
+	outstanding atomic.Int64 // Messages being published.
+	lastSuccess atomic.Int64 // Unix nanoseconds of the last successful publish.
+	lastFailure atomic.Int64 // Unix nanoseconds of the last failed publish.
+}
+
+// flushed records the outcome of publishing the messages of a flush.
+func (h *health) flushed(err error) {
+	now := time.Now().UnixNano()
+	if err != nil {
+		h.failures.Add(1)
+		h.lastFailure.Store(now)
+		return
+	}
+	h.failures.Store(0)
+	h.lastSuccess.Store(now)
+}
+
+// unixTime converts unix nanoseconds to a time.Time, with zero as nil.
+func unixTime(ns int64) *time.Time {
+	if ns == 0 {
+		return nil
+	}
+	t := time.Unix(0, ns)
+	return &t
+}
+
+// healthStatus is the body of the health and readiness responses.
+type healthStatus struct {
+	OK                  bool       `json:"ok"`
+	Reason              string     `json:"reason,omitempty"`
+	Initialized         bool       `json:"initialized"`
+	ConsecutiveFailures int64      `json:"consecutive_failures"`
+	Outstanding         int64      `json:"outstanding"`
+	Spooled             int64      `json:"spooled"`
+	LastSuccess         *time.Time `json:"last_success,omitempty"`
+	LastFailure         *time.Time `json:"last_failure,omitempty"`
+}
+
+// status returns the current status of the plugin, without checking it.
+func (p *OutputPlugin) status() healthStatus {
+	return healthStatus{
+		Initialized:         p.Ready(),
+		ConsecutiveFailures: p.health.failures.Load(),
+		Outstanding:         p.health.outstanding.Load(),
+		Spooled:             p.spooled(),
+		LastSuccess:         unixTime(p.health.lastSuccess.Load()),
+		LastFailure:         unixTime(p.health.lastFailure.Load()),
+	}
+}
+
+// liveness reports if the plugin is healthy. It is unhealthy after MaxFailures consecutive failed flushes.
+func (p *OutputPlugin) liveness() healthStatus {
+	s := p.status()
+	if max := p.config.Health.MaxFailures; max > 0 && s.ConsecutiveFailures >= int64(max) {
+		s.Reason = fmt.Sprintf("%d consecutive flushes failed", s.ConsecutiveFailures)
+		return s
+	}
+	s.OK = true
+	return s
+}
+
+// readiness reports if the plugin is ready to publish. It isn't ready until the client and topic are initialized,
+// while publishes have been failing for longer than MaxPublishAge, or while more than MaxOutstanding messages are
+// being published.
+func (p *OutputPlugin) readiness(now time.Time) healthStatus {
+	s := p.status()
+	cfg := &p.config.Health
+	lastSuccess, lastFailure := p.health.lastSuccess.Load(), p.health.lastFailure.Load()
+	since := p.health.started
+	if lastSuccess != 0 {
+		since = time.Unix(0, lastSuccess)
+	}
+	switch {
+	case !s.Initialized:
+		s.Reason = "client not initialized"
+	case cfg.MaxPublishAge > 0 && lastFailure > lastSuccess && now.Sub(since) > cfg.MaxPublishAge:
+		s.Reason = fmt.Sprintf("no successful publish since %s", since.Format(time.RFC3339))
+	case cfg.MaxOutstanding > 0 && s.Outstanding > int64(cfg.MaxOutstanding):
+		s.Reason = fmt.Sprintf("%d messages outstanding", s.Outstanding)
+	default:
+		s.OK = true
+	}
+	return s
+}
+
+// writeStatus writes s as JSON, with a 503 status code if it isn't OK.
+func writeStatus(w http.ResponseWriter, s healthStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	if !s.OK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(s)
+}
+
+// handler returns the HTTP handler for the instance endpoints.
+func (p *OutputPlugin) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeStatus(w, p.liveness())
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		writeStatus(w, p.readiness(time.Now()))
+	})
+	mux.HandleFunc("/metrics", p.metricsHandler)
+	return mux
+}
+
+// serveHTTP starts the HTTP server for the instance endpoints, returning once it is listening.
+func (p *OutputPlugin) serveHTTP(l *zerolog.Logger) error {
+	ln, err := net.Listen("tcp", p.config.Health.Listen)
+	if err != nil {
+		return fmt.Errorf("unable to listen on health_listen: %w", err)
+	}
+	p.srv = &http.Server{Handler: p.handler(), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := p.srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			l.Error().Err(err).Msg("health server failed")
+		}
+	}()
+	l.Info().Str("address", ln.Addr().String()).Msg("serving health and metrics endpoints")
+	return nil
+}
+
+// stopHTTP stops the HTTP server, if it is running.
+func (p *OutputPlugin) stopHTTP() {
+	if p.srv == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_ = p.srv.Shutdown(ctx)
+}
@@ -0,0 +1,108 @@
+/*
+ * Copyright 2022  David MacKinnon (blaedd@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You may
+ * not use this file except in compliance with the License. A copy of the
+ * License is located at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0.txt
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package plugin
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+func TestOutputPlugin_healthEndpoints(t *testing.T) {
+	type testData struct {
+		cfg         HealthConfig
+		initialized bool
+		flushes     []error
+		outstanding int64
+		age         time.Duration
+		wantLive    int
+		wantReady   int
+	}
+	failed := errors.New("publish failed")
+	testMap := map[string]testData{
+		"healthy": {cfg: DefaultHealthConfig, initialized: true, flushes: []error{nil, failed},
+			wantLive: http.StatusOK, wantReady: http.StatusOK},
+		"notInitialized": {cfg: DefaultHealthConfig, wantLive: http.StatusOK, wantReady: http.StatusServiceUnavailable},
+		"failures": {cfg: HealthConfig{MaxFailures: 2}, initialized: true, flushes: []error{failed, failed},
+			wantLive: http.StatusServiceUnavailable, wantReady: http.StatusOK},
+		"recovered": {cfg: HealthConfig{MaxFailures: 2}, initialized: true, flushes: []error{failed, failed, nil},
+			wantLive: http.StatusOK, wantReady: http.StatusOK},
+		"failuresDisabled": {cfg: HealthConfig{}, initialized: true, flushes: []error{failed, failed, failed},
+			wantLive: http.StatusOK, wantReady: http.StatusOK},
+		"staleSuccess": {cfg: HealthConfig{MaxPublishAge: time.Minute}, initialized: true,
+			flushes: []error{nil, failed}, age: 2 * time.Minute, wantLive: http.StatusOK,
+			wantReady: http.StatusServiceUnavailable},
+		"recentSuccess": {cfg: HealthConfig{MaxPublishAge: time.Minute}, initialized: true,
+			flushes: []error{nil, failed}, age: 30 * time.Second, wantLive: http.StatusOK, wantReady: http.StatusOK},
+		"idle": {cfg: HealthConfig{MaxPublishAge: time.Minute}, initialized: true, flushes: []error{nil},
+			age: time.Hour, wantLive: http.StatusOK, wantReady: http.StatusOK},
+		"outstanding": {cfg: HealthConfig{MaxOutstanding: 10}, initialized: true, outstanding: 11,
+			wantLive: http.StatusOK, wantReady: http.StatusServiceUnavailable},
+	}
+	for k, tt := range testMap {
+		t.Run(k, func(t *testing.T) {
+			p := &OutputPlugin{config: &OutputPluginConfig{Health: tt.cfg}}
+			p.health.started = time.Now()
+			if tt.initialized {
+				p.Topic = &pubsub.Topic{}
+			}
+			for _, err := range tt.flushes {
+				p.health.flushed(err)
+			}
+			if tt.age > 0 {
+				// Age the recorded publishes instead of waiting.
+				shift := tt.age.Nanoseconds()
+				p.health.started = p.health.started.Add(-tt.age)
+				if v := p.health.lastSuccess.Load(); v != 0 {
+					p.health.lastSuccess.Store(v - shift)
+				}
+			}
+			p.health.outstanding.Store(tt.outstanding)
+			srv := httptest.NewServer(p.handler())
+			defer srv.Close()
+
+			for path, want := range map[string]int{"/healthz": tt.wantLive, "/readyz": tt.wantReady} {
+				resp, err := http.Get(srv.URL + path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var s healthStatus
+				err = json.NewDecoder(resp.Body).Decode(&s)
+				_ = resp.Body.Close()
+				if err != nil {
+					t.Fatalf("%s body: %v", path, err)
+				}
+				if resp.StatusCode != want {
+					t.Errorf("%s status = %d, want %d (%+v)", path, resp.StatusCode, want, s)
+				}
+				if s.OK != (want == http.StatusOK) || (!s.OK && s.Reason == "") {
+					t.Errorf("%s body = %+v", path, s)
+				}
+				if s.Initialized != tt.initialized || s.Outstanding != tt.outstanding {
+					t.Errorf("%s body = %+v, want initialized %v, outstanding %d", path, s, tt.initialized,
+						tt.outstanding)
+				}
+			}
+		})
+	}
+}
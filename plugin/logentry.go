@@ -0,0 +1,305 @@
+/*
+ * Copyright 2022  David MacKinnon (blaedd@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You may
+ * not use this file except in compliance with the License. A copy of the
+ * License is located at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0.txt
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// LogEntry payload modes.
+const (
+	PayloadAuto = "auto"
+	PayloadText = "text"
+	PayloadJSON = "json"
+)
+
+// LogEntryConfig holds the settings used to map records to Cloud Logging LogEntry objects.
+//
+// See https://cloud.google.com/logging/docs/reference/v2/rest/v2/LogEntry. Field names may be dotted paths into
+// nested record fields.
+type LogEntryConfig struct {
+	LogName        string            // Template for the log id used in logName.
+	SeverityFields []string          // Fields checked, in order, for the entry severity.
+	MessageFields  []string          // Fields checked, in order, for the log message.
+	Payload        string            // When to use textPayload rather than jsonPayload: auto, text or json.
+	LabelsField    string            // Field holding a map of entry labels.
+	LabelFields    []string          // Additional fields to copy into the entry labels.
+	ResourceType   string            // Monitored resource type.
+	ResourceLabels map[string]string // Monitored resource label names to the fields holding their values.
+	TraceField     string            // Field holding the trace id.
+	SpanIDField    string            // Field holding the span id.
+	TimestampField string            // Field holding the entry time, as RFC 3339 or a Unix epoch time.
+}
+
+// DefaultLogEntryConfig is the LogEntryConfig used unless overridden by the plugin configuration.
+//
+// The defaults suit records from the fluent-bit kubernetes filter.
+var DefaultLogEntryConfig = LogEntryConfig{
+	LogName:        "{{.Tag}}",
+	SeverityFields: []string{"severity", "level"},
+	MessageFields:  []string{"message", "log"},
+	Payload:        PayloadAuto,
+	LabelsField:    "logging.googleapis.com/labels",
+	ResourceType:   "k8s_container",
+	ResourceLabels: map[string]string{
+		"namespace_name": "kubernetes.namespace_name",
+		"pod_name":       "kubernetes.pod_name",
+		"container_name": "kubernetes.container_name",
+	},
+	TraceField:  "logging.googleapis.com/trace",
+	SpanIDField: "logging.googleapis.com/spanId",
+}
+
+// Validate checks the LogEntryConfig settings.
+func (c *LogEntryConfig) Validate() error {
+	switch c.Payload {
+	case PayloadAuto, PayloadText, PayloadJSON:
+	default:
+		return fmt.Errorf("logentry_payload must be one of %s, %s or %s, not %q", PayloadAuto, PayloadText,
+			PayloadJSON, c.Payload)
+	}
+	if c.LogName == "" {
+		return fmt.Errorf("logentry_log_name can not be empty")
+	}
+	return nil
+}
+
+type monitoredResource struct {
+	Type   string            `json:"type"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// logEntry is the JSON representation of a Cloud Logging LogEntry.
+type logEntry struct {
+	LogName     string                 `json:"logName"`
+	Resource    *monitoredResource     `json:"resource,omitempty"`
+	Timestamp   string                 `json:"timestamp"`
+	Severity    string                 `json:"severity,omitempty"`
+	Labels      map[string]string      `json:"labels,omitempty"`
+	Trace       string                 `json:"trace,omitempty"`
+	SpanID      string                 `json:"spanId,omitempty"`
+	TextPayload *string                `json:"textPayload,omitempty"`
+	JSONPayload map[string]interface{} `json:"jsonPayload,omitempty"`
+}
+
+// logEntryEncoder maps records to LogEntry JSON.
+type logEntryEncoder struct {
+	cfg     LogEntryConfig
+	project string
+	logName *template.Template
+}
+
+func newLogEntryEncoder(c *LogEntryConfig, project string) (*logEntryEncoder, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	t, err := newRecordTemplate("logentry_log_name", c.LogName)
+	if err != nil {
+		return nil, err
+	}
+	return &logEntryEncoder{cfg: *c, project: project, logName: t}, nil
+}
+
+// popField removes a top level field from the record, or looks up a nested one.
+func popField(record map[string]interface{}, name string) (interface{}, bool) {
+	if v, ok := record[name]; ok {
+		delete(record, name)
+		return v, true
+	}
+	return lookupField(record, name)
+}
+
+func (e *logEntryEncoder) Encode(ts time.Time, tag string, record map[string]interface{}, _ map[string]string) ([]byte, error) {
+	ln, err := execTemplate(e.logName, &RecordData{Tag: tag, Time: ts, Record: record})
+	if err != nil {
+		return nil, fmt.Errorf("unable to render logentry_log_name: %w", err)
+	}
+	if e.cfg.TimestampField != "" {
+		if v, ok := lookupField(record, e.cfg.TimestampField); ok {
+			if t, ok := parseTimestamp(v); ok {
+				ts = t
+				popField(record, e.cfg.TimestampField)
+			}
+		}
+	}
+	le := logEntry{
+		LogName:   fmt.Sprintf("projects/%s/logs/%s", e.project, url.PathEscape(string(ln))),
+		Timestamp: ts.UTC().Format(time.RFC3339Nano),
+	}
+
+	if e.cfg.ResourceType != "" {
+		le.Resource = &monitoredResource{Type: e.cfg.ResourceType, Labels: map[string]string{"project_id": e.project}}
+		for label, field := range e.cfg.ResourceLabels {
+			if v, ok := lookupField(record, field); ok {
+				le.Resource.Labels[label] = fmt.Sprint(v)
+			}
+		}
+	}
+	for _, f := range e.cfg.SeverityFields {
+		if v, ok := popField(record, f); ok {
+			le.Severity = normalizeSeverity(v)
+			break
+		}
+	}
+	if v, ok := popField(record, e.cfg.TraceField); ok {
+		le.Trace = fmt.Sprint(v)
+		if !strings.HasPrefix(le.Trace, "projects/") {
+			le.Trace = fmt.Sprintf("projects/%s/traces/%s", e.project, le.Trace)
+		}
+	}
+	if v, ok := popField(record, e.cfg.SpanIDField); ok {
+		le.SpanID = fmt.Sprint(v)
+	}
+
+	labels := make(map[string]string)
+	if v, ok := popField(record, e.cfg.LabelsField); ok {
+		if m, ok := v.(map[string]interface{}); ok {
+			for lk, lv := range m {
+				labels[lk] = fmt.Sprint(lv)
+			}
+		}
+	}
+	for _, f := range e.cfg.LabelFields {
+		if v, ok := lookupField(record, f); ok {
+			labels[f] = fmt.Sprint(v)
+		}
+	}
+	if len(labels) > 0 {
+		le.Labels = labels
+	}
+
+	le.TextPayload, le.JSONPayload = e.payload(record)
+	return json.Marshal(le)
+}
+
+// parseTimestamp parses a record time, as an RFC 3339 string, or a Unix epoch time in seconds, milliseconds,
+// microseconds or nanoseconds, which are told apart by their magnitude.
+func parseTimestamp(v interface{}) (time.Time, bool) {
+	switch v := v.(type) {
+	case string:
+		if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			return t, true
+		}
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return epochTime(n)
+		}
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			return epochSeconds(f)
+		}
+	case int64:
+		return epochTime(v)
+	case uint64:
+		return epochTime(int64(v))
+	case int:
+		return epochTime(int64(v))
+	case float64:
+		return epochSeconds(v)
+	case float32:
+		return epochSeconds(float64(v))
+	}
+	return time.Time{}, false
+}
+
+// epochTime converts an integer Unix epoch time in seconds, milliseconds, microseconds or nanoseconds to a time.
+func epochTime(n int64) (time.Time, bool) {
+	switch {
+	case n <= 0:
+		return time.Time{}, false
+	case n >= 1e17:
+		return time.Unix(0, n), true
+	case n >= 1e14:
+		return time.UnixMicro(n), true
+	case n >= 1e11:
+		return time.UnixMilli(n), true
+	}
+	return time.Unix(n, 0), true
+}
+
+// epochSeconds converts a fractional Unix epoch time to a time. Large values are treated as integers, by epochTime.
+func epochSeconds(f float64) (time.Time, bool) {
+	if f >= 1e11 || f <= 0 {
+		return epochTime(int64(f))
+	}
+	sec, frac := math.Modf(f)
+	return time.Unix(int64(sec), int64(math.Round(frac*1e9))), true
+}
+
+// payload chooses between a textPayload and jsonPayload for the record.
+func (e *logEntryEncoder) payload(record map[string]interface{}) (*string, map[string]interface{}) {
+	if e.cfg.Payload == PayloadJSON {
+		return nil, record
+	}
+	for _, f := range e.cfg.MessageFields {
+		v, ok := record[f]
+		if !ok {
+			continue
+		}
+		msg, isStr := v.(string)
+		if e.cfg.Payload == PayloadText {
+			if !isStr {
+				msg = fmt.Sprint(v)
+			}
+			return &msg, nil
+		}
+		if isStr && len(record) == 1 {
+			return &msg, nil
+		}
+		break
+	}
+	return nil, record
+}
+
+// severityNames are the LogSeverity names, indexed by their numeric value / 100.
+var severityNames = []string{"DEFAULT", "DEBUG", "INFO", "NOTICE", "WARNING", "ERROR", "CRITICAL", "ALERT", "EMERGENCY"}
+
+// normalizeSeverity maps common log level names, and numeric LogSeverity values, to Cloud Logging LogSeverity names.
+func normalizeSeverity(v interface{}) string {
+	s := strings.ToUpper(strings.TrimSpace(fmt.Sprint(v)))
+	if n, err := strconv.Atoi(s); err == nil {
+		if n >= 0 && n/100 < len(severityNames) {
+			return severityNames[n/100]
+		}
+		return "DEFAULT"
+	}
+	switch s {
+	case "TRACE", "DEBUG", "D":
+		return "DEBUG"
+	case "INFO", "INFORMATION", "I":
+		return "INFO"
+	case "NOTICE":
+		return "NOTICE"
+	case "WARN", "WARNING", "W":
+		return "WARNING"
+	case "ERR", "ERROR", "E":
+		return "ERROR"
+	case "CRIT", "CRITICAL", "FATAL", "F":
+		return "CRITICAL"
+	case "ALERT":
+		return "ALERT"
+	case "EMERG", "EMERGENCY", "PANIC":
+		return "EMERGENCY"
+	}
+	return "DEFAULT"
+}
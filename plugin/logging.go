@@ -0,0 +1,185 @@
+/*
+ * Copyright 2022  David MacKinnon (blaedd@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You may
+ * not use this file except in compliance with the License. A copy of the
+ * License is located at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0.txt
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package plugin
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Log formats.
+const (
+	LogFormatConsole = "console"
+	LogFormatJSON    = "json"
+)
+
+// LogConfig holds the settings for the plugin's own logs.
+type LogConfig struct {
+	Level          string        // Minimum level logged, trace, debug, info, warn or error.
+	Format         string        // console or json.
+	File           string        // File to log to, instead of stderr.
+	MaxSize        int64         // Size at which File is rotated. Zero disables rotation.
+	MaxBackups     int           // Number of rotated files kept.
+	SampleBurst    int           // Per record errors logged in each SamplePeriod. Zero disables sampling.
+	SamplePeriod   time.Duration // Period for SampleBurst.
+	RecordContents bool          // Include record contents, which may hold sensitive data, in logs.
+	RecordIDField  string        // Record field identifying records in error summaries.
+}
+
+// DefaultLogConfig holds the default logging settings.
+var DefaultLogConfig = LogConfig{
+	Level:        zerolog.LevelInfoValue,
+	Format:       LogFormatConsole,
+	MaxSize:      10_000_000,
+	MaxBackups:   3,
+	SamplePeriod: time.Second,
+}
+
+// Validate checks the LogConfig settings.
+func (c *LogConfig) Validate() error {
+	if c.SampleBurst > 0 && c.SamplePeriod <= 0 {
+		return fmt.Errorf("log_sample_period must be positive when log_sample_burst is set")
+	}
+	if c.File != "" && c.MaxSize > 0 && c.MaxBackups < 0 {
+		return fmt.Errorf("log_file_max_backups can not be negative")
+	}
+	return nil
+}
+
+// NewLogger creates a logger with the settings. A debug level is used if debug is set and the level is higher.
+func (c *LogConfig) NewLogger(debug bool) (zerolog.Logger, error) {
+	level, err := zerolog.ParseLevel(c.Level)
+	if err != nil || level == zerolog.NoLevel {
+		return zerolog.Nop(), fmt.Errorf("invalid log_level %q", c.Level)
+	}
+	if debug && level > zerolog.DebugLevel {
+		level = zerolog.DebugLevel
+	}
+	var w io.Writer = os.Stderr
+	if c.File != "" {
+		if w, err = openLogFile(c.File, c.MaxSize, c.MaxBackups); err != nil {
+			return zerolog.Nop(), err
+		}
+	}
+	if c.Format != LogFormatJSON {
+		w = zerolog.ConsoleWriter{Out: w, TimeFormat: time.RFC3339, NoColor: c.File != ""}
+	}
+	return zerolog.New(w).Level(level).With().Timestamp().Caller().Logger(), nil
+}
+
+// recordSampler returns the sampler for per record errors, or nil if they aren't sampled.
+func (c *LogConfig) recordSampler() zerolog.Sampler {
+	if c.SampleBurst <= 0 {
+		return nil
+	}
+	return &zerolog.BurstSampler{Burst: uint32(c.SampleBurst), Period: c.SamplePeriod}
+}
+
+// ShortCaller formats the caller of a log event as the file name and line, without the directory.
+func ShortCaller(file string, line int) string {
+	return filepath.Base(file) + ":" + strconv.Itoa(line)
+}
+
+var (
+	logFilesMu sync.Mutex
+	// logFiles holds the open log files, so that plugin instances logging to the same file share a writer.
+	logFiles = make(map[string]*rotatingFile)
+)
+
+// openLogFile opens the log file at path for appending, rotating it when it reaches maxSize bytes.
+func openLogFile(path string, maxSize int64, backups int) (*rotatingFile, error) {
+	logFilesMu.Lock()
+	defer logFilesMu.Unlock()
+	if f, ok := logFiles[path]; ok {
+		return f, nil
+	}
+	f := &rotatingFile{path: path, maxSize: maxSize, backups: backups}
+	if err := f.open(); err != nil {
+		return nil, fmt.Errorf("unable to open log_file: %w", err)
+	}
+	logFiles[path] = f
+	return f, nil
+}
+
+// rotatingFile is an io.Writer appending to a file, which is renamed to path.1 when it reaches maxSize bytes. Older
+// files are renamed to path.2 and so on, keeping up to backups files.
+type rotatingFile struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64
+	backups int
+	f       *os.File
+	size    int64
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	r.f, r.size = f, fi.Size()
+	return nil
+}
+
+// Write writes p to the file, rotating it first if p would take it over maxSize.
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	if r.f == nil {
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	r.f = nil
+	if r.backups <= 0 {
+		return os.Remove(r.path)
+	}
+	for i := r.backups - 1; i > 0; i-- {
+		old := r.path + "." + strconv.Itoa(i)
+		if err := os.Rename(old, r.path+"."+strconv.Itoa(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(r.path, r.path+".1")
+}
@@ -0,0 +1,128 @@
+/*
+ * Copyright 2022  David MacKinnon (blaedd@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You may
+ * not use this file except in compliance with the License. A copy of the
+ * License is located at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0.txt
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package plugin
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestLogConfig_NewLogger(t *testing.T) {
+	type testData struct {
+		cfg       LogConfig
+		debug     bool
+		wantLevel zerolog.Level
+		wantErr   bool
+	}
+	testMap := map[string]testData{
+		"default":       {cfg: DefaultLogConfig, wantLevel: zerolog.InfoLevel},
+		"trace":         {cfg: LogConfig{Level: "trace"}, wantLevel: zerolog.TraceLevel},
+		"warn":          {cfg: LogConfig{Level: "warn"}, wantLevel: zerolog.WarnLevel},
+		"debugOverride": {cfg: LogConfig{Level: "error"}, debug: true, wantLevel: zerolog.DebugLevel},
+		"debugLower":    {cfg: LogConfig{Level: "trace"}, debug: true, wantLevel: zerolog.TraceLevel},
+		"invalid":       {cfg: LogConfig{Level: "loud"}, wantErr: true},
+		"empty":         {cfg: LogConfig{}, wantErr: true},
+		"badFile": {cfg: LogConfig{Level: "info", File: filepath.Join(t.TempDir(), "missing", "log")},
+			wantErr: true},
+	}
+	for k, tt := range testMap {
+		t.Run(k, func(t *testing.T) {
+			l, err := tt.cfg.NewLogger(tt.debug)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewLogger() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && l.GetLevel() != tt.wantLevel {
+				t.Errorf("NewLogger() level = %v, want %v", l.GetLevel(), tt.wantLevel)
+			}
+		})
+	}
+}
+
+func TestLogConfig_NewLogger_file(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "plugin.log")
+	cfg := LogConfig{Level: "info", Format: LogFormatJSON, File: path}
+	l, err := cfg.NewLogger(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Info().Str("topic_id", "logs").Msg("hello")
+	l.Debug().Msg("hidden")
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("log file has %d lines, want 1: %s", len(lines), b)
+	}
+	var event map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &event); err != nil {
+		t.Fatalf("log line is not JSON: %v", err)
+	}
+	if event["message"] != "hello" || event["topic_id"] != "logs" || event["level"] != "info" {
+		t.Errorf("log event = %v", event)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "plugin.log")
+	r := &rotatingFile{path: path, maxSize: 10, backups: 2}
+	if err := r.open(); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"aaaaaa\n", "bbbbbb\n", "cccccc\n", "dddddd\n"} {
+		if _, err := r.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := map[string]string{path: "dddddd\n", path + ".1": "cccccc\n", path + ".2": "bbbbbb\n"}
+	for p, w := range want {
+		b, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != w {
+			t.Errorf("%s = %q, want %q", filepath.Base(p), b, w)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("%s.3 exists, want only 2 backups", filepath.Base(path))
+	}
+}
+
+func TestLogConfig_recordSampler(t *testing.T) {
+	if s := (&LogConfig{}).recordSampler(); s != nil {
+		t.Errorf("recordSampler() = %v, want nil without log_sample_burst", s)
+	}
+	s := (&LogConfig{SampleBurst: 2, SamplePeriod: time.Hour}).recordSampler()
+	var got int
+	for i := 0; i < 5; i++ {
+		if s.Sample(zerolog.ErrorLevel) {
+			got++
+		}
+	}
+	if got != 2 {
+		t.Errorf("recordSampler() sampled %d of 5 events, want 2", got)
+	}
+}
@@ -0,0 +1,110 @@
+/*
+ * Copyright 2022  David MacKinnon (blaedd@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You may
+ * not use this file except in compliance with the License. A copy of the
+ * License is located at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0.txt
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package plugin
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// metricsPrefix is prepended to the names of the exported metrics.
+const metricsPrefix = "fluentbit_pubsub_"
+
+// metricsWriter writes metrics in the Prometheus text exposition format.
+type metricsWriter struct {
+	w      io.Writer
+	labels string
+}
+
+// header writes the HELP and TYPE lines of a metric.
+func (m *metricsWriter) header(name, typ, help string) {
+	fmt.Fprintf(m.w, "# HELP %s%s %s\n# TYPE %s%s %s\n", metricsPrefix, name, help, metricsPrefix, name, typ)
+}
+
+// sample writes a sample of a metric, with the instance labels and any extra labels.
+func (m *metricsWriter) sample(name string, v int64, extra ...string) {
+	labels := m.labels
+	for i := 0; i+1 < len(extra); i += 2 {
+		labels += "," + extra[i] + "=" + strconv.Quote(extra[i+1])
+	}
+	fmt.Fprintf(m.w, "%s%s{%s} %d\n", metricsPrefix, name, labels, v)
+}
+
+func (m *metricsWriter) metric(name, typ, help string, v int64) {
+	m.header(name, typ, help)
+	m.sample(name, v)
+}
+
+// writeMetrics writes the metrics of the instance.
+func (p *OutputPlugin) writeMetrics(w io.Writer) {
+	m := &metricsWriter{w: w, labels: fmt.Sprintf("plugin_id=%q,topic=%q", strconv.Itoa(p.config.ID), p.config.TID)}
+	ready := int64(0)
+	if p.Ready() {
+		ready = 1
+	}
+	m.metric("initialized", "gauge", "Whether the client and topic are initialized.", ready)
+	m.metric("consecutive_failures", "gauge", "Consecutive flushes that failed to publish.",
+		p.health.failures.Load())
+	m.metric("outstanding_messages", "gauge", "Messages being published.", p.health.outstanding.Load())
+	m.metric("spooled_messages", "gauge", "Messages in the spool.", p.spooled())
+	if p.spool != nil {
+		m.metric("spool_rejected_total", "counter", "Spooled messages discarded after a non-retryable publish error.",
+			p.spool.rejected.Load())
+	}
+	if p.limiter != nil {
+		m.metric("rate_limited_dropped_total", "counter", "Messages dropped over the rate limit.",
+			p.limiter.droppedCount())
+	}
+	if p.smp != nil {
+		m.header("sampled_records_total", "counter", "Records sampled, by whether they were kept or dropped.")
+		m.sample("sampled_records_total", p.smp.kept.Load(), "decision", "kept")
+		m.sample("sampled_records_total", p.smp.dropped.Load(), "decision", "dropped")
+	}
+	if p.dedup != nil {
+		m.metric("dedup_dropped_total", "counter", "Duplicate records dropped.", p.dedup.dropped.Load())
+		m.metric("dedup_entries", "gauge", "Records remembered to find duplicates.", int64(p.dedup.size()))
+	}
+	if p.brk == nil {
+		return
+	}
+	s := p.brk.stats()
+	m.header("circuit_state", "gauge", "Circuit breaker state, 1 for the current state.")
+	for st, name := range breakerStateNames {
+		v := int64(0)
+		if breakerState(st) == s.state {
+			v = 1
+		}
+		m.sample("circuit_state", v, "state", name)
+	}
+	m.header("circuit_transitions_total", "counter", "Circuit breaker transitions, by the state entered.")
+	for st, name := range breakerStateNames {
+		m.sample("circuit_transitions_total", s.entered[st], "state", name)
+	}
+	m.metric("circuit_rejected_total", "counter", "Flushes failed fast by the open circuit breaker.", s.rejected)
+}
+
+// metricsHandler serves the instance metrics.
+func (p *OutputPlugin) metricsHandler(w http.ResponseWriter, _ *http.Request) {
+	var b strings.Builder
+	p.writeMetrics(&b)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_, _ = io.WriteString(w, b.String())
+}
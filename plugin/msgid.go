@@ -0,0 +1,86 @@
+/*
+ * Copyright 2022  David MacKinnon (blaedd@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You may
+ * not use this file except in compliance with the License. A copy of the
+ * License is located at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0.txt
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package plugin
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// MessageIDConfig holds the settings for the message ID attribute.
+type MessageIDConfig struct {
+	Attribute string // Attribute set to the message ID. Disabled if empty.
+	Field     string // Record field holding an ID, e.g. a UUID, used instead of a hash if present.
+	Host      string // Host name included in the hash. The system host name if empty.
+}
+
+// messageIDer computes a message ID that is the same each time a record is published. A nil messageIDer sets no ID.
+type messageIDer struct {
+	cfg  MessageIDConfig
+	host string
+}
+
+// newMessageIDer creates a messageIDer, or returns nil if the message ID attribute is disabled.
+func newMessageIDer(cfg *MessageIDConfig) (*messageIDer, error) {
+	if cfg.Attribute == "" {
+		return nil, nil
+	}
+	host := cfg.Host
+	if host == "" {
+		var err error
+		if host, err = os.Hostname(); err != nil {
+			return nil, fmt.Errorf("unable to get the host name for message IDs, set message_id_host: %w", err)
+		}
+	}
+	return &messageIDer{cfg: *cfg, host: host}, nil
+}
+
+// set sets the message ID attribute for a record. It must be called before the record is changed for encoding.
+//
+// The ID is the value of the ID field if the record has it, and otherwise a hash of the tag, timestamp, host and
+// record.
+func (m *messageIDer) set(attrs map[string]string, ts time.Time, tag string, record map[string]interface{}) {
+	if m == nil {
+		return
+	}
+	if m.cfg.Field != "" {
+		if v, ok := lookupField(record, m.cfg.Field); ok {
+			if id := fmt.Sprint(v); id != "" {
+				attrs[m.cfg.Attribute] = id
+				return
+			}
+		}
+	}
+	attrs[m.cfg.Attribute] = recordHash(ts, tag, m.host, record)
+}
+
+// recordHash returns a hex encoded hash of the tag, timestamp, host and record, which is the same each time a record
+// is published.
+func recordHash(ts time.Time, tag, host string, record map[string]interface{}) string {
+	h := sha256.New()
+	for _, s := range []string{tag, strconv.FormatInt(ts.UnixNano(), 10), host} {
+		_, _ = h.Write([]byte(s))
+		_, _ = h.Write([]byte{0})
+	}
+	writeValue(h, record)
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
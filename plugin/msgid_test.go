@@ -0,0 +1,101 @@
+/*
+ * Copyright 2022  David MacKinnon (blaedd@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You may
+ * not use this file except in compliance with the License. A copy of the
+ * License is located at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0.txt
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package plugin
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMessageIDer_set(t *testing.T) {
+	ts := time.Unix(1661810013, 500)
+	record := func() map[string]interface{} {
+		return map[string]interface{}{"log": "hello", "app": "web", "req": map[string]interface{}{"uuid": "u-1"}}
+	}
+	type testData struct {
+		cfg      MessageIDConfig
+		ts       time.Time
+		tag      string
+		record   map[string]interface{}
+		wantSame bool
+		wantID   string
+	}
+	base := MessageIDConfig{Attribute: "message_id", Host: "node-1"}
+	testMap := map[string]testData{
+		"same":           {cfg: base, ts: ts, tag: "app", record: record(), wantSame: true},
+		"otherTimestamp": {cfg: base, ts: ts.Add(time.Nanosecond), tag: "app", record: record()},
+		"otherTag":       {cfg: base, ts: ts, tag: "app2", record: record()},
+		"otherHost":      {cfg: MessageIDConfig{Attribute: "message_id", Host: "node-2"}, ts: ts, tag: "app", record: record()},
+		"otherRecord":    {cfg: base, ts: ts, tag: "app", record: map[string]interface{}{"log": "hello"}},
+		"idField": {cfg: MessageIDConfig{Attribute: "message_id", Field: "req.uuid"}, ts: ts, record: record(),
+			wantID: "u-1"},
+		"missingIDField": {cfg: MessageIDConfig{Attribute: "message_id", Field: "uuid", Host: "node-1"}, ts: ts,
+			tag: "app", record: record(), wantSame: true},
+		"emptyAttributes": {cfg: MessageIDConfig{Host: "node-1"}, ts: ts, record: record(), wantID: ""},
+	}
+	ref, err := newMessageIDer(&base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{}
+	ref.set(want, ts, "app", record())
+	if len(want["message_id"]) != 32 {
+		t.Fatalf("set() message_id = %q, want a 32 character hash", want["message_id"])
+	}
+	for k, tt := range testMap {
+		t.Run(k, func(t *testing.T) {
+			m, err := newMessageIDer(&tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			attrs := map[string]string{}
+			m.set(attrs, tt.ts, tt.tag, tt.record)
+			got := attrs["message_id"]
+			switch {
+			case tt.wantID != "" || tt.cfg.Attribute == "":
+				if got != tt.wantID {
+					t.Errorf("set() message_id = %q, want %q", got, tt.wantID)
+				}
+			case (got == want["message_id"]) != tt.wantSame:
+				t.Errorf("set() message_id = %q, reference %q, want same = %v", got, want["message_id"], tt.wantSame)
+			}
+		})
+	}
+}
+
+func TestOutputPlugin_CreateMessageID(t *testing.T) {
+	ts := time.Unix(1661810013, 0)
+	m, err := newMessageIDer(&MessageIDConfig{Attribute: "message_id", Host: "node-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{}
+	m.set(want, ts, "app", map[string]interface{}{"log": "hello", "app": "web"})
+
+	// The ID is computed before the timestamp field is added and attribute fields are removed.
+	p := &OutputPlugin{TSField: "fb_ts", As: []string{"app"}, enc: jsonEncoder{}, msgID: m}
+	for i := 0; i < 2; i++ {
+		msg, err := p.CreateMessage(ts, "app", map[string]interface{}{"log": "hello", "app": "web"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Attributes["message_id"] != want["message_id"] {
+			t.Errorf("CreateMessage() message_id = %q, want %q", msg.Attributes["message_id"], want["message_id"])
+		}
+	}
+}
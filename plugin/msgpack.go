@@ -0,0 +1,125 @@
+/*
+ * Copyright 2022  David MacKinnon (blaedd@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You may
+ * not use this file except in compliance with the License. A copy of the
+ * License is located at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0.txt
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package plugin
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"time"
+
+	"github.com/ugorji/go/codec"
+)
+
+const msgpackContentType = "application/msgpack"
+
+// msgpackEncoder publishes the original MsgPack encoding of records.
+//
+// If the record was changed by [OutputPlugin.CreateMessage], for instance by removing attribute fields, a new map is
+// built from the original encoded entries that remain in the record, so the encoding of the remaining fields is
+// preserved.
+type msgpackEncoder struct {
+	r       *FLBRecordReader
+	handle  *codec.MsgpackHandle
+	dec     *codec.Decoder
+	keyDec  *codec.Decoder
+	tsField string
+}
+
+func newMsgpackEncoder(r *FLBRecordReader, tsField string) *msgpackEncoder {
+	r.KeepRaw(true)
+	// WriteExt keeps binary values as MsgPack bin rather than str.
+	h := &codec.MsgpackHandle{WriteExt: true}
+	return &msgpackEncoder{r: r, handle: h, dec: codec.NewDecoderBytes([]byte{}, h),
+		keyDec: codec.NewDecoderBytes([]byte{}, h), tsField: tsField}
+}
+
+// mapHeader returns the number of entries in a MsgPack encoded map, and the length of the map header.
+func mapHeader(b []byte) (int, int, error) {
+	switch {
+	case len(b) >= 1 && b[0]&0xf0 == 0x80:
+		return int(b[0] & 0x0f), 1, nil
+	case len(b) >= 3 && b[0] == 0xde:
+		return int(binary.BigEndian.Uint16(b[1:])), 3, nil
+	case len(b) >= 5 && b[0] == 0xdf:
+		return int(binary.BigEndian.Uint32(b[1:])), 5, nil
+	}
+	return 0, 0, errors.New("record is not a MsgPack map")
+}
+
+// appendMapHeader appends a MsgPack map header for n entries to b.
+func appendMapHeader(b []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(b, 0x80|byte(n))
+	case n <= math.MaxUint16:
+		b = append(b, 0xde, 0, 0)
+		binary.BigEndian.PutUint16(b[len(b)-2:], uint16(n))
+		return b
+	}
+	b = append(b, 0xdf, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(b[len(b)-4:], uint32(n))
+	return b
+}
+
+func (e *msgpackEncoder) Encode(_ time.Time, _ string, record map[string]interface{}, attrs map[string]string) ([]byte, error) {
+	raw := e.r.RawRecord()
+	n, hdrLen, err := mapHeader(raw)
+	if err != nil {
+		return nil, err
+	}
+	attrs["content-type"] = msgpackContentType
+	if n == len(record) && e.tsField == "" {
+		return raw, nil
+	}
+
+	var (
+		entries = make([]byte, 0, len(raw))
+		kept    = 0
+		key     string
+		val     codec.Raw
+	)
+	e.dec.ResetBytes(raw[hdrLen:])
+	for i := 0; i < n; i++ {
+		var k codec.Raw
+		if err := e.dec.Decode(&k); err != nil {
+			return nil, err
+		}
+		if err := e.dec.Decode(&val); err != nil {
+			return nil, err
+		}
+		key = ""
+		e.keyDec.ResetBytes(k)
+		_ = e.keyDec.Decode(&key)
+		if _, ok := record[key]; !ok || key == e.tsField {
+			continue
+		}
+		entries = append(append(entries, k...), val...)
+		kept++
+	}
+	if e.tsField != "" {
+		var tsEntry []byte
+		if err := codec.NewEncoderBytes(&tsEntry, e.handle).Encode([]interface{}{e.tsField, record[e.tsField]}); err != nil {
+			return nil, err
+		}
+		// Strip the array header, leaving the key and value.
+		entries = append(entries, tsEntry[1:]...)
+		kept++
+	}
+	return append(appendMapHeader(make([]byte, 0, len(entries)+5), kept), entries...), nil
+}
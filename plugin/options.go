@@ -0,0 +1,880 @@
+/*
+ * Copyright 2022  David MacKinnon (blaedd@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You may
+ * not use this file except in compliance with the License. A copy of the
+ * License is located at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0.txt
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package plugin
+
+//go:generate go run ../internal/cmd/optdocs ../README.md
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc/codes"
+)
+
+// OptionType is the type of a configuration option value.
+type OptionType int
+
+// Configuration option types.
+const (
+	TypeString    OptionType = iota // A string.
+	TypeTemplate                    // A string holding a record template.
+	TypeBool                        // A boolean.
+	TypeInt                         // An integer.
+	TypeDuration                    // A time.Duration, e.g. 1m30s.
+	TypeStrings                     // A comma seperated list of strings.
+	TypeKeyValues                   // A comma seperated list of key=value pairs.
+	TypeCodes                       // A comma seperated list of gRPC status codes.
+	TypeBytes                       // A size in bytes, with an optional unit, e.g. 5M or 512KiB.
+	TypeFloat                       // A floating point number.
+)
+
+var optionTypeNames = [...]string{"string", "template", "boolean", "int", "Duration", "comma seperated strings",
+	"comma seperated key=value pairs", "comma seperated status codes", "size", "float"}
+
+func (t OptionType) String() string {
+	if int(t) < len(optionTypeNames) {
+		return optionTypeNames[t]
+	}
+	return strconv.Itoa(int(t))
+}
+
+// Option groups. Each group is documented in its own section of the README.
+const (
+	GroupGeneral     = "general"
+	GroupTopic       = "topic"
+	GroupRetry       = "retry"
+	GroupBatch       = "batch"
+	GroupCloudEvents = "cloudevents"
+	GroupLogEntry    = "logentry"
+	GroupRaw         = "raw"
+	GroupTracing     = "tracing"
+	GroupLogging     = "logging"
+	GroupHealth      = "health"
+	GroupSpool       = "spool"
+	GroupBreaker     = "breaker"
+	GroupRateLimit   = "ratelimit"
+	GroupSampling    = "sampling"
+	GroupDedup       = "dedup"
+)
+
+// An Option describes a plugin configuration option.
+//
+// Options drive [BuildPluginConfig], the per option checks in [OutputPluginConfig.Validate], the debug logging of the
+// effective configuration and the option documentation.
+type Option struct {
+	Name        string     // Configuration key.
+	Group       string     // Documentation group.
+	Type        OptionType // Type of the value.
+	Default     string     // Default value in configuration syntax, applied when the option is not set.
+	DocDefault  string     // Default shown in the documentation, when Default can't express it.
+	Example     string     // Example value for the documentation.
+	Description string     // Markdown description for the documentation.
+	Required    bool       // The option must be set.
+	Sensitive   bool       // The value is redacted from logs.
+	Values      []string   // Allowed values of string options.
+	Min         string     // Minimum value of int, size, float and Duration options, in configuration syntax.
+	Max         string     // Maximum value of int, size, float and Duration options, in configuration syntax.
+
+	// field returns a pointer to the OutputPluginConfig field holding the value.
+	field func(c *OutputPluginConfig) interface{}
+}
+
+// Options are the supported plugin configuration options. They are loaded in order.
+var Options = []*Option{
+	{Name: "gcp_project_id", Group: GroupGeneral, Type: TypeString, Required: true, Example: "my_gcp_project",
+		Description: "Google Cloud project id",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.PID }},
+	{Name: "topic_id", Group: GroupGeneral, Type: TypeString, Required: true, Example: "fluentbit_logs",
+		Description: "PubSub topic ID",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.TID }},
+	{Name: "debug", Group: GroupGeneral, Type: TypeBool, Default: "false", Example: "true",
+		Description: "Enables debug logging, including the effective configuration. Overrides a higher `log_level`.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.D }},
+	{Name: "config_file", Group: GroupGeneral, Type: TypeString, Example: "/etc/fluent-bit/pubsub.yaml",
+		Description: "YAML or JSON file of options, used for options not set in the `[OUTPUT]` section or the " +
+			"environment.",
+		field: func(c *OutputPluginConfig) interface{} { return &c.ConfigFile }},
+	{Name: "env_prefix", Group: GroupGeneral, Type: TypeString, Default: DefaultEnvPrefix, Example: "PUBSUB_AUDIT_",
+		Description: "Prefix of environment variables holding options not set in the `[OUTPUT]` section. Variables " +
+			"with the prefix that aren't options, even after a longer prefix, are logged as warnings.",
+		field: func(c *OutputPluginConfig) interface{} { return &c.EnvPrefix }},
+	{Name: "credentials_file", Group: GroupGeneral, Type: TypeString, Example: "/etc/fluent-bit/gcloud.json",
+		Description: "Path to a credentials file. Service account keys and workload identity federation (external " +
+			"account) configurations are supported.",
+		field: func(c *OutputPluginConfig) interface{} { return &c.Crds }},
+	{Name: "credentials_reload_interval", Group: GroupGeneral, Type: TypeDuration, Default: "1m", Min: "0s",
+		Example: "5m",
+		Description: "How often to check `credentials_file` for changes. When the contents change, a new client is " +
+			"created and outstanding messages are sent with the previous one. Set to 0 to disable.",
+		field: func(c *OutputPluginConfig) interface{} { return &c.CrdsReload }},
+	{Name: "credentials_json", Group: GroupGeneral, Type: TypeString, Sensitive: true,
+		Example: "${PUBSUB_CREDENTIALS}",
+		Description: "Credentials as inline JSON, typically from an environment variable. Only one of " +
+			"`credentials_file` and `credentials_json` can be set.",
+		field: func(c *OutputPluginConfig) interface{} { return &c.CrdsJSON }},
+	{Name: "impersonate_service_account", Group: GroupGeneral, Type: TypeString,
+		Example:     "publisher@my_gcp_project.iam.gserviceaccount.com",
+		Description: "Service account to impersonate, using the credentials from the other options.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.Impersonate }},
+	{Name: "impersonate_delegates", Group: GroupGeneral, Type: TypeStrings,
+		Example:     "sa1@proj.iam.gserviceaccount.com",
+		Description: "Delegation chain of service accounts used to impersonate `impersonate_service_account`.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.Delegates }},
+	{Name: "oauth_scopes", Group: GroupGeneral, Type: TypeStrings, DocDefault: "pubsub and cloud-platform scopes",
+		Example:     "https://www.googleapis.com/auth/pubsub",
+		Description: "OAuth scopes to request.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.Scopes }},
+	{Name: "quota_project", Group: GroupGeneral, Type: TypeString, Example: "my_billing_project",
+		Description: "Project used for quota and billing of API requests.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.QuotaProject }},
+	{Name: "lazy_init", Group: GroupGeneral, Type: TypeBool, Default: "false", Example: "true",
+		Description: "If true, plugin initialization succeeds even if PubSub can't be reached. The client and topic " +
+			"are set up in the background, retrying with backoff, and flushes are retried until it succeeds.",
+		field: func(c *OutputPluginConfig) interface{} { return &c.LazyInit }},
+	{Name: "init_retry_min", Group: GroupGeneral, Type: TypeDuration, Default: "1s", Example: "5s",
+		Description: "Initial delay between background initialization attempts with `lazy_init`.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.InitRetryMin }},
+	{Name: "init_retry_max", Group: GroupGeneral, Type: TypeDuration, Default: "5m", Example: "1m",
+		Description: "Maximum delay between background initialization attempts with `lazy_init`.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.InitRetryMax }},
+	{Name: "timestamp_field", Group: GroupGeneral, Type: TypeString, Example: "fb_ts",
+		Description: "Log record field to populate/update with the fluent-bit timestamp",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.TSField }},
+	{Name: "attribute_fields", Group: GroupGeneral, Type: TypeStrings, Example: "loghost,tag,app",
+		Description: "Fields to use as PubSub message attributes. These are useful since subscribers can filter " +
+			"messages by attributes, but not body content.",
+		field: func(c *OutputPluginConfig) interface{} { return &c.As }},
+	{Name: "keep_attribute_fields", Group: GroupGeneral, Type: TypeBool, Default: "false", Example: "true",
+		Description: "If set to true, record fields used as attributes are also left in the log record. Otherwise, " +
+			"they are removed.",
+		field: func(c *OutputPluginConfig) interface{} { return &c.KA }},
+	{Name: "message_id_attribute", Group: GroupGeneral, Type: TypeString, Example: "message_id",
+		Description: "Attribute to set to an ID that is the same each time a record is published, so subscribers can " +
+			"drop retried messages. A hash of the tag, timestamp, host and record, unless `message_id_field` is set.",
+		field: func(c *OutputPluginConfig) interface{} { return &c.MessageID.Attribute }},
+	{Name: "message_id_field", Group: GroupGeneral, Type: TypeString, Example: "uuid",
+		Description: "Record field holding an ID, such as a UUID, to use as the message ID. The hash is used for " +
+			"records without it.",
+		field: func(c *OutputPluginConfig) interface{} { return &c.MessageID.Field }},
+	{Name: "message_id_host", Group: GroupGeneral, Type: TypeString, DocDefault: "system host name", Example: "node-1",
+		Description: "Host name included in the message ID hash.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.MessageID.Host }},
+	{Name: "publish_timeout", Group: GroupGeneral, Type: TypeDuration, Default: "60s", Min: "0s", Example: "2m",
+		Description: "Timeout to use on the PubSub publisher client.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.PS.Timeout }},
+	{Name: "format", Group: GroupGeneral, Type: TypeString, Default: FormatJSON, Example: FormatCloudEvents,
+		Values:      []string{FormatJSON, FormatCloudEvents, FormatLogEntry, FormatRaw, FormatMsgpack},
+		Description: "Message payload format.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.Fmt }},
+	{Name: "data_template", Group: GroupGeneral, Type: TypeTemplate, Example: "{{.Record.log}}",
+		Description: "[Go template](https://pkg.go.dev/text/template) used to render the message payload, instead " +
+			"of encoding the record as JSON. Only used with the `json` format.",
+		field: func(c *OutputPluginConfig) interface{} { return &c.Tmpl }},
+	{Name: "data_template_file", Group: GroupGeneral, Type: TypeString, Example: "/etc/fluent-bit/msg.tmpl",
+		Description: "File containing the `data_template`. Only one of `data_template` and `data_template_file` " +
+			"can be set.",
+		field: func(c *OutputPluginConfig) interface{} { return &c.TmplFile }},
+
+	{Name: "skip_topic_check", Group: GroupTopic, Type: TypeBool, Default: "false", Example: "true",
+		Description: "If true, don't check the topic exists at startup.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.SkipTopicCheck }},
+	{Name: "create_topic", Group: GroupTopic, Type: TypeBool, Default: "false", Example: "true",
+		Description: "If true, create the topic if it doesn't exist.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.CreateTopic }},
+	{Name: "topic_labels", Group: GroupTopic, Type: TypeKeyValues, Example: "team=core,env=prod",
+		Description: "Labels for created topics.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.TopicLabels }},
+	{Name: "topic_retention", Group: GroupTopic, Type: TypeDuration, Example: "24h",
+		Description: "Message retention for created topics, between 10m and 168h.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.TopicRetention }},
+	{Name: "topic_schema", Group: GroupTopic, Type: TypeString, Example: "log-schema",
+		Description: "Schema for created topics, as a schema id or `projects/PROJECT/schemas/SCHEMA`.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.TopicSchema }},
+	{Name: "topic_schema_encoding", Group: GroupTopic, Type: TypeString, Default: "json", Example: "binary",
+		Values:      []string{"json", "binary"},
+		Description: "Encoding of messages validated against `topic_schema`.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.TopicSchemaEnc }},
+
+	{Name: "retry_codes", Group: GroupRetry, Type: TypeCodes, Default: codeNames(DefaultRetryCodes),
+		Description: "Status codes that are retried.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.RetryCodes }},
+	{Name: "fatal_codes", Group: GroupRetry, Type: TypeCodes,
+		Description: "Status codes that are never retried, overriding `retry_codes`.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.FatalCodes }},
+	{Name: "publish_retries", Group: GroupRetry, Type: TypeInt, Default: "0", Min: "0",
+		Description: "Number of times the plugin retries failed messages before returning `FLB_RETRY`.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.Retry.Retries }},
+	{Name: "publish_retry_min", Group: GroupRetry, Type: TypeDuration, Default: "100ms", Min: "0s",
+		Description: "Initial delay between plugin retries.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.Retry.Min }},
+	{Name: "publish_retry_max", Group: GroupRetry, Type: TypeDuration, Default: "5s", Min: "0s",
+		Description: "Maximum delay between plugin retries.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.Retry.Max }},
+
+	{Name: "publish_delay_threshold", Group: GroupBatch, Type: TypeDuration, Default: "1s", Min: "0s",
+		Description: "Publish a non-empty batch after this much time has passed.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.PS.DelayThreshold }},
+	{Name: "publish_byte_threshold", Group: GroupBatch, Type: TypeBytes, Default: "1M", Min: "0",
+		Max:         strconv.Itoa(pubsub.MaxPublishRequestBytes),
+		Description: "Publish a batch once it reaches this size in bytes.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.PS.ByteThreshold }},
+	{Name: "publish_count_threshold", Group: GroupBatch, Type: TypeInt, Default: "100", Min: "0",
+		Max:         strconv.Itoa(pubsub.MaxPublishRequestCount),
+		Description: "Publish a batch once it has this many messages.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.PS.CountThreshold }},
+	{Name: "publish_num_goroutines", Group: GroupBatch, Type: TypeInt, DocDefault: "25 × GOMAXPROCS", Min: "0",
+		Description: "Number of goroutines used to publish each batch.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.PS.NumGoroutines }},
+	{Name: "publish_buffered_byte_limit", Group: GroupBatch, Type: TypeBytes, Default: "100M", Min: "0",
+		Description: "Maximum bytes buffered by the client before publishes fail.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.PS.BufferedByteLimit }},
+	{Name: "publish_max_outstanding_messages", Group: GroupBatch, Type: TypeInt, Default: "1000",
+		Description: "Flow control limit on unpublished messages. Zero or less is unlimited.",
+		field: func(c *OutputPluginConfig) interface{} {
+			return &c.PS.FlowControlSettings.MaxOutstandingMessages
+		}},
+	{Name: "publish_max_outstanding_bytes", Group: GroupBatch, Type: TypeBytes, DocDefault: "unlimited",
+		Description: "Flow control limit on unpublished bytes. Zero is unlimited.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.PS.FlowControlSettings.MaxOutstandingBytes }},
+	{Name: "publish_limit_exceeded_behavior", Group: GroupBatch, Type: TypeString, Default: "ignore",
+		Values: []string{"ignore", "block", "signal_error"},
+		Description: "What to do when a flow control limit is reached. With `signal_error` the flush is " +
+			"retried.",
+		field: func(c *OutputPluginConfig) interface{} { return &c.PS.FlowControlSettings.LimitExceededBehavior }},
+	{Name: "publish_enable_compression", Group: GroupBatch, Type: TypeBool, Default: "false",
+		Description: "Compress publish requests with gzip.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.PS.EnableCompression }},
+	{Name: "publish_compression_bytes_threshold", Group: GroupBatch, Type: TypeBytes, Default: "240", Min: "0",
+		Description: "Only compress requests of at least this many bytes.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.PS.CompressionBytesThreshold }},
+
+	{Name: "cloudevents_mode", Group: GroupCloudEvents, Type: TypeString, Default: DefaultCloudEventsConfig.Mode,
+		Example: CloudEventsStructured, Values: []string{CloudEventsBinary, CloudEventsStructured},
+		Description: "Content mode.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.CE.Mode }},
+	{Name: "cloudevents_id", Group: GroupCloudEvents, Type: TypeTemplate, Default: DefaultCloudEventsConfig.ID,
+		Example: "{{.Record.request_id}}",
+		Description: "Template for the event id. The default is a hash of the tag, timestamp and record, so a " +
+			"record retried by fluent-bit keeps its id. `{{uuid}}` is different on every retry.",
+		field: func(c *OutputPluginConfig) interface{} { return &c.CE.ID }},
+	{Name: "cloudevents_source", Group: GroupCloudEvents, Type: TypeTemplate,
+		Default: DefaultCloudEventsConfig.Source, Example: "//fluent-bit/{{.Record.hostname}}",
+		Description: "Template for the event source.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.CE.Source }},
+	{Name: "cloudevents_type", Group: GroupCloudEvents, Type: TypeTemplate, Default: DefaultCloudEventsConfig.Type,
+		Example: "com.example.{{.Record.app}}.log", Description: "Template for the event type.",
+		field: func(c *OutputPluginConfig) interface{} { return &c.CE.Type }},
+	{Name: "cloudevents_subject", Group: GroupCloudEvents, Type: TypeTemplate,
+		Default: DefaultCloudEventsConfig.Subject, Example: "{{.Record.app}}",
+		Description: "Template for the event subject. The subject is omitted if it renders empty.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.CE.Subject }},
+	{Name: "cloudevents_time", Group: GroupCloudEvents, Type: TypeTemplate, Example: "{{.Record.time}}",
+		Description: "Template for the event time. Defaults to the RFC 3339 fluent-bit timestamp.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.CE.Time }},
+
+	{Name: "logentry_log_name", Group: GroupLogEntry, Type: TypeTemplate, Default: DefaultLogEntryConfig.LogName,
+		Description: "Template for the log id in `logName`.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.LE.LogName }},
+	{Name: "logentry_severity_fields", Group: GroupLogEntry, Type: TypeStrings,
+		Default:     strings.Join(DefaultLogEntryConfig.SeverityFields, ","),
+		Description: "Fields checked, in order, for the entry severity.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.LE.SeverityFields }},
+	{Name: "logentry_message_fields", Group: GroupLogEntry, Type: TypeStrings,
+		Default:     strings.Join(DefaultLogEntryConfig.MessageFields, ","),
+		Description: "Fields checked, in order, for the log message.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.LE.MessageFields }},
+	{Name: "logentry_payload", Group: GroupLogEntry, Type: TypeString, Default: DefaultLogEntryConfig.Payload,
+		Values: []string{PayloadAuto, PayloadText, PayloadJSON}, Description: "Payload mode.",
+		field: func(c *OutputPluginConfig) interface{} { return &c.LE.Payload }},
+	{Name: "logentry_labels_field", Group: GroupLogEntry, Type: TypeString,
+		Default: DefaultLogEntryConfig.LabelsField, Description: "Field holding a map of entry labels.",
+		field: func(c *OutputPluginConfig) interface{} { return &c.LE.LabelsField }},
+	{Name: "logentry_label_fields", Group: GroupLogEntry, Type: TypeStrings,
+		Description: "Additional fields to copy into the entry labels.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.LE.LabelFields }},
+	{Name: "logentry_resource_type", Group: GroupLogEntry, Type: TypeString,
+		Default:     DefaultLogEntryConfig.ResourceType,
+		Description: "Monitored resource type. If empty no resource is set.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.LE.ResourceType }},
+	{Name: "logentry_resource_labels", Group: GroupLogEntry, Type: TypeKeyValues,
+		Default:     formatKeyValues(DefaultLogEntryConfig.ResourceLabels),
+		Description: "Monitored resource labels, as `label=field` pairs. `project_id` is always set.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.LE.ResourceLabels }},
+	{Name: "logentry_trace_field", Group: GroupLogEntry, Type: TypeString, Default: DefaultLogEntryConfig.TraceField,
+		Description: "Field holding the trace id.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.LE.TraceField }},
+	{Name: "logentry_span_id_field", Group: GroupLogEntry, Type: TypeString,
+		Default: DefaultLogEntryConfig.SpanIDField, Description: "Field holding the span id.",
+		field: func(c *OutputPluginConfig) interface{} { return &c.LE.SpanIDField }},
+	{Name: "logentry_timestamp_field", Group: GroupLogEntry, Type: TypeString, Example: "time",
+		Description: "Field holding the entry timestamp, as RFC 3339 or a Unix epoch time in seconds, milliseconds, " +
+			"microseconds or nanoseconds. The fluent-bit timestamp is used if not set, or the field can't be parsed.",
+		field: func(c *OutputPluginConfig) interface{} { return &c.LE.TimestampField }},
+
+	{Name: "raw_field", Group: GroupRaw, Type: TypeString, Default: DefaultRawConfig.Field,
+		Description: "Record field published as the message data.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.Raw.Field }},
+	{Name: "raw_attributes", Group: GroupRaw, Type: TypeBool, Default: "false",
+		Description: "If true, the remaining record fields become message attributes. Nested values are JSON " +
+			"encoded. Records exceeding the PubSub limits of 100 attributes, 256 byte names or 1024 byte values " +
+			"fail to encode and are skipped.",
+		field: func(c *OutputPluginConfig) interface{} { return &c.Raw.Attrs }},
+	{Name: "raw_missing", Group: GroupRaw, Type: TypeString, Default: DefaultRawConfig.Missing,
+		Values: []string{RawMissingJSON, RawMissingDrop, RawMissingError},
+		Description: "What to do with records without the field. `json` publishes the whole record as JSON, `drop` " +
+			"discards the record and `error` logs an error and skips it.",
+		field: func(c *OutputPluginConfig) interface{} { return &c.Raw.Missing }},
+	{Name: "raw_encoding", Group: GroupRaw, Type: TypeString, Default: DefaultRawConfig.Encoding,
+		Values:      []string{RawEncodingNone, RawEncodingBase64, RawEncodingHex},
+		Description: "Encoding of the field value, which is decoded before publishing.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.Raw.Encoding }},
+
+	{Name: "otel_endpoint", Group: GroupTracing, Type: TypeString, Example: "otel-collector:4317",
+		Description: "OTLP/gRPC endpoint to export flush spans to. Tracing is disabled if not set.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.Tracing.Endpoint }},
+	{Name: "otel_insecure", Group: GroupTracing, Type: TypeBool, Default: "false",
+		Description: "Connect to the OTLP endpoint without TLS.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.Tracing.Insecure }},
+	{Name: "otel_service_name", Group: GroupTracing, Type: TypeString, Default: DefaultTracingConfig.ServiceName,
+		Description: "The `service.name` of the exported spans.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.Tracing.ServiceName }},
+	{Name: "trace_propagate", Group: GroupTracing, Type: TypeBool, Default: "false",
+		Description: "If true, the W3C trace context of the publish span is added to each message as " +
+			"`googclient_traceparent` and `googclient_tracestate` attributes.",
+		field: func(c *OutputPluginConfig) interface{} { return &c.Tracing.Propagate }},
+	{Name: "trace_link_field", Group: GroupTracing, Type: TypeString, Example: "trace_id",
+		Description: "Record field holding a trace id. The publish span is linked to the span it identifies. " +
+			"Cloud Logging `projects/PROJECT/traces/TRACE_ID` values are accepted.",
+		field: func(c *OutputPluginConfig) interface{} { return &c.Tracing.LinkField }},
+	{Name: "trace_link_span_field", Group: GroupTracing, Type: TypeString, Example: "span_id",
+		Description: "Record field holding the span id to link to. Without a span id, the trace id is added to " +
+			"the `fluentbit.linked_trace_ids` attribute of the publish span instead of a link.",
+		field: func(c *OutputPluginConfig) interface{} { return &c.Tracing.LinkSpanField }},
+
+	{Name: "health_listen", Group: GroupHealth, Type: TypeString, Example: ":2021",
+		Description: "Address to serve the `/healthz`, `/readyz` and `/metrics` endpoints of this instance on. Each " +
+			"instance needs its own address. Disabled if not set.",
+		field: func(c *OutputPluginConfig) interface{} { return &c.Health.Listen }},
+	{Name: "health_max_failures", Group: GroupHealth, Type: TypeInt, Default: strconv.Itoa(DefaultHealthConfig.MaxFailures),
+		Min: "0", Description: "Consecutive failed flushes after which `/healthz` reports unhealthy. 0 disables.",
+		field: func(c *OutputPluginConfig) interface{} { return &c.Health.MaxFailures }},
+	{Name: "health_max_publish_age", Group: GroupHealth, Type: TypeDuration, Default: "0s", Min: "0s",
+		Example: "5m",
+		Description: "How long publishes can fail without a success before `/readyz` reports not ready. 0 " +
+			"disables.",
+		field: func(c *OutputPluginConfig) interface{} { return &c.Health.MaxPublishAge }},
+	{Name: "health_max_outstanding", Group: GroupHealth, Type: TypeInt, Default: "0", Min: "0", Example: "5000",
+		Description: "Outstanding messages above which `/readyz` reports not ready. 0 disables.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.Health.MaxOutstanding }},
+
+	{Name: "spool_dir", Group: GroupSpool, Type: TypeString, Example: "/var/lib/fluent-bit/pubsub",
+		Description: "Directory to spool messages that fail to publish in. Each instance needs its own directory. " +
+			"Disabled if not set.",
+		field: func(c *OutputPluginConfig) interface{} { return &c.Spool.Dir }},
+	{Name: "spool_max_size", Group: GroupSpool, Type: TypeBytes, Default: "1G", Min: "1",
+		Description: "Maximum size of the spool.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.Spool.MaxSize }},
+	{Name: "spool_segment_size", Group: GroupSpool, Type: TypeBytes, Default: "16M", Min: "1",
+		Description: "Size of the spool files. Files are removed once all their messages are published.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.Spool.SegmentSize }},
+	{Name: "spool_full", Group: GroupSpool, Type: TypeString, Default: DefaultSpoolConfig.Full,
+		Values: []string{SpoolFullDropOldest, SpoolFullReject},
+		Description: "What to do when the spool is full. `drop_oldest` removes the oldest spool file, `reject` " +
+			"returns the chunk to fluent-bit to retry.",
+		field: func(c *OutputPluginConfig) interface{} { return &c.Spool.Full }},
+	{Name: "spool_drain_interval", Group: GroupSpool, Type: TypeDuration,
+		Default: DefaultSpoolConfig.DrainInterval.String(), Min: "1ms",
+		Description: "How often to try to publish spooled messages.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.Spool.DrainInterval }},
+	{Name: "spool_drain_batch", Group: GroupSpool, Type: TypeInt, Default: strconv.Itoa(DefaultSpoolConfig.DrainBatch),
+		Min: "1", Description: "Maximum number of spooled messages published at once.",
+		field: func(c *OutputPluginConfig) interface{} { return &c.Spool.DrainBatch }},
+
+	{Name: "breaker_failures", Group: GroupBreaker, Type: TypeInt, Default: "0", Min: "0", Example: "5",
+		Description: "Consecutive failed publishes after which the circuit opens, and flushes are retried without " +
+			"publishing. 0 disables the circuit breaker.",
+		field: func(c *OutputPluginConfig) interface{} { return &c.Breaker.Failures }},
+	{Name: "breaker_cooldown", Group: GroupBreaker, Type: TypeDuration,
+		Default: DefaultBreakerConfig.Cooldown.String(), Min: "1ms",
+		Description: "How long the circuit stays open before a probe publish is let through.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.Breaker.Cooldown }},
+	{Name: "breaker_probes", Group: GroupBreaker, Type: TypeInt, Default: strconv.Itoa(DefaultBreakerConfig.Probes),
+		Min: "1", Description: "Successful probe publishes needed to close the circuit.",
+		field: func(c *OutputPluginConfig) interface{} { return &c.Breaker.Probes }},
+
+	{Name: "max_messages_per_second", Group: GroupRateLimit, Type: TypeInt, Default: "0", Min: "0", Example: "1000",
+		Description: "Maximum messages published per second, 0 for no limit.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.RateLimit.Messages }},
+	{Name: "max_bytes_per_second", Group: GroupRateLimit, Type: TypeBytes, Default: "0", Min: "0", Example: "10M",
+		Description: "Maximum message data bytes published per second, 0 for no limit.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.RateLimit.Bytes }},
+	{Name: "rate_limit_exceeded", Group: GroupRateLimit, Type: TypeString, Default: DefaultRateLimitConfig.Exceeded,
+		Values: []string{RateLimitBlock, RateLimitRetry, RateLimitDrop},
+		Description: "What to do with messages over the rate limit. `block` waits until they are under the " +
+			"limit, `retry` returns chunks that would wait longer than `publish_timeout` to fluent-bit before any of " +
+			"their messages are published, `drop` discards them.",
+		field: func(c *OutputPluginConfig) interface{} { return &c.RateLimit.Exceeded }},
+	{Name: "rate_limit_scope", Group: GroupRateLimit, Type: TypeString, Default: DefaultRateLimitConfig.Scope,
+		Values:      []string{RateLimitInstance, RateLimitTopic},
+		Description: "Whether the rate limits apply to each instance, or are shared by the instances publishing to a topic.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.RateLimit.Scope }},
+
+	{Name: "sample_rate", Group: GroupSampling, Type: TypeFloat, Default: "1", Min: "0", Max: "1", Example: "0.1",
+		Description: "Fraction of records published, from 0 to 1, for records without a rate in `sample_rates`.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.Sample.Rate }},
+	{Name: "sample_field", Group: GroupSampling, Type: TypeString, Example: "level",
+		Description: "Record field whose value selects the sample rate from `sample_rates`.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.Sample.Field }},
+	{Name: "sample_rates", Group: GroupSampling, Type: TypeKeyValues, Example: "debug=0.01,info=0.5",
+		Description: "Sample rates by the value of `sample_field`.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.Sample.Rates }},
+	{Name: "sample_key_field", Group: GroupSampling, Type: TypeString, Example: "request_id",
+		Description: "Record field hashed to decide if a record is kept, so records with the same value are kept or " +
+			"dropped together. Records are sampled at random if not set, or the record doesn't have the field.",
+		field: func(c *OutputPluginConfig) interface{} { return &c.Sample.KeyField }},
+	{Name: "sample_rate_attribute", Group: GroupSampling, Type: TypeString, Example: "sample_rate",
+		Description: "Attribute set to the rate the record was sampled at. Not set if empty.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.Sample.Attribute }},
+
+	{Name: "dedup_window", Group: GroupDedup, Type: TypeDuration, Default: "0s", Min: "0s", Example: "5m",
+		Description: "How long published records are remembered, to drop duplicates. 0 disables duplicate suppression.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.Dedup.Window }},
+	{Name: "dedup_fields", Group: GroupDedup, Type: TypeStrings, Example: "log,kubernetes.pod_name",
+		Description: "Record fields that identify duplicate records. If not set, the whole record and its timestamp " +
+			"are compared, so the same line logged at different times isn't a duplicate.",
+		field: func(c *OutputPluginConfig) interface{} { return &c.Dedup.Fields }},
+	{Name: "dedup_max_memory", Group: GroupDedup, Type: TypeBytes, Default: "16M", Min: "1",
+		Description: "Approximate memory used to remember records. The oldest records are forgotten when it is used up.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.Dedup.MaxMemory }},
+	{Name: "dedup_attribute", Group: GroupDedup, Type: TypeString, Default: DefaultDedupConfig.Attribute,
+		Description: "Attribute set to the hash identifying the record, for consumers to drop duplicates. Not set if empty.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.Dedup.Attribute }},
+
+	{Name: "log_level", Group: GroupLogging, Type: TypeString, Default: DefaultLogConfig.Level,
+		Values: []string{zerolog.LevelTraceValue, zerolog.LevelDebugValue, zerolog.LevelInfoValue,
+			zerolog.LevelWarnValue, zerolog.LevelErrorValue},
+		Description: "Minimum level of the plugin logs.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.Log.Level }},
+	{Name: "log_format", Group: GroupLogging, Type: TypeString, Default: DefaultLogConfig.Format,
+		Values:      []string{LogFormatConsole, LogFormatJSON},
+		Description: "Format of the plugin logs. `json` writes one JSON object per line.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.Log.Format }},
+	{Name: "log_file", Group: GroupLogging, Type: TypeString, Example: "/var/log/fluent-bit-pubsub.log",
+		Description: "File to write the plugin logs to, instead of stderr.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.Log.File }},
+	{Name: "log_file_max_size", Group: GroupLogging, Type: TypeBytes, Default: "10M", Min: "0",
+		Description: "Size at which `log_file` is rotated. 0 disables rotation.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.Log.MaxSize }},
+	{Name: "log_file_max_backups", Group: GroupLogging, Type: TypeInt, Default: strconv.Itoa(DefaultLogConfig.MaxBackups),
+		Min: "0", Description: "Number of rotated log files to keep, as `log_file.1`, `log_file.2` and so on.",
+		field: func(c *OutputPluginConfig) interface{} { return &c.Log.MaxBackups }},
+	{Name: "log_sample_burst", Group: GroupLogging, Type: TypeInt, Default: "0", Example: "10", Min: "0",
+		Description: "Maximum number of per record errors logged in each `log_sample_period`. 0 logs every error.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.Log.SampleBurst }},
+	{Name: "log_sample_period", Group: GroupLogging, Type: TypeDuration,
+		Default: DefaultLogConfig.SamplePeriod.String(), Description: "Period for `log_sample_burst`.",
+		field: func(c *OutputPluginConfig) interface{} { return &c.Log.SamplePeriod }},
+	{Name: "log_record_contents", Group: GroupLogging, Type: TypeBool, Default: "false", Example: "true",
+		Description: "If true, the contents of records that fail are logged. Records may hold sensitive data.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.Log.RecordContents }},
+	{Name: "log_record_id_field", Group: GroupLogging, Type: TypeString, Example: "request_id",
+		Description: "Record field identifying the sample record in error summaries.",
+		field:       func(c *OutputPluginConfig) interface{} { return &c.Log.RecordIDField }},
+}
+
+// LookupOption returns the named Option, or nil if there isn't one. Names are case insensitive, as in fluent-bit.
+func LookupOption(name string) *Option {
+	for _, o := range Options {
+		if strings.EqualFold(o.Name, name) {
+			return o
+		}
+	}
+	return nil
+}
+
+// A KeyLister is a ConfigStore that can list the keys it holds, allowing unknown keys to be reported.
+//
+// FLBConfigStore is not a KeyLister, as fluent-bit only supports looking up plugin configuration keys by name.
+type KeyLister interface {
+	Keys() []string
+}
+
+// codeNames formats status codes as a comma seperated list.
+func codeNames(cs []codes.Code) string {
+	names := make([]string, len(cs))
+	for i, c := range cs {
+		names[i] = c.String()
+	}
+	return strings.Join(names, ",")
+}
+
+// formatKeyValues formats a map as a comma seperated list of key=value pairs, sorted by key.
+func formatKeyValues(m map[string]string) string {
+	kvs := make([]string, 0, len(m))
+	for k, v := range m {
+		kvs = append(kvs, quoteListItem(k+"="+v))
+	}
+	sort.Strings(kvs)
+	return strings.Join(kvs, ",")
+}
+
+// parse converts a value in configuration syntax to the option type.
+func (o *Option) parse(s string) (interface{}, error) {
+	var (
+		v   interface{}
+		err error
+	)
+	switch o.Type {
+	case TypeBool:
+		v, err = strconv.ParseBool(s)
+	case TypeInt:
+		v, err = strconv.Atoi(s)
+	case TypeDuration:
+		v, err = time.ParseDuration(s)
+	case TypeBytes:
+		v, err = parseBytes(s)
+	case TypeFloat:
+		var f float64
+		if f, err = strconv.ParseFloat(s, 64); err == nil && (math.IsNaN(f) || math.IsInf(f, 0)) {
+			err = fmt.Errorf("not a finite number")
+		}
+		v = f
+	case TypeKeyValues:
+		var ss []string
+		ss, err = splitList(s)
+		v = parseKeyValues(ss)
+	case TypeStrings, TypeCodes:
+		v, err = splitList(s)
+	default:
+		v = s
+	}
+	if err != nil {
+		return nil, o.invalid(s)
+	}
+	return v, nil
+}
+
+// invalid returns the error for a value that can't be parsed.
+func (o *Option) invalid(s string) error {
+	if o.Sensitive {
+		s = "********"
+	}
+	return fmt.Errorf("%s: invalid %s %q", o.Name, o.Type, s)
+}
+
+// load reads the option from cs into c. Options that are not set are left unchanged.
+func (o *Option) load(c *OutputPluginConfig, cs ConfigStore) error {
+	if ve, ok := cs.(valueErrorer); ok {
+		if err := ve.ValueErr(o.Name); err != nil {
+			return err
+		}
+	}
+	var (
+		v  interface{}
+		ok bool
+	)
+	switch o.Type {
+	case TypeBool:
+		v, ok = cs.Bool(o.Name)
+	case TypeInt:
+		v, ok = cs.Int(o.Name)
+	case TypeDuration:
+		v, ok = cs.Duration(o.Name)
+	case TypeBytes:
+		v, ok = cs.Bytes(o.Name)
+	case TypeFloat:
+		// ConfigStores have no float accessor, so the value is parsed here.
+		var s string
+		if s, ok = cs.String(o.Name); ok {
+			var err error
+			if v, err = o.parse(s); err != nil {
+				return err
+			}
+		}
+	case TypeKeyValues:
+		v, ok = cs.Map(o.Name)
+	case TypeStrings, TypeCodes:
+		v, ok = cs.Strings(o.Name)
+	default:
+		v, ok = cs.String(o.Name)
+	}
+	if !ok {
+		// The typed accessors don't distinguish between missing and unparseable values.
+		if s, found := cs.String(o.Name); found {
+			return o.invalid(s)
+		}
+		return nil
+	}
+	return o.set(c, v)
+}
+
+// set stores a parsed value in the config field for the option.
+func (o *Option) set(c *OutputPluginConfig, v interface{}) error {
+	switch f := o.field(c).(type) {
+	case *string:
+		*f = v.(string)
+	case *bool:
+		*f = v.(bool)
+	case *int:
+		if n, ok := v.(int64); ok {
+			*f = int(n)
+		} else {
+			*f = v.(int)
+		}
+	case *int64:
+		*f = v.(int64)
+	case *float64:
+		*f = v.(float64)
+	case *time.Duration:
+		*f = v.(time.Duration)
+	case *[]string:
+		*f = v.([]string)
+	case *map[string]string:
+		*f = v.(map[string]string)
+	case *[]codes.Code:
+		var err error
+		*f = parseCodes(v.([]string), &err)
+		if err != nil {
+			return fmt.Errorf("%s: %w", o.Name, err)
+		}
+	case *pubsub.LimitExceededBehavior:
+		b, err := ParseLimitExceededBehavior(v.(string))
+		if err != nil {
+			return err
+		}
+		*f = b
+	default:
+		panic(fmt.Sprintf("option %s has unsupported field type %T", o.Name, f))
+	}
+	return nil
+}
+
+// value returns the value of the option in c, in a form suitable for logging and checking against Values.
+func (o *Option) value(c *OutputPluginConfig) interface{} {
+	switch f := o.field(c).(type) {
+	case *string:
+		return *f
+	case *bool:
+		return *f
+	case *int:
+		return *f
+	case *int64:
+		return *f
+	case *float64:
+		return *f
+	case *time.Duration:
+		return *f
+	case *[]string:
+		return *f
+	case *map[string]string:
+		return formatKeyValues(*f)
+	case *[]codes.Code:
+		return codeNames(*f)
+	case *pubsub.LimitExceededBehavior:
+		for name, b := range limitExceededBehaviors {
+			if b == *f {
+				return name
+			}
+		}
+		return strconv.Itoa(int(*f))
+	}
+	return nil
+}
+
+// isZero reports if v is the zero value of an option.
+func isZero(v interface{}) bool {
+	switch v := v.(type) {
+	case string:
+		return v == ""
+	case []string:
+		return len(v) == 0
+	case nil:
+		return true
+	}
+	return false
+}
+
+// bound parses a Min or Max value as an int64, for comparison with int and Duration values.
+func (o *Option) bound(s string) int64 {
+	v, err := o.parse(s)
+	if err != nil {
+		panic(fmt.Sprintf("option %s has an invalid bound: %v", o.Name, err))
+	}
+	switch v := v.(type) {
+	case int:
+		return int64(v)
+	case int64:
+		return v
+	case time.Duration:
+		return int64(v)
+	}
+	panic(fmt.Sprintf("option %s has bounds but is a %s", o.Name, o.Type))
+}
+
+// floatBound parses a Min or Max value of a float option.
+func (o *Option) floatBound(s string) float64 {
+	v, err := o.parse(s)
+	if err != nil {
+		panic(fmt.Sprintf("option %s has an invalid bound: %v", o.Name, err))
+	}
+	return v.(float64)
+}
+
+// validate checks the value of the option in c.
+func (o *Option) validate(c *OutputPluginConfig) error {
+	v := o.value(c)
+	if o.Required && isZero(v) {
+		return fmt.Errorf("%s is a required parameter", o.Name)
+	}
+	var n int64
+	switch v := v.(type) {
+	case string:
+		if v == "" || len(o.Values) == 0 {
+			return nil
+		}
+		for _, allowed := range o.Values {
+			if v == allowed {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s must be one of %s, not %q", o.Name, strings.Join(o.Values, ", "), v)
+	case int:
+		n = int64(v)
+	case int64:
+		n = v
+	case time.Duration:
+		n = int64(v)
+	case float64:
+		if o.Min != "" && v < o.floatBound(o.Min) {
+			return fmt.Errorf("%s can not be less than %s", o.Name, o.Min)
+		}
+		if o.Max != "" && v > o.floatBound(o.Max) {
+			return fmt.Errorf("%s can not be more than %s", o.Name, o.Max)
+		}
+		return nil
+	default:
+		return nil
+	}
+	if o.Min != "" && n < o.bound(o.Min) {
+		return fmt.Errorf("%s can not be less than %s", o.Name, o.Min)
+	}
+	if o.Max != "" && n > o.bound(o.Max) {
+		return fmt.Errorf("%s can not be more than %s", o.Name, o.Max)
+	}
+	return nil
+}
+
+// loadOptions sets the option defaults in c, then loads the options from cs.
+//
+// All the options that can't be parsed are reported, along with any unknown keys if cs is a [KeyLister]. Unknown keys
+// in the [OUTPUT] section can't be reported, as fluent-bit only looks up keys by name.
+func loadOptions(c *OutputPluginConfig, cs ConfigStore) error {
+	var errs []error
+	for _, o := range Options {
+		if o.Default == "" {
+			continue
+		}
+		v, err := o.parse(o.Default)
+		if err == nil {
+			err = o.set(c, v)
+		}
+		if err != nil {
+			panic(fmt.Sprintf("option %s has an invalid default: %v", o.Name, err))
+		}
+	}
+	for _, o := range Options {
+		if err := o.load(c, cs); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if kl, ok := cs.(KeyLister); ok {
+		for _, k := range kl.Keys() {
+			if LookupOption(k) != nil {
+				continue
+			}
+			if s := suggestOption(k); s != "" {
+				errs = append(errs, fmt.Errorf("unknown option %q, did you mean %q?", k, s))
+			} else {
+				errs = append(errs, fmt.Errorf("unknown option %q", k))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// suggestOption returns the option name closest to the unknown key name, if there is one close enough to be a typo.
+func suggestOption(name string) string {
+	name = strings.ToLower(name)
+	best, bestDist := "", len(name)/3+1
+	for _, o := range Options {
+		if d := editDistance(name, o.Name); d < bestDist {
+			best, bestDist = o.Name, d
+		}
+	}
+	return best
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// logOptions logs the effective value of every option at debug level, redacting sensitive values.
+func (c *OutputPluginConfig) logOptions(l *zerolog.Logger) {
+	if e := l.Debug(); !e.Enabled() {
+		return
+	}
+	d := zerolog.Dict()
+	for _, o := range Options {
+		v := o.value(c)
+		if o.Sensitive && !isZero(v) {
+			v = "********"
+		}
+		d = d.Interface(o.Name, v)
+	}
+	l.Debug().Dict("config", d).Msg("effective configuration")
+}
@@ -0,0 +1,171 @@
+/*
+ * Copyright 2022  David MacKinnon (blaedd@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You may
+ * not use this file except in compliance with the License. A copy of the
+ * License is located at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0.txt
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package plugin
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"google.golang.org/grpc/codes"
+)
+
+func TestBuildPluginConfig(t *testing.T) {
+	cfg, err := BuildPluginConfig(3, MapConfigStore{
+		"gcp_project_id":                  "proj",
+		"topic_id":                        "logs",
+		"publish_count_threshold":         "50",
+		"publish_byte_threshold":          "512KiB",
+		"publish_limit_exceeded_behavior": "signal_error",
+		"topic_labels":                    "team=core,env",
+		"fatal_codes":                     "Unauthenticated",
+		"logentry_severity_fields":        "lvl",
+	})
+	if err != nil {
+		t.Fatalf("BuildPluginConfig() err = %v", err)
+	}
+	if cfg.ID != 3 || cfg.PID != "proj" || cfg.TID != "logs" {
+		t.Errorf("BuildPluginConfig() ID, PID, TID = %d, %s, %s", cfg.ID, cfg.PID, cfg.TID)
+	}
+	if cfg.PS.CountThreshold != 50 || cfg.PS.ByteThreshold != 512*1024 || cfg.PS.DelayThreshold != time.Second {
+		t.Errorf("BuildPluginConfig() PublishSettings = %+v", cfg.PS)
+	}
+	if cfg.PS.FlowControlSettings.LimitExceededBehavior != pubsub.FlowControlSignalError {
+		t.Errorf("BuildPluginConfig() LimitExceededBehavior = %v", cfg.PS.FlowControlSettings.LimitExceededBehavior)
+	}
+	if cfg.TopicLabels["team"] != "core" || cfg.TopicLabels["env"] != "env" {
+		t.Errorf("BuildPluginConfig() TopicLabels = %v", cfg.TopicLabels)
+	}
+	if !cfg.Retry.Codes[codes.Unavailable] || cfg.Retry.Codes[codes.Unauthenticated] {
+		t.Errorf("BuildPluginConfig() Retry.Codes = %v", cfg.Retry.Codes)
+	}
+	if cfg.Retry.Min != 100*time.Millisecond || cfg.CrdsReload != time.Minute || cfg.Fmt != FormatJSON {
+		t.Errorf("BuildPluginConfig() defaults not applied: %+v", cfg)
+	}
+	if len(cfg.LE.SeverityFields) != 1 || cfg.LE.ResourceLabels["pod_name"] != "kubernetes.pod_name" ||
+		cfg.CE.ID != DefaultCloudEventsConfig.ID {
+		t.Errorf("BuildPluginConfig() LE, CE = %+v, %+v", cfg.LE, cfg.CE)
+	}
+	// The defaults must not be modified through the config.
+	cfg.LE.ResourceLabels["pod_name"] = "changed"
+	if DefaultLogEntryConfig.ResourceLabels["pod_name"] != "kubernetes.pod_name" {
+		t.Errorf("BuildPluginConfig() shares DefaultLogEntryConfig.ResourceLabels")
+	}
+}
+
+func TestBuildPluginConfig_errors(t *testing.T) {
+	type testData struct {
+		opts    MapConfigStore
+		wantErr []string
+	}
+	testMap := map[string]testData{
+		"badInt":         {opts: MapConfigStore{"publish_retries": "three"}, wantErr: []string{`publish_retries: invalid int "three"`}},
+		"badBytes":       {opts: MapConfigStore{"publish_byte_threshold": "5 lots"}, wantErr: []string{`publish_byte_threshold: invalid size "5 lots"`}},
+		"badDuration":    {opts: MapConfigStore{"publish_timeout": "10"}, wantErr: []string{`publish_timeout: invalid Duration "10"`}},
+		"badBool":        {opts: MapConfigStore{"lazy_init": "yes please"}, wantErr: []string{"lazy_init: invalid boolean"}},
+		"badCode":        {opts: MapConfigStore{"retry_codes": "Unavailable,Flaky"}, wantErr: []string{"retry_codes:", "Flaky"}},
+		"badBehavior":    {opts: MapConfigStore{"publish_limit_exceeded_behavior": "panic"}, wantErr: []string{"publish_limit_exceeded_behavior"}},
+		"badFloat":       {opts: MapConfigStore{"sample_rate": "half"}, wantErr: []string{`sample_rate: invalid float "half"`}},
+		"badQuote":       {opts: MapConfigStore{"attribute_fields": `host,"app`}, wantErr: []string{`attribute_fields: invalid`}},
+		"redacted":       {opts: MapConfigStore{"credentials_json": "x"}},
+		"unknown":        {opts: MapConfigStore{"frobnicate": "1"}, wantErr: []string{`unknown option "frobnicate"`}},
+		"typo":           {opts: MapConfigStore{"topic_lables": "a=b"}, wantErr: []string{`did you mean "topic_labels"?`}},
+		"caseInsensitve": {opts: MapConfigStore{"Topic_ID": "logs"}},
+		"multiple": {opts: MapConfigStore{"publish_retries": "x", "publish_timeout": "y"},
+			wantErr: []string{"publish_retries", "publish_timeout"}},
+	}
+	for k, tt := range testMap {
+		t.Run(k, func(t *testing.T) {
+			_, err := BuildPluginConfig(0, tt.opts)
+			if len(tt.wantErr) == 0 {
+				if err != nil {
+					t.Errorf("BuildPluginConfig() err = %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("BuildPluginConfig() err = nil, want %q", tt.wantErr)
+			}
+			for _, want := range tt.wantErr {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("BuildPluginConfig() err = %v, want %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestOption_invalidRedacted(t *testing.T) {
+	o := &Option{Name: "secret", Type: TypeInt, Sensitive: true}
+	if err := o.invalid("hunter2"); strings.Contains(err.Error(), "hunter2") {
+		t.Errorf("invalid() err = %v, contains the value", err)
+	}
+}
+
+func TestOptions_defaults(t *testing.T) {
+	for _, o := range Options {
+		if o.Default == "" {
+			continue
+		}
+		cfg := &OutputPluginConfig{}
+		v, err := o.parse(o.Default)
+		if err != nil {
+			t.Errorf("option %s default %q: %v", o.Name, o.Default, err)
+			continue
+		}
+		if err := o.set(cfg, v); err != nil {
+			t.Errorf("option %s default %q: %v", o.Name, o.Default, err)
+		}
+	}
+}
+
+func TestUpdateOptionsDoc(t *testing.T) {
+	doc, err := os.ReadFile("../README.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := UpdateOptionsDoc(append([]byte(nil), doc...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, doc) {
+		t.Errorf("README.md option tables are out of date, run go generate ./...")
+	}
+}
+
+func Test_suggestOption(t *testing.T) {
+	testMap := map[string]string{
+		"topic_lables":       "topic_labels",
+		"gcp_projectid":      "gcp_project_id",
+		"PUBLISH_TIMEOUTS":   "publish_timeout",
+		"something_else":     "",
+		"credentials":        "",
+		"raw_feild":          "raw_field",
+		"publish_retry_maxx": "publish_retry_max",
+	}
+	for k, want := range testMap {
+		t.Run(k, func(t *testing.T) {
+			if got := suggestOption(k); got != want {
+				t.Errorf("suggestOption(%q) = %q, want %q", k, got, want)
+			}
+		})
+	}
+}
@@ -21,8 +21,9 @@ package plugin
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
+	"net/http"
+	"sync"
 	"time"
 
 	"cloud.google.com/go/pubsub"
@@ -43,8 +44,41 @@ type OutputPlugin struct {
 	KA bool
 	// Debug flag
 	D bool
+	// Decides which publish errors are retried
+	Retry RetryPolicy
 	// FluentBit record reader
 	R *FLBRecordReader
+	// Encoder for the message payload
+	enc recordEncoder
+	// Configuration and client options, used to recreate the client.
+	config *OutputPluginConfig
+	opts   []option.ClientOption
+	// Guards client, Topic and closed. The client and topic are replaced when credentials are reloaded.
+	mu     sync.RWMutex
+	client *pubsub.Client
+	closed bool // Set by Close, after which no client is installed.
+	// Stops background tasks.
+	cancel context.CancelFunc
+	// Creates spans for flushes, nil if tracing is disabled.
+	trc *flushTracer
+	// Logger for the instance, and the sampler for per record errors.
+	log        zerolog.Logger
+	recSampler zerolog.Sampler
+	// State reported by the health endpoints, and their server if enabled.
+	health health
+	srv    *http.Server
+	// Messages that failed to publish, if spooling is enabled.
+	spool *spool
+	// Fails publishes fast while PubSub is failing, nil if disabled.
+	brk *breaker
+	// Client side rate limits, nil if unlimited.
+	limiter *rateLimiter
+	// Samples records, nil if every record is kept.
+	smp *sampler
+	// Drops duplicate records, nil if disabled.
+	dedup *deduper
+	// Sets the message ID attribute, nil if disabled.
+	msgID *messageIDer
 	// PubSub Topic
 	*pubsub.Topic
 }
@@ -54,34 +88,81 @@ type OutputPlugin struct {
 // Optionally taking some additional options for the RPC client.
 func NewPluginFromConfig(ctx context.Context, config *OutputPluginConfig, opts ...option.ClientOption) (*OutputPlugin, error) {
 	gcp := zerolog.Dict().Str("project_id", config.PID).Str("topic_id", config.TID).
-		Str("credentials", config.Crds)
+		Str("credentials", config.Crds).Str("impersonate", config.Impersonate)
 	l := log.Ctx(ctx).With().Dict("gcp", gcp).Logger()
-	client, err := config.createClient(ctx, &l, opts...)
-	if err != nil {
-		return nil, fmt.Errorf("unable to create pubsub.Client: %w", err)
-	}
-	topic, err := config.fetchTopic(ctx, &l, client)
-	if err != nil {
-		l.Error().Err(err)
-		return nil, fmt.Errorf("unable to access pubsub.Topic: %w", err)
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
 	}
+	config.logOptions(&l)
 	reader, err := NewFLBRecordReader()
 	if err != nil {
 		l.Error().Err(err)
 		return nil, fmt.Errorf("unable to create record reader: %w", err)
 	}
-	return &OutputPlugin{
+	enc, err := config.newEncoder(reader)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create %s encoder: %w", config.Fmt, err)
+	}
+	p := &OutputPlugin{
 		ID: config.ID, TSField: config.TSField, As: config.As, D: config.D, KA: config.KA, R: reader,
-		Topic: topic}, nil
+		Retry: config.Retry, enc: enc, config: config, opts: opts, log: l, recSampler: config.Log.recordSampler()}
+	p.health.started = time.Now()
+	p.brk = newBreaker(&config.Breaker, &p.log)
+	p.limiter = newRateLimiter(&config.RateLimit, config.topicName(), &p.log)
+	if p.smp, err = newSampler(&config.Sample); err != nil {
+		return nil, err
+	}
+	p.dedup = newDeduper(&config.Dedup)
+	if p.msgID, err = newMessageIDer(&config.MessageID); err != nil {
+		return nil, err
+	}
+	if p.trc, err = newFlushTracer(ctx, &config.Tracing, config.ID); err != nil {
+		return nil, err
+	}
+	bgCtx, cancel := context.WithCancel(l.WithContext(context.Background()))
+	p.cancel = cancel
+
+	if config.LazyInit {
+		l.Info().Msg("initializing PubSub client in the background")
+		go p.connect(bgCtx, &l)
+	} else if err := p.Reload(ctx, &l); err != nil {
+		p.Close()
+		return nil, err
+	}
+	if config.Spool.Dir != "" {
+		if p.spool, err = openSpool(&config.Spool, &l); err != nil {
+			p.Close()
+			return nil, err
+		}
+		go p.drainSpool(bgCtx, &l)
+	}
+	if config.Health.Listen != "" {
+		if err := p.serveHTTP(&l); err != nil {
+			p.Close()
+			return nil, err
+		}
+	}
+
+	if config.Crds != "" && config.CrdsReload > 0 {
+		go p.watchCredentials(bgCtx, &l, newFileWatcher(config.Crds), config.CrdsReload)
+		l.Info().Dur("interval", config.CrdsReload).Msg("watching credentials file for changes")
+	}
+	return p, nil
+}
+
+// Logger returns the logger of the plugin instance.
+func (p *OutputPlugin) Logger() *zerolog.Logger {
+	return &p.log
 }
 
 // CreateMessage creates a pubsub.Message from the timestamp, tag, and record from fluent-bit.
 func (p *OutputPlugin) CreateMessage(ts time.Time, tag string, record map[string]interface{}) (*pubsub.Message, error) {
+	attrs := map[string]string{"tag": tag}
+	p.msgID.set(attrs, ts, tag, record)
 	if p.TSField != "" {
 		record[p.TSField] = ts.UnixMicro()
 	}
 	attrKeys := make([]string, 0, len(p.As))
-	attrs := map[string]string{"tag": tag}
 	for _, attrKey := range p.As {
 		if attrVal, ok := record[attrKey]; ok {
 			attrs[attrKey] = fmt.Sprint(attrVal)
@@ -91,9 +172,9 @@ func (p *OutputPlugin) CreateMessage(ts time.Time, tag string, record map[string
 			}
 		}
 	}
-	j, err := json.Marshal(record)
+	data, err := p.enc.Encode(ts, tag, record, attrs)
 	if err != nil {
 		return nil, err
 	}
-	return &pubsub.Message{Attributes: attrs, Data: j}, nil
+	return &pubsub.Message{Attributes: attrs, Data: data}, nil
 }
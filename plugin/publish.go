@@ -0,0 +1,213 @@
+/*
+ * Copyright 2022  David MacKinnon (blaedd@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You may
+ * not use this file except in compliance with the License. A copy of the
+ * License is located at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0.txt
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/api/support/bundler"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultRetryCodes are the gRPC status codes treated as retryable unless retry_codes is set.
+var DefaultRetryCodes = []codes.Code{
+	codes.DeadlineExceeded,
+	codes.Internal,
+	codes.Unavailable,
+	codes.ResourceExhausted,
+	codes.Aborted,
+	codes.Unauthenticated,
+}
+
+// ParseCode parses a gRPC status code from its name, e.g. ResourceExhausted or RESOURCE_EXHAUSTED, or number.
+func ParseCode(s string) (codes.Code, error) {
+	if n, err := strconv.ParseUint(s, 10, 32); err == nil && n <= uint64(codes.Unauthenticated) {
+		return codes.Code(n), nil
+	}
+	norm := strings.ToLower(strings.ReplaceAll(s, "_", ""))
+	for c := codes.OK; c <= codes.Unauthenticated; c++ {
+		if strings.ToLower(c.String()) == norm {
+			return c, nil
+		}
+	}
+	// codes.Canceled is also commonly spelt Cancelled.
+	if norm == "cancelled" {
+		return codes.Canceled, nil
+	}
+	return 0, fmt.Errorf("unknown gRPC status code %q", s)
+}
+
+// RetryPolicy decides which publish errors are retried.
+type RetryPolicy struct {
+	Codes   map[codes.Code]bool // gRPC status codes that are retryable.
+	Retries int                 // Number of times the plugin retries failed messages before returning FLB_RETRY.
+	Min     time.Duration       // Initial delay between retries.
+	Max     time.Duration       // Maximum delay between retries.
+}
+
+// NewRetryPolicy creates a RetryPolicy retrying the retry codes, except for any fatal codes.
+func NewRetryPolicy(retry, fatal []codes.Code) RetryPolicy {
+	rp := RetryPolicy{Codes: make(map[codes.Code]bool), Min: 100 * time.Millisecond, Max: 5 * time.Second}
+	for _, c := range retry {
+		rp.Codes[c] = true
+	}
+	for _, c := range fatal {
+		delete(rp.Codes, c)
+	}
+	return rp
+}
+
+// Retryable reports if the publish error err should be retried.
+func (rp *RetryPolicy) Retryable(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrRateLimited) {
+		return true
+	}
+	// Client side buffers are full, with publish_limit_exceeded_behavior signal_error or publish_buffered_byte_limit.
+	if errors.Is(err, pubsub.ErrFlowControllerMaxOutstandingMessages) ||
+		errors.Is(err, pubsub.ErrFlowControllerMaxOutstandingBytes) || errors.Is(err, bundler.ErrOverflow) {
+		return true
+	}
+	stts, ok := status.FromError(err)
+	if !ok {
+		return false
+	}
+	return rp.Codes[stts.Code()]
+}
+
+// A PublishError is returned by [OutputPlugin.PublishMessages] when messages could not be published.
+type PublishError struct {
+	Err       error // The first error encountered.
+	Failed    int   // The number of messages that failed.
+	Retryable bool  // If the failed messages can be retried.
+	Rejected  int   // The number of failed messages with a non-retryable error.
+	// The messages that failed.
+	Msgs []*pubsub.Message
+}
+
+func (e *PublishError) Error() string {
+	return fmt.Sprintf("%d messages failed to publish: %v", e.Failed, e.Err)
+}
+
+func (e *PublishError) Unwrap() error {
+	return e.Err
+}
+
+// IsRetryable reports if err is a retryable [PublishError].
+func IsRetryable(err error) bool {
+	var perr *PublishError
+	return errors.As(err, &perr) && perr.Retryable
+}
+
+// PublishMessages publishes msgs and waits for the results.
+//
+// Messages that fail with a retryable error are published again, with backoff, up to the configured number of
+// retries. If messages still fail a [PublishError] is returned. Messages are subject to the client side rate limits,
+// see [RateLimitConfig].
+func (p *OutputPlugin) PublishMessages(ctx context.Context, msgs []*pubsub.Message) error {
+	logger := log.Ctx(ctx)
+	span := trace.SpanFromContext(ctx)
+	for _, msg := range msgs {
+		p.trc.inject(ctx, msg.Attributes)
+	}
+	// Chunks that would wait for the rate limit longer than the publish timeout are returned to fluent-bit before any
+	// of their messages are published.
+	if p.limiter != nil && !p.limiter.admit(msgs, p.config.PS.Timeout) {
+		return &PublishError{Err: ErrRateLimited, Failed: len(msgs), Retryable: true, Msgs: msgs}
+	}
+	b := newBackoff(p.Retry.Min, p.Retry.Max)
+	for attempt := 0; ; attempt++ {
+		var (
+			published []*pubsub.Message
+			results   []*pubsub.PublishResult
+			limited   []*pubsub.Message
+			limitErr  error
+			dropped   int
+		)
+		for i, msg := range msgs {
+			if err := p.limiter.take(ctx, msg); errors.Is(err, errRateDropped) {
+				dropped++
+				continue
+			} else if err != nil {
+				limited, limitErr = msgs[i:], err
+				break
+			}
+			p.health.outstanding.Add(1)
+			published = append(published, msg)
+			results = append(results, p.Publish(ctx, msg))
+		}
+		if dropped > 0 {
+			logger.Warn().Int("dropped", dropped).Msg("dropped messages over the rate limit")
+		}
+		var (
+			failed   []*pubsub.Message
+			firstErr error
+			rejected int
+		)
+		for i, res := range results {
+			_, err := res.Get(ctx)
+			p.health.outstanding.Add(-1)
+			if err == nil {
+				continue
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			if !p.Retry.Retryable(err) {
+				rejected++
+			}
+			failed = append(failed, published[i])
+		}
+		if limitErr != nil {
+			if firstErr == nil {
+				firstErr = limitErr
+			}
+			if !p.Retry.Retryable(limitErr) {
+				rejected += len(limited)
+			}
+			failed = append(failed, limited...)
+		}
+		if firstErr == nil {
+			return nil
+		}
+		perr := &PublishError{Err: firstErr, Failed: len(failed), Retryable: rejected == 0, Rejected: rejected,
+			Msgs: failed}
+		if rejected > 0 || limitErr != nil || attempt >= p.Retry.Retries {
+			return perr
+		}
+		d := b.next()
+		logger.Warn().Err(perr).Int("attempt", attempt+1).Dur("retry_in", d).Msg("retrying failed messages")
+		span.AddEvent("retry", trace.WithAttributes(attribute.Int("attempt", attempt+1),
+			attribute.Int("failed", len(failed)), attribute.String("error", perr.Error())))
+		select {
+		case <-ctx.Done():
+			return perr
+		case <-time.After(d):
+		}
+		msgs = failed
+	}
+}
@@ -0,0 +1,114 @@
+/*
+ * Copyright 2022  David MacKinnon (blaedd@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You may
+ * not use this file except in compliance with the License. A copy of the
+ * License is located at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0.txt
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package plugin
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	pubsubpb "google.golang.org/genproto/googleapis/pubsub/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestParseCode(t *testing.T) {
+	testMap := map[string]struct {
+		want codes.Code
+		ok   bool
+	}{
+		"ResourceExhausted":  {codes.ResourceExhausted, true},
+		"RESOURCE_EXHAUSTED": {codes.ResourceExhausted, true},
+		"unavailable":        {codes.Unavailable, true},
+		"Cancelled":          {codes.Canceled, true},
+		"16":                 {codes.Unauthenticated, true},
+		"17":                 {0, false},
+		"NoSuchCode":         {0, false},
+	}
+	for k, tt := range testMap {
+		t.Run(k, func(t *testing.T) {
+			got, err := ParseCode(k)
+			if (err == nil) != tt.ok || got != tt.want {
+				t.Errorf("ParseCode() = %v, %v want %v, ok %v", got, err, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestRetryPolicy_Retryable(t *testing.T) {
+	rp := NewRetryPolicy(DefaultRetryCodes, []codes.Code{codes.Unauthenticated})
+	testMap := map[string]struct {
+		err  error
+		want bool
+	}{
+		"deadline":          {context.DeadlineExceeded, true},
+		"resourceExhausted": {status.Error(codes.ResourceExhausted, "quota"), true},
+		"unauthenticated":   {status.Error(codes.Unauthenticated, "fatal override"), false},
+		"invalidArgument":   {status.Error(codes.InvalidArgument, "bad"), false},
+		"notStatus":         {pubsub.ErrOversizedMessage, false},
+	}
+	for k, tt := range testMap {
+		t.Run(k, func(t *testing.T) {
+			if got := rp.Retryable(tt.err); got != tt.want {
+				t.Errorf("Retryable() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOutputPlugin_PublishMessages(t *testing.T) {
+	type testData struct {
+		retries   int
+		errs      []error
+		wantErr   bool
+		retryable bool
+	}
+	testMap := map[string]testData{
+		"ok":              {0, []error{nil}, false, false},
+		"retryable":       {0, []error{status.Error(codes.Unauthenticated, "expired")}, true, true},
+		"fatal":           {0, []error{status.Error(codes.PermissionDenied, "denied")}, true, false},
+		"retried":         {1, []error{status.Error(codes.Unauthenticated, "expired"), nil}, false, false},
+		"fatalNotRetried": {1, []error{status.Error(codes.PermissionDenied, "denied"), nil}, true, false},
+	}
+	for k, tt := range testMap {
+		t.Run(k, func(t *testing.T) {
+			ctx := context.Background()
+			client, srv := newTestClient(t)
+			topic, err := client.CreateTopic(ctx, "logs")
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(topic.Stop)
+			srv.SetAutoPublishResponse(false)
+			for i, err := range tt.errs {
+				srv.AddPublishResponse(&pubsubpb.PublishResponse{MessageIds: []string{string(rune('a' + i))}}, err)
+			}
+			p := &OutputPlugin{Topic: topic, Retry: NewRetryPolicy(DefaultRetryCodes, nil)}
+			p.Retry.Retries = tt.retries
+			p.Retry.Min, p.Retry.Max = time.Millisecond, time.Millisecond
+			err = p.PublishMessages(ctx, []*pubsub.Message{{Data: []byte("hello")}})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("PublishMessages() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if IsRetryable(err) != tt.retryable {
+				t.Errorf("IsRetryable() = %v, want %v", IsRetryable(err), tt.retryable)
+			}
+		})
+	}
+}
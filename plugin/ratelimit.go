@@ -0,0 +1,205 @@
+/*
+ * Copyright 2022  David MacKinnon (blaedd@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You may
+ * not use this file except in compliance with the License. A copy of the
+ * License is located at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0.txt
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/rs/zerolog"
+	"golang.org/x/time/rate"
+)
+
+// Rate limit exceeded behaviors.
+const (
+	RateLimitBlock = "block"
+	RateLimitRetry = "retry"
+	RateLimitDrop  = "drop"
+)
+
+// Rate limit scopes.
+const (
+	RateLimitInstance = "instance"
+	RateLimitTopic    = "topic"
+)
+
+// RateLimitConfig holds the client side rate limits.
+type RateLimitConfig struct {
+	Messages int    // Messages per second. Zero is unlimited.
+	Bytes    int64  // Message data bytes per second. Zero is unlimited.
+	Exceeded string // What to do with messages over the limit, block, retry or drop.
+	Scope    string // Whether the limits are per instance, or shared by the instances publishing to a topic.
+}
+
+// DefaultRateLimitConfig holds the default rate limit settings.
+var DefaultRateLimitConfig = RateLimitConfig{Exceeded: RateLimitBlock, Scope: RateLimitInstance}
+
+// ErrRateLimited is returned for chunks over the rate limit, with the retry behavior. It is retryable.
+var ErrRateLimited = errors.New("rate limit exceeded")
+
+// errRateDropped is returned for messages over the rate limit, with the drop behavior.
+var errRateDropped = errors.New("rate limit exceeded, message dropped")
+
+// rateLimiter applies token bucket limits to messages. Buckets hold one second of tokens. A nil rateLimiter is
+// unlimited.
+type rateLimiter struct {
+	cfg     RateLimitConfig
+	msgs    *rate.Limiter
+	bytes   *rate.Limiter
+	dropped atomic.Int64
+}
+
+var (
+	topicLimitersMu sync.Mutex
+	// topicLimiters holds the limiters shared by instances with the topic scope, by topic name.
+	topicLimiters = make(map[string]*rateLimiter)
+)
+
+// newRateLimiter returns the limiter for an instance publishing to topic, or nil if there are no limits.
+//
+// With the topic scope, the first instance to publish to a topic sets the limits for all instances.
+func newRateLimiter(cfg *RateLimitConfig, topic string, l *zerolog.Logger) *rateLimiter {
+	if cfg.Messages <= 0 && cfg.Bytes <= 0 {
+		return nil
+	}
+	if cfg.Scope != RateLimitTopic {
+		return makeRateLimiter(cfg)
+	}
+	topicLimitersMu.Lock()
+	defer topicLimitersMu.Unlock()
+	if rl, ok := topicLimiters[topic]; ok {
+		if rl.cfg != *cfg {
+			l.Warn().Str("topic", topic).Msg("rate limits differ from another instance for the topic, using the " +
+				"limits of the first instance")
+		}
+		return rl
+	}
+	rl := makeRateLimiter(cfg)
+	topicLimiters[topic] = rl
+	return rl
+}
+
+func makeRateLimiter(cfg *RateLimitConfig) *rateLimiter {
+	rl := &rateLimiter{cfg: *cfg}
+	if cfg.Messages > 0 {
+		rl.msgs = rate.NewLimiter(rate.Limit(cfg.Messages), cfg.Messages)
+	}
+	if cfg.Bytes > 0 {
+		rl.bytes = rate.NewLimiter(rate.Limit(cfg.Bytes), int(cfg.Bytes))
+	}
+	return rl
+}
+
+// byteTokens returns the tokens taken for a message, which are capped at the burst so that messages larger than
+// a second of the limit can still be sent.
+func (rl *rateLimiter) byteTokens(msg *pubsub.Message) int {
+	n := len(msg.Data)
+	if b := rl.bytes.Burst(); n > b {
+		return b
+	}
+	return n
+}
+
+// admit reports if a chunk can be published with the retry behavior, which is when the first message of msgs can
+// be published within maxWait. No tokens are taken.
+//
+// The decision is made once for the whole chunk, before any of it is published, so that fluent-bit doesn't publish
+// the start of the chunk again when it retries it. Once admitted, take waits for the tokens of each message, so a
+// chunk larger than the burst is still published in full.
+func (rl *rateLimiter) admit(msgs []*pubsub.Message, maxWait time.Duration) bool {
+	if rl == nil || rl.cfg.Exceeded != RateLimitRetry || len(msgs) == 0 {
+		return true
+	}
+	now := time.Now()
+	var (
+		reserved []*rate.Reservation
+		delay    time.Duration
+	)
+	if rl.msgs != nil {
+		reserved = append(reserved, rl.msgs.ReserveN(now, 1))
+	}
+	if rl.bytes != nil {
+		reserved = append(reserved, rl.bytes.ReserveN(now, rl.byteTokens(msgs[0])))
+	}
+	for _, r := range reserved {
+		if d := r.DelayFrom(now); d > delay {
+			delay = d
+		}
+	}
+	for _, r := range reserved {
+		r.CancelAt(now)
+	}
+	return delay <= maxWait
+}
+
+// take takes the tokens for msg, waiting for them with the block and retry behaviors. With the drop behavior
+// errRateDropped is returned if they aren't available.
+//
+// [ErrRateLimited] is returned if ctx is done while waiting.
+func (rl *rateLimiter) take(ctx context.Context, msg *pubsub.Message) error {
+	if rl == nil {
+		return nil
+	}
+	if rl.cfg.Exceeded != RateLimitDrop {
+		if rl.msgs != nil {
+			if err := rl.msgs.Wait(ctx); err != nil {
+				return fmt.Errorf("%w: %v", ErrRateLimited, err)
+			}
+		}
+		if rl.bytes != nil {
+			if err := rl.bytes.WaitN(ctx, rl.byteTokens(msg)); err != nil {
+				return fmt.Errorf("%w: %v", ErrRateLimited, err)
+			}
+		}
+		return nil
+	}
+	now := time.Now()
+	var reserved []*rate.Reservation
+	ok := true
+	if rl.msgs != nil {
+		r := rl.msgs.ReserveN(now, 1)
+		reserved = append(reserved, r)
+		ok = r.OK() && r.DelayFrom(now) == 0
+	}
+	if ok && rl.bytes != nil {
+		r := rl.bytes.ReserveN(now, rl.byteTokens(msg))
+		reserved = append(reserved, r)
+		ok = r.OK() && r.DelayFrom(now) == 0
+	}
+	if ok {
+		return nil
+	}
+	for _, r := range reserved {
+		r.CancelAt(now)
+	}
+	rl.dropped.Add(1)
+	return errRateDropped
+}
+
+// droppedCount returns the number of messages dropped by the limiter.
+func (rl *rateLimiter) droppedCount() int64 {
+	if rl == nil {
+		return 0
+	}
+	return rl.dropped.Load()
+}
@@ -0,0 +1,191 @@
+/*
+ * Copyright 2022  David MacKinnon (blaedd@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You may
+ * not use this file except in compliance with the License. A copy of the
+ * License is located at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0.txt
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package plugin
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/rs/zerolog"
+)
+
+func TestRateLimiter_take(t *testing.T) {
+	type testData struct {
+		cfg      RateLimitConfig
+		wantErrs []error // For each of 4 messages of 11 bytes.
+	}
+	testMap := map[string]testData{
+		"unlimited": {cfg: RateLimitConfig{Exceeded: RateLimitDrop}, wantErrs: []error{nil, nil, nil, nil}},
+		"messages": {cfg: RateLimitConfig{Messages: 3, Exceeded: RateLimitDrop},
+			wantErrs: []error{nil, nil, nil, errRateDropped}},
+		"bytes": {cfg: RateLimitConfig{Bytes: 25, Exceeded: RateLimitDrop},
+			wantErrs: []error{nil, nil, errRateDropped, errRateDropped}},
+		// Messages larger than the burst take the whole bucket, rather than never being allowed.
+		"bytesLarge": {cfg: RateLimitConfig{Bytes: 5, Exceeded: RateLimitDrop},
+			wantErrs: []error{nil, errRateDropped, errRateDropped, errRateDropped}},
+		// The message tokens aren't used up by messages rejected for their size.
+		"both": {cfg: RateLimitConfig{Messages: 3, Bytes: 11, Exceeded: RateLimitDrop},
+			wantErrs: []error{nil, errRateDropped, errRateDropped, errRateDropped}},
+	}
+	for k, tt := range testMap {
+		t.Run(k, func(t *testing.T) {
+			l := zerolog.Nop()
+			rl := newRateLimiter(&tt.cfg, "projects/p/topics/"+k, &l)
+			for i, msg := range testMessages(0, len(tt.wantErrs)) {
+				if err := rl.take(context.Background(), msg); !errors.Is(err, tt.wantErrs[i]) ||
+					(err != nil) != (tt.wantErrs[i] != nil) {
+					t.Errorf("take() message %d err = %v, want %v", i, err, tt.wantErrs[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimiter_admit(t *testing.T) {
+	l := zerolog.Nop()
+	rl := newRateLimiter(&RateLimitConfig{Messages: 2, Exceeded: RateLimitRetry}, "projects/p/topics/admit", &l)
+	msgs := testMessages(0, 5)
+	// A chunk larger than the burst is admitted while the bucket has tokens, without taking them.
+	for i := 0; i < 3; i++ {
+		if !rl.admit(msgs, 0) {
+			t.Fatalf("admit() call %d with a full bucket = false", i)
+		}
+	}
+	for _, msg := range msgs[:2] {
+		if err := rl.take(context.Background(), msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if rl.admit(msgs, 0) {
+		t.Error("admit() with an empty bucket and no wait = true")
+	}
+	if !rl.admit(msgs, time.Second) {
+		t.Error("admit() with an empty bucket and a second to wait = false")
+	}
+	block := newRateLimiter(&RateLimitConfig{Messages: 1, Exceeded: RateLimitBlock}, "projects/p/topics/admit", &l)
+	_ = block.take(context.Background(), msgs[0])
+	if !block.admit(msgs, 0) {
+		t.Error("admit() with the block behavior = false")
+	}
+}
+
+func TestRateLimiter_block(t *testing.T) {
+	l := zerolog.Nop()
+	rl := newRateLimiter(&RateLimitConfig{Messages: 1, Exceeded: RateLimitBlock}, "projects/p/topics/block", &l)
+	msg := testMessages(0, 1)[0]
+	if err := rl.take(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := rl.take(ctx, msg); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("take() with the bucket empty err = %v, want %v", err, ErrRateLimited)
+	}
+}
+
+func TestRateLimiter_scope(t *testing.T) {
+	l := zerolog.Nop()
+	topic := RateLimitConfig{Messages: 5, Exceeded: RateLimitDrop, Scope: RateLimitTopic}
+	a := newRateLimiter(&topic, "projects/p/topics/shared", &l)
+	if b := newRateLimiter(&topic, "projects/p/topics/shared", &l); a != b {
+		t.Error("newRateLimiter() with the topic scope isn't shared by a topic")
+	}
+	if b := newRateLimiter(&topic, "projects/p/topics/other", &l); a == b {
+		t.Error("newRateLimiter() with the topic scope is shared by different topics")
+	}
+	instance := topic
+	instance.Scope = RateLimitInstance
+	if b := newRateLimiter(&instance, "projects/p/topics/shared", &l); a == b {
+		t.Error("newRateLimiter() with the instance scope is shared")
+	}
+	if newRateLimiter(&DefaultRateLimitConfig, "projects/p/topics/shared", &l) != nil {
+		t.Error("newRateLimiter() with no limits isn't nil")
+	}
+}
+
+func TestOutputPlugin_PublishMessagesRateLimited(t *testing.T) {
+	type testData struct {
+		exceeded      string
+		timeout       time.Duration
+		wantErr       error
+		wantPublished int
+		wantDropped   int64
+	}
+	// Each case publishes two chunks of 5 messages, with a limit of 3 messages per second.
+	testMap := map[string]testData{
+		// The first chunk is larger than the burst, and is published in full rather than retried forever. The
+		// second is returned whole, as it would wait longer than the timeout.
+		"retry": {exceeded: RateLimitRetry, timeout: 100 * time.Millisecond, wantErr: ErrRateLimited,
+			wantPublished: 5},
+		"retryWait": {exceeded: RateLimitRetry, timeout: time.Minute, wantPublished: 10},
+		"drop":      {exceeded: RateLimitDrop, wantPublished: 3, wantDropped: 7},
+	}
+	for k, tt := range testMap {
+		t.Run(k, func(t *testing.T) {
+			ctx := context.Background()
+			client, srv := newTestClient(t)
+			topic, err := client.CreateTopic(ctx, "logs")
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(topic.Stop)
+			l := zerolog.Nop()
+			cfg := &OutputPluginConfig{PS: pubsub.PublishSettings{Timeout: tt.timeout}}
+			p := &OutputPlugin{Topic: topic, Retry: NewRetryPolicy(DefaultRetryCodes, nil), config: cfg,
+				limiter: newRateLimiter(&RateLimitConfig{Messages: 3, Exceeded: tt.exceeded}, "", &l)}
+			p.Retry.Retries = 3
+
+			if err := p.PublishMessages(ctx, testMessages(0, 5)); err != nil {
+				t.Fatalf("PublishMessages() of the first chunk err = %v", err)
+			}
+			err = p.PublishMessages(ctx, testMessages(5, 5))
+			if !errors.Is(err, tt.wantErr) || (err != nil) != (tt.wantErr != nil) {
+				t.Fatalf("PublishMessages() err = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				var perr *PublishError
+				if !errors.As(err, &perr) || !perr.Retryable || len(perr.Msgs) != 5 {
+					t.Errorf("PublishMessages() err = %#v, want the 5 messages of the chunk to retry", err)
+				}
+			}
+			if n := len(srv.Messages()); n != tt.wantPublished {
+				t.Errorf("published %d messages, want %d", n, tt.wantPublished)
+			}
+			if n := p.limiter.droppedCount(); n != tt.wantDropped {
+				t.Errorf("droppedCount() = %d, want %d", n, tt.wantDropped)
+			}
+		})
+	}
+}
+
+func TestOutputPlugin_publishedRateLimited(t *testing.T) {
+	l := zerolog.Nop()
+	p := &OutputPlugin{brk: newBreaker(&BreakerConfig{Failures: 1, Cooldown: time.Minute}, &l)}
+	for i := 0; i < 3; i++ {
+		if !p.brk.allow() {
+			t.Fatal("allow() = false after rate limited chunks")
+		}
+		p.published(&PublishError{Err: ErrRateLimited, Retryable: true})
+	}
+	if n := p.health.failures.Load(); n != 0 {
+		t.Errorf("health failures = %d after rate limited chunks, want 0", n)
+	}
+}
@@ -0,0 +1,179 @@
+/*
+ * Copyright 2022  David MacKinnon (blaedd@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You may
+ * not use this file except in compliance with the License. A copy of the
+ * License is located at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0.txt
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package plugin
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Policies for records missing the raw field.
+const (
+	RawMissingJSON  = "json"
+	RawMissingDrop  = "drop"
+	RawMissingError = "error"
+)
+
+// Encodings of the raw field value.
+const (
+	RawEncodingNone   = "none"
+	RawEncodingBase64 = "base64"
+	RawEncodingHex    = "hex"
+)
+
+// PubSub message attribute limits. Records that would exceed them with raw_attributes fail to encode, rather than
+// failing the publish of the whole chunk.
+const (
+	maxAttributes          = 100
+	maxAttributeKeyBytes   = 256
+	maxAttributeValueBytes = 1024
+)
+
+// ErrRecordDropped is returned when a record is intentionally not published.
+var ErrRecordDropped = errors.New("record dropped")
+
+// RawConfig holds the settings used to publish a single record field as the message data.
+type RawConfig struct {
+	Field    string // Field published as the message data.
+	Attrs    bool   // If the remaining record fields should become message attributes.
+	Missing  string // Policy for records without Field: json, drop or error.
+	Encoding string // Encoding of the field value, decoded before publishing: none, base64 or hex.
+}
+
+// DefaultRawConfig is the RawConfig used unless overridden by the plugin configuration.
+var DefaultRawConfig = RawConfig{
+	Field:    "log",
+	Missing:  RawMissingJSON,
+	Encoding: RawEncodingNone,
+}
+
+// Validate checks the RawConfig settings.
+func (c *RawConfig) Validate() error {
+	if c.Field == "" {
+		return fmt.Errorf("raw_field can not be empty")
+	}
+	switch c.Missing {
+	case RawMissingJSON, RawMissingDrop, RawMissingError:
+	default:
+		return fmt.Errorf("raw_missing must be one of %s, %s or %s, not %q", RawMissingJSON, RawMissingDrop,
+			RawMissingError, c.Missing)
+	}
+	switch c.Encoding {
+	case RawEncodingNone, RawEncodingBase64, RawEncodingHex:
+	default:
+		return fmt.Errorf("raw_encoding must be one of %s, %s or %s, not %q", RawEncodingNone, RawEncodingBase64,
+			RawEncodingHex, c.Encoding)
+	}
+	return nil
+}
+
+// rawEncoder publishes a single record field as the message data.
+type rawEncoder struct {
+	cfg RawConfig
+}
+
+func newRawEncoder(c *RawConfig) (*rawEncoder, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return &rawEncoder{cfg: *c}, nil
+}
+
+func (e *rawEncoder) Encode(_ time.Time, _ string, record map[string]interface{}, attrs map[string]string) ([]byte, error) {
+	v, ok := record[e.cfg.Field]
+	if !ok {
+		switch e.cfg.Missing {
+		case RawMissingDrop:
+			return nil, ErrRecordDropped
+		case RawMissingError:
+			return nil, fmt.Errorf("record has no %s field", e.cfg.Field)
+		default:
+			return json.Marshal(record)
+		}
+	}
+
+	data, err := e.decode(v)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode %s field: %w", e.cfg.Field, err)
+	}
+	if e.cfg.Attrs {
+		for k, fv := range record {
+			if k == e.cfg.Field {
+				continue
+			}
+			if _, exists := attrs[k]; exists {
+				continue
+			}
+			s, err := attrString(fv)
+			if err != nil {
+				return nil, err
+			}
+			if len(k) > maxAttributeKeyBytes {
+				return nil, fmt.Errorf("field name of %d bytes is longer than the %d byte attribute key limit", len(k),
+					maxAttributeKeyBytes)
+			}
+			if len(s) > maxAttributeValueBytes {
+				return nil, fmt.Errorf("field %s is %d bytes, more than the %d byte attribute value limit", k, len(s),
+					maxAttributeValueBytes)
+			}
+			attrs[k] = s
+		}
+		if len(attrs) > maxAttributes {
+			return nil, fmt.Errorf("record has %d attributes, more than the limit of %d", len(attrs), maxAttributes)
+		}
+	}
+	return data, nil
+}
+
+// decode converts the raw field value to the message data.
+//
+// String values, which includes binary values from fluent-bit, are used as is unless an encoding is configured.
+func (e *rawEncoder) decode(v interface{}) ([]byte, error) {
+	var s string
+	switch t := v.(type) {
+	case string:
+		s = t
+	case map[string]interface{}, []interface{}:
+		return json.Marshal(t)
+	default:
+		s = fmt.Sprint(t)
+	}
+	switch e.cfg.Encoding {
+	case RawEncodingBase64:
+		return base64.StdEncoding.DecodeString(s)
+	case RawEncodingHex:
+		return hex.DecodeString(s)
+	}
+	return []byte(s), nil
+}
+
+// attrString converts a record field to a message attribute value. Nested values are encoded as JSON.
+func attrString(v interface{}) (string, error) {
+	switch t := v.(type) {
+	case string:
+		return t, nil
+	case map[string]interface{}, []interface{}:
+		b, err := json.Marshal(t)
+		return string(b), err
+	}
+	return fmt.Sprint(v), nil
+}
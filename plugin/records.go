@@ -25,6 +25,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"reflect"
+	"strings"
 	"time"
 	"unsafe"
 
@@ -33,8 +34,11 @@ import (
 
 // An FLBRecordReader decodes a MsgPack record from fluent-bit
 type FLBRecordReader struct {
-	handle *codec.MsgpackHandle
-	mpdec  *codec.Decoder
+	handle  *codec.MsgpackHandle
+	mpdec   *codec.Decoder
+	rawdec  *codec.Decoder
+	keepRaw bool
+	raw     codec.Raw
 }
 type FLBTime struct {
 	time.Time
@@ -60,7 +64,8 @@ func NewFLBRecordReader() (*FLBRecordReader, error) {
 		return nil, err
 	}
 	mpdec := codec.NewDecoderBytes([]byte{}, mh)
-	return &FLBRecordReader{handle: mh, mpdec: mpdec}, nil
+	rawdec := codec.NewDecoderBytes([]byte{}, mh)
+	return &FLBRecordReader{handle: mh, mpdec: mpdec, rawdec: rawdec}, nil
 }
 
 // ResetReader resets the MsgPack decoder contained in the FLBRecordReader, readying it to decode another record.
@@ -69,6 +74,17 @@ func (r *FLBRecordReader) ResetReader(data unsafe.Pointer, length int) {
 	r.mpdec.ResetBytes(b)
 }
 
+// KeepRaw configures the reader to retain the undecoded MsgPack bytes of each record, see [FLBRecordReader.RawRecord].
+func (r *FLBRecordReader) KeepRaw(keep bool) {
+	r.keepRaw = keep
+	r.raw = nil
+}
+
+// RawRecord returns the MsgPack encoded record map last read by ReadRecord, if KeepRaw is enabled.
+func (r *FLBRecordReader) RawRecord() []byte {
+	return r.raw
+}
+
 // taken from https://github.com/tanakarian/fluent-bit-google-pubsub-out/blob/4a6024923388bd1f0913f99058293775d98ff966/converter.go
 func makeJSONMap(record map[interface{}]interface{}) map[string]interface{} {
 	jsonMap := make(map[string]interface{})
@@ -88,11 +104,41 @@ func makeJSONMap(record map[interface{}]interface{}) map[string]interface{} {
 	return jsonMap
 }
 
+// lookupField finds a field in a record.
+//
+// Nested fields can be referred to with a dotted path, e.g. kubernetes.pod_name. Keys containing dots are matched
+// before being treated as a path, so fields such as logging.googleapis.com/trace are found as expected.
+func lookupField(record map[string]interface{}, path string) (interface{}, bool) {
+	if v, ok := record[path]; ok {
+		return v, true
+	}
+	for i := strings.IndexByte(path, '.'); i > 0; i = nextDot(path, i) {
+		if nested, ok := record[path[:i]].(map[string]interface{}); ok {
+			if v, ok := lookupField(nested, path[i+1:]); ok {
+				return v, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// nextDot returns the index of the next '.' in path after i, or -1.
+func nextDot(path string, i int) int {
+	j := strings.IndexByte(path[i+1:], '.')
+	if j < 0 {
+		return -1
+	}
+	return i + 1 + j
+}
+
 // ReadRecord reads the next record from bytes provided by fluent-bit.
 //
 // These records are encoded as [ts, record] slices. ReadRecord converts these to time.Time and map[string]interface{}
 // for ready encoding as JSON and/or PubSub attributes.
 func (r *FLBRecordReader) ReadRecord() (time.Time, map[string]interface{}, error) {
+	if r.keepRaw {
+		return r.readRawRecord()
+	}
 	var m interface{}
 
 	err := r.mpdec.Decode(&m)
@@ -108,3 +154,31 @@ func (r *FLBRecordReader) ReadRecord() (time.Time, map[string]interface{}, error
 
 	return ts.Time, mapData, nil
 }
+
+// readRawRecord reads the next record, keeping the encoded record map for RawRecord.
+func (r *FLBRecordReader) readRawRecord() (time.Time, map[string]interface{}, error) {
+	var entry []codec.Raw
+
+	r.raw = nil
+	err := r.mpdec.Decode(&entry)
+	if err != nil {
+		return time.Time{}, nil, err
+	}
+	if len(entry) != 2 {
+		return time.Time{}, nil, errors.New("unexpected or malformed data")
+	}
+	var (
+		ts FLBTime
+		m  map[interface{}]interface{}
+	)
+	r.rawdec.ResetBytes(entry[0])
+	if err := r.rawdec.Decode(&ts); err != nil {
+		return time.Time{}, nil, err
+	}
+	r.rawdec.ResetBytes(entry[1])
+	if err := r.rawdec.Decode(&m); err != nil {
+		return time.Time{}, nil, err
+	}
+	r.raw = entry[1]
+	return ts.Time, makeJSONMap(m), nil
+}
@@ -0,0 +1,198 @@
+/*
+ * Copyright 2022  David MacKinnon (blaedd@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You may
+ * not use this file except in compliance with the License. A copy of the
+ * License is located at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0.txt
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/rs/zerolog"
+)
+
+// Publish publishes msg on the current topic.
+//
+// The topic may be replaced when credentials are reloaded, so messages must be published through the OutputPlugin
+// rather than the embedded [pubsub.Topic].
+func (p *OutputPlugin) Publish(ctx context.Context, msg *pubsub.Message) *pubsub.PublishResult {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.Topic.Publish(ctx, msg)
+}
+
+// errPluginClosed is returned by Reload once the plugin is closed.
+var errPluginClosed = errors.New("plugin closed")
+
+// swapTopic replaces the client and topic used to publish messages.
+//
+// Messages already published on the previous topic are sent before its client is closed. Once the plugin is closed,
+// the new client is closed instead of being installed, and errPluginClosed is returned.
+func (p *OutputPlugin) swapTopic(l *zerolog.Logger, client *pubsub.Client, topic *pubsub.Topic) error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		closeTopic(l, client, topic)
+		return errPluginClosed
+	}
+	oldClient, oldTopic := p.client, p.Topic
+	p.client, p.Topic = client, topic
+	p.mu.Unlock()
+
+	if oldTopic != nil {
+		l.Info().Msg("draining outstanding messages on previous topic")
+	}
+	closeTopic(l, oldClient, oldTopic)
+	return nil
+}
+
+// closeTopic sends the outstanding messages of topic, then closes client. Either may be nil.
+func closeTopic(l *zerolog.Logger, client *pubsub.Client, topic *pubsub.Topic) {
+	if topic != nil {
+		topic.Stop()
+	}
+	if client != nil {
+		if err := client.Close(); err != nil {
+			l.Warn().Err(err).Msg("error closing previous PubSub.Client")
+		}
+	}
+}
+
+// Ready reports if the client and topic have been initialized.
+func (p *OutputPlugin) Ready() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.Topic != nil
+}
+
+// connect initializes the client and topic, retrying with backoff until it succeeds or ctx is cancelled.
+func (p *OutputPlugin) connect(ctx context.Context, l *zerolog.Logger) {
+	b := newBackoff(p.config.InitRetryMin, p.config.InitRetryMax)
+	for {
+		err := p.Reload(ctx, l)
+		if err == nil {
+			l.Info().Msg("PubSub client initialized")
+			return
+		}
+		if errors.Is(err, errPluginClosed) {
+			return
+		}
+		d := b.next()
+		l.Warn().Err(err).Dur("retry_in", d).Msg("unable to initialize PubSub client, will retry")
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(d):
+		}
+	}
+}
+
+// Reload creates a new client and topic from the plugin configuration, and replaces the current ones with them.
+//
+// The current client and topic are kept if the new ones can't be created.
+func (p *OutputPlugin) Reload(ctx context.Context, l *zerolog.Logger) error {
+	client, err := p.config.createClient(ctx, l, p.opts...)
+	if err != nil {
+		return fmt.Errorf("unable to create pubsub.Client: %w", err)
+	}
+	topic, err := p.config.fetchTopic(ctx, l, client)
+	if err != nil {
+		_ = client.Close()
+		return fmt.Errorf("unable to access pubsub.Topic: %w", err)
+	}
+	return p.swapTopic(l, client, topic)
+}
+
+// Close stops any background tasks and the HTTP server, and sends outstanding messages and spans before closing the
+// client.
+func (p *OutputPlugin) Close() {
+	if p.cancel != nil {
+		p.cancel()
+	}
+	p.stopHTTP()
+	p.mu.Lock()
+	p.closed = true
+	client, topic := p.client, p.Topic
+	p.client, p.Topic = nil, nil
+	p.mu.Unlock()
+	l := zerolog.Nop()
+	closeTopic(&l, client, topic)
+	if p.spool != nil {
+		_ = p.spool.Close()
+	}
+	_ = p.trc.shutdown()
+}
+
+// fileWatcher detects changes to the contents of a file.
+type fileWatcher struct {
+	path string
+	sum  []byte
+}
+
+// newFileWatcher creates a fileWatcher for path. If the file can't be read yet, the first successful read is
+// reported as a change.
+func newFileWatcher(path string) *fileWatcher {
+	w := &fileWatcher{path: path}
+	_, _ = w.changed()
+	return w
+}
+
+// changed reports if the file contents have changed since the last call.
+func (w *fileWatcher) changed() (bool, error) {
+	b, err := os.ReadFile(w.path)
+	if err != nil {
+		return false, err
+	}
+	sum := sha256.Sum256(b)
+	if bytes.Equal(sum[:], w.sum) {
+		return false, nil
+	}
+	w.sum = sum[:]
+	return true, nil
+}
+
+// watchCredentials polls the credentials file, and reloads the client and topic when its contents change.
+func (p *OutputPlugin) watchCredentials(ctx context.Context, l *zerolog.Logger, w *fileWatcher, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		changed, err := w.changed()
+		if err != nil {
+			l.Warn().Err(err).Msg("unable to read credentials file")
+			continue
+		}
+		if !changed {
+			continue
+		}
+		l.Info().Msg("credentials file changed, reloading client")
+		if err := p.Reload(ctx, l); err != nil {
+			l.Error().Err(err).Msg("unable to reload client, continuing with previous credentials")
+			continue
+		}
+		l.Info().Msg("client reloaded")
+	}
+}
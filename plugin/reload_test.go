@@ -0,0 +1,110 @@
+/*
+ * Copyright 2022  David MacKinnon (blaedd@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You may
+ * not use this file except in compliance with the License. A copy of the
+ * License is located at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0.txt
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package plugin
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/rs/zerolog"
+)
+
+func TestFileWatcher(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "creds.json")
+	if err := os.WriteFile(path, []byte(`{"type":"service_account"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	w := newFileWatcher(path)
+	if changed, err := w.changed(); changed || err != nil {
+		t.Errorf("changed() = %v, %v for an unchanged file", changed, err)
+	}
+	// Rewriting the same contents isn't a change.
+	if err := os.WriteFile(path, []byte(`{"type":"service_account"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := w.changed(); changed || err != nil {
+		t.Errorf("changed() = %v, %v for a rewritten file", changed, err)
+	}
+	if err := os.WriteFile(path, []byte(`{"type":"external_account"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := w.changed(); !changed || err != nil {
+		t.Errorf("changed() = %v, %v for a modified file", changed, err)
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.changed(); err == nil {
+		t.Errorf("changed() no error for a missing file")
+	}
+}
+
+func TestFileWatcher_missingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "creds.json")
+	w := newFileWatcher(path)
+	if _, err := w.changed(); err == nil {
+		t.Errorf("changed() no error for a missing file")
+	}
+	if err := os.WriteFile(path, []byte(`{"type":"service_account"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := w.changed(); !changed || err != nil {
+		t.Errorf("changed() = %v, %v for a created file", changed, err)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	b := newBackoff(time.Second, 5*time.Second)
+	for i, max := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		d := b.next()
+		if d > max || d < max*4/5 {
+			t.Errorf("next() %d = %v, want between %v and %v", i, d, max*4/5, max)
+		}
+	}
+	b.reset()
+	if d := b.next(); d > time.Second {
+		t.Errorf("next() after reset = %v", d)
+	}
+}
+
+func TestOutputPlugin_swapTopicAfterClose(t *testing.T) {
+	ctx := context.Background()
+	client, _ := newTestClient(t)
+	topic, err := client.CreateTopic(ctx, "logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := zerolog.Nop()
+	p := &OutputPlugin{}
+	p.Close()
+	// A background connect finishing after Close mustn't install its client.
+	if err := p.swapTopic(&l, client, topic); !errors.Is(err, errPluginClosed) {
+		t.Errorf("swapTopic() after Close err = %v, want %v", err, errPluginClosed)
+	}
+	if p.Ready() {
+		t.Error("Ready() after Close = true")
+	}
+	if _, err := topic.Publish(ctx, &pubsub.Message{Data: []byte("late")}).Get(ctx); err == nil {
+		t.Error("Publish() on the topic swapped in after Close err = nil, want the topic stopped")
+	}
+}
@@ -0,0 +1,166 @@
+/*
+ * Copyright 2022  David MacKinnon (blaedd@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You may
+ * not use this file except in compliance with the License. A copy of the
+ * License is located at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0.txt
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package plugin
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"strconv"
+	"sync/atomic"
+)
+
+// SampleConfig holds the record sampling settings.
+type SampleConfig struct {
+	Rate      float64           // Fraction of records kept, from 0 to 1.
+	Field     string            // Record field that selects a rate from Rates.
+	Rates     map[string]string // Fraction of records kept, by the value of Field.
+	KeyField  string            // Record field hashed to sample deterministically, rather than at random.
+	Attribute string            // Attribute set to the rate records were sampled at. Not set if empty.
+}
+
+// DefaultSampleConfig holds the default sampling settings, which keep every record.
+var DefaultSampleConfig = SampleConfig{Rate: 1}
+
+// parseRate parses a sample rate.
+func parseRate(s string) (float64, error) {
+	r, err := strconv.ParseFloat(s, 64)
+	if err != nil || r < 0 || r > 1 {
+		return 0, fmt.Errorf("invalid sample rate %q, must be from 0 to 1", s)
+	}
+	return r, nil
+}
+
+// parse returns the default rate and the rates by field value.
+func (c *SampleConfig) parse() (float64, map[string]float64, error) {
+	if c.Rate < 0 || c.Rate > 1 {
+		return 0, nil, fmt.Errorf("sample_rate must be from 0 to 1, not %v", c.Rate)
+	}
+	if len(c.Rates) > 0 && c.Field == "" {
+		return 0, nil, fmt.Errorf("sample_rates requires sample_field")
+	}
+	rates := make(map[string]float64, len(c.Rates))
+	for v, s := range c.Rates {
+		var err error
+		if rates[v], err = parseRate(s); err != nil {
+			return 0, nil, fmt.Errorf("sample_rates %s: %w", v, err)
+		}
+	}
+	return c.Rate, rates, nil
+}
+
+// Validate validates the sampling settings.
+func (c *SampleConfig) Validate() error {
+	_, _, err := c.parse()
+	return err
+}
+
+// sampler decides which records are published. A nil sampler keeps every record.
+type sampler struct {
+	cfg     SampleConfig
+	rate    float64
+	rates   map[string]float64
+	kept    atomic.Int64
+	dropped atomic.Int64
+	random  func() float64
+}
+
+// newSampler creates a sampler, or returns nil if every record is kept without a sample rate attribute.
+func newSampler(cfg *SampleConfig) (*sampler, error) {
+	rate, rates, err := cfg.parse()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Attribute == "" && rate == 1 {
+		all := true
+		for _, r := range rates {
+			all = all && r == 1
+		}
+		if all {
+			return nil, nil
+		}
+	}
+	return &sampler{cfg: *cfg, rate: rate, rates: rates, random: rand.Float64}, nil
+}
+
+// sample reports if a record is kept, and the rate it was sampled at.
+//
+// Records with the key field are kept if the hash of its value falls under the rate, so records sharing a key are
+// all kept or all dropped, and a key kept at one rate is also kept at any higher rate.
+func (s *sampler) sample(record map[string]interface{}) (bool, float64) {
+	if s == nil {
+		return true, 1
+	}
+	rate := s.rate
+	if s.cfg.Field != "" {
+		if v, ok := lookupField(record, s.cfg.Field); ok {
+			if r, ok := s.rates[fmt.Sprint(v)]; ok {
+				rate = r
+			}
+		}
+	}
+	var keep bool
+	switch rate {
+	case 0:
+	case 1:
+		keep = true
+	default:
+		var x float64
+		if v, ok := s.key(record); ok {
+			h := fnv.New64a()
+			_, _ = fmt.Fprint(h, v)
+			// The top 53 bits of the hash, as a fraction from 0 to 1.
+			x = float64(mix64(h.Sum64())>>11) / (1 << 53)
+		} else {
+			x = s.random()
+		}
+		keep = x < rate
+	}
+	if keep {
+		s.kept.Add(1)
+	} else {
+		s.dropped.Add(1)
+	}
+	return keep, rate
+}
+
+// mix64 is the MurmurHash3 finalizer. FNV alone leaves the high bits of similar keys, e.g. sequential IDs, too
+// close together to sample evenly.
+func mix64(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// key returns the value of the key field in record.
+func (s *sampler) key(record map[string]interface{}) (interface{}, bool) {
+	if s.cfg.KeyField == "" {
+		return nil, false
+	}
+	return lookupField(record, s.cfg.KeyField)
+}
+
+// annotate sets the sample rate attribute, if configured.
+func (s *sampler) annotate(attrs map[string]string, rate float64) {
+	if s != nil && s.cfg.Attribute != "" {
+		attrs[s.cfg.Attribute] = strconv.FormatFloat(rate, 'g', -1, 64)
+	}
+}
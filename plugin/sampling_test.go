@@ -0,0 +1,116 @@
+/*
+ * Copyright 2022  David MacKinnon (blaedd@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You may
+ * not use this file except in compliance with the License. A copy of the
+ * License is located at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0.txt
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package plugin
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestSampler_sample(t *testing.T) {
+	type testData struct {
+		cfg      SampleConfig
+		record   map[string]interface{}
+		random   float64
+		wantKeep bool
+		wantRate float64
+	}
+	levels := SampleConfig{Rate: 1, Field: "level", Rates: map[string]string{"debug": "0.25", "trace": "0"}}
+	testMap := map[string]testData{
+		"keepAll":       {cfg: SampleConfig{Rate: 1, Attribute: "rate"}, random: 0.99, wantKeep: true, wantRate: 1},
+		"dropAll":       {cfg: SampleConfig{Rate: 0}, random: 0, wantKeep: false, wantRate: 0},
+		"randomKept":    {cfg: SampleConfig{Rate: 0.5}, random: 0.49, wantKeep: true, wantRate: 0.5},
+		"randomDropped": {cfg: SampleConfig{Rate: 0.5}, random: 0.5, wantKeep: false, wantRate: 0.5},
+		"ruleMatched": {cfg: levels, record: map[string]interface{}{"level": "debug"}, random: 0.3,
+			wantKeep: false, wantRate: 0.25},
+		"ruleZero": {cfg: levels, record: map[string]interface{}{"level": "trace"}, random: 0,
+			wantKeep: false, wantRate: 0},
+		"ruleUnmatched": {cfg: levels, record: map[string]interface{}{"level": "info"}, random: 0.99,
+			wantKeep: true, wantRate: 1},
+		"nestedField": {cfg: SampleConfig{Rate: 1, Field: "log.level", Rates: map[string]string{"debug": "0.25"}},
+			record: map[string]interface{}{"log": map[string]interface{}{"level": "debug"}}, random: 0.2,
+			wantKeep: true, wantRate: 0.25},
+		// Records without the key field are sampled at random.
+		"keyMissing": {cfg: SampleConfig{Rate: 0.5, KeyField: "request_id"}, random: 0.1, wantKeep: true,
+			wantRate: 0.5},
+	}
+	for k, tt := range testMap {
+		t.Run(k, func(t *testing.T) {
+			s, err := newSampler(&tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.random = func() float64 { return tt.random }
+			keep, rate := s.sample(tt.record)
+			if keep != tt.wantKeep || rate != tt.wantRate {
+				t.Errorf("sample() = %v, %v, want %v, %v", keep, rate, tt.wantKeep, tt.wantRate)
+			}
+		})
+	}
+}
+
+func TestSampler_deterministic(t *testing.T) {
+	s, err := newSampler(&SampleConfig{Rate: 0.3, Field: "level", Rates: map[string]string{"info": "0.6"},
+		KeyField: "request_id"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.random = func() float64 { panic("random sampling with a key field") }
+	kept := 0
+	const n = 10000
+	for i := 0; i < n; i++ {
+		id := fmt.Sprintf("req-%d", i)
+		debug, _ := s.sample(map[string]interface{}{"request_id": id, "level": "debug"})
+		again, _ := s.sample(map[string]interface{}{"request_id": id, "level": "debug"})
+		info, _ := s.sample(map[string]interface{}{"request_id": id, "level": "info"})
+		if debug != again {
+			t.Fatalf("sample() of %s = %v, then %v", id, debug, again)
+		}
+		if debug && !info {
+			t.Fatalf("sample() of %s kept at 0.3 but dropped at 0.6", id)
+		}
+		if debug {
+			kept++
+		}
+	}
+	if r := float64(kept) / n; math.Abs(r-0.3) > 0.03 {
+		t.Errorf("sample() kept %.3f of records, want about 0.3", r)
+	}
+	if got, want := s.kept.Load()+s.dropped.Load(), int64(3*n); got != want {
+		t.Errorf("sampler counted %d decisions, want %d", got, want)
+	}
+}
+
+func TestNewSampler(t *testing.T) {
+	if s, err := newSampler(&DefaultSampleConfig); s != nil || err != nil {
+		t.Errorf("newSampler() with the defaults = %v, %v, want nil", s, err)
+	}
+	s, err := newSampler(&SampleConfig{Rate: 0.125, Attribute: "sample_rate"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	attrs := map[string]string{}
+	s.annotate(attrs, 0.125)
+	if attrs["sample_rate"] != "0.125" {
+		t.Errorf("annotate() attributes = %v, want sample_rate=0.125", attrs)
+	}
+	if _, err := newSampler(&SampleConfig{Rate: 1.5}); err == nil {
+		t.Error("newSampler() with an invalid rate err = nil")
+	}
+}
@@ -0,0 +1,541 @@
+/*
+ * Copyright 2022  David MacKinnon (blaedd@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You may
+ * not use this file except in compliance with the License. A copy of the
+ * License is located at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0.txt
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package plugin
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/fluent/fluent-bit-go/output"
+	"github.com/rs/zerolog"
+)
+
+// Spool full policies.
+const (
+	SpoolFullDropOldest = "drop_oldest"
+	SpoolFullReject     = "reject"
+)
+
+// SpoolConfig holds the settings for the on-disk spool of messages that could not be published.
+type SpoolConfig struct {
+	Dir           string        // Directory holding the spool. The spool is disabled if empty.
+	MaxSize       int64         // Maximum size of the spool segments.
+	SegmentSize   int64         // Size at which a new segment is started.
+	Full          string        // What to do when the spool is full, drop_oldest or reject.
+	DrainInterval time.Duration // How often to try to publish spooled messages.
+	DrainBatch    int           // Maximum number of spooled messages published at once.
+}
+
+// DefaultSpoolConfig holds the default spool settings.
+var DefaultSpoolConfig = SpoolConfig{
+	MaxSize:       1_000_000_000,
+	SegmentSize:   16_000_000,
+	Full:          SpoolFullDropOldest,
+	DrainInterval: time.Second,
+	DrainBatch:    500,
+}
+
+// Validate checks the SpoolConfig settings.
+func (c *SpoolConfig) Validate() error {
+	if c.Dir == "" {
+		return nil
+	}
+	if c.SegmentSize <= 0 || c.MaxSize < c.SegmentSize {
+		return fmt.Errorf("spool_segment_size must be positive, and no larger than spool_max_size")
+	}
+	if c.DrainInterval <= 0 || c.DrainBatch <= 0 {
+		return fmt.Errorf("spool_drain_interval and spool_drain_batch must be positive")
+	}
+	return nil
+}
+
+// ErrSpoolFull is returned when messages can't be added to a full spool with the reject policy.
+var ErrSpoolFull = errors.New("spool is full")
+
+const (
+	segmentExt   = ".seg"
+	cursorFile   = "cursor"
+	recordHeader = 8 // Length and CRC-32C of the payload, both uint32 little endian.
+	// maxRecord is larger than any encoded message, so that a corrupt length isn't allocated.
+	maxRecord = 32 << 20
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// spoolRecord is the payload of a spool record.
+type spoolRecord struct {
+	Attributes  map[string]string `json:"a,omitempty"`
+	Data        []byte            `json:"d"`
+	OrderingKey string            `json:"k,omitempty"`
+}
+
+// segment is a spool file, named by its sequence number. Records are appended to the last segment.
+type segment struct {
+	seq     uint64
+	size    int64 // Bytes in the file.
+	off     int64 // Offset of the first unread record.
+	pending int64 // Unread records.
+}
+
+func (s *segment) name() string {
+	return fmt.Sprintf("%020d%s", s.seq, segmentExt)
+}
+
+// spool is a write-ahead queue of messages on disk.
+//
+// Messages are appended to segment files as length prefixed, checksummed records, and read back in order. The read
+// position is kept in a cursor file, which is only advanced once messages are published, so messages may be
+// published more than once after a crash, but aren't lost.
+type spool struct {
+	cfg  SpoolConfig
+	l    *zerolog.Logger
+	mu   sync.Mutex
+	segs []*segment
+	w    *os.File // Appends to the last segment.
+	size int64    // Total bytes in segments.
+	// Messages discarded because they failed to publish with a non-retryable error.
+	rejected atomic.Int64
+}
+
+// spoolPos is a read position, and the number of records read from each segment to reach it.
+type spoolPos struct {
+	seq  uint64
+	off  int64
+	read map[uint64]int64
+}
+
+// openSpool opens the spool in the configured directory, recovering any existing segments.
+//
+// Records that are truncated or fail their checksum, e.g. after a crash while appending, are discarded along with
+// the rest of their segment.
+func openSpool(cfg *SpoolConfig, l *zerolog.Logger) (*spool, error) {
+	if err := os.MkdirAll(cfg.Dir, 0o700); err != nil {
+		return nil, fmt.Errorf("unable to create spool_dir: %w", err)
+	}
+	s := &spool{cfg: *cfg, l: l}
+	entries, err := os.ReadDir(cfg.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read spool_dir: %w", err)
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		s.segs = append(s.segs, &segment{seq: seq})
+	}
+	sort.Slice(s.segs, func(i, j int) bool { return s.segs[i].seq < s.segs[j].seq })
+
+	cseq, coff := s.readCursor()
+	var live []*segment
+	for _, seg := range s.segs {
+		if seg.seq < cseq {
+			// Already published, but not removed before a crash.
+			_ = os.Remove(s.path(seg))
+			continue
+		}
+		if seg.seq == cseq {
+			seg.off = coff
+		}
+		if err := s.recover(seg); err != nil {
+			return nil, err
+		}
+		s.size += seg.size
+		live = append(live, seg)
+	}
+	s.segs = live
+	if len(s.segs) == 0 {
+		s.segs = append(s.segs, &segment{seq: cseq + 1})
+	}
+	tail := s.segs[len(s.segs)-1]
+	if s.w, err = os.OpenFile(s.path(tail), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600); err != nil {
+		return nil, fmt.Errorf("unable to open spool segment: %w", err)
+	}
+	if n := s.len(); n > 0 {
+		l.Info().Int64("messages", n).Int("segments", len(s.segs)).Msg("recovered spooled messages")
+	}
+	return s, nil
+}
+
+func (s *spool) path(seg *segment) string {
+	return filepath.Join(s.cfg.Dir, seg.name())
+}
+
+// readCursor returns the read position saved by writeCursor, or the start of the spool.
+func (s *spool) readCursor() (uint64, int64) {
+	b, err := os.ReadFile(filepath.Join(s.cfg.Dir, cursorFile))
+	if err != nil {
+		return 0, 0
+	}
+	var (
+		seq uint64
+		off int64
+	)
+	if _, err := fmt.Sscan(string(b), &seq, &off); err != nil {
+		s.l.Warn().Err(err).Msg("ignoring invalid spool cursor")
+		return 0, 0
+	}
+	return seq, off
+}
+
+// writeCursor atomically saves the read position.
+func (s *spool) writeCursor() error {
+	first := s.segs[0]
+	tmp := filepath.Join(s.cfg.Dir, cursorFile+".tmp")
+	if err := os.WriteFile(tmp, []byte(fmt.Sprintf("%d %d\n", first.seq, first.off)), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(s.cfg.Dir, cursorFile))
+}
+
+// recover checks the records of seg from its read offset, counting them and truncating any invalid tail.
+func (s *spool) recover(seg *segment) error {
+	f, err := os.OpenFile(s.path(seg), os.O_RDWR, 0o600)
+	if err != nil {
+		return fmt.Errorf("unable to open spool segment: %w", err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if seg.off > fi.Size() {
+		seg.off = fi.Size()
+	}
+	if _, err := f.Seek(seg.off, io.SeekStart); err != nil {
+		return err
+	}
+	r := bufio.NewReader(f)
+	end := seg.off
+	for {
+		n, err := readRecord(r, nil)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			s.l.Warn().Err(err).Str("segment", seg.name()).Int64("offset", end).Int64("discarded", fi.Size()-end).
+				Msg("discarding invalid spool records")
+			if err := f.Truncate(end); err != nil {
+				return fmt.Errorf("unable to truncate spool segment: %w", err)
+			}
+			break
+		}
+		end += n
+		seg.pending++
+	}
+	seg.size = end
+	return nil
+}
+
+// readRecord reads a record from r into rec, returning the number of bytes read. A nil rec only checks the record.
+func readRecord(r io.Reader, rec *spoolRecord) (int64, error) {
+	var hdr [recordHeader]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		if err == io.EOF {
+			return 0, io.EOF
+		}
+		return 0, fmt.Errorf("truncated record header: %w", err)
+	}
+	n := binary.LittleEndian.Uint32(hdr[:4])
+	if n > maxRecord {
+		return 0, fmt.Errorf("invalid record length %d", n)
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, fmt.Errorf("truncated record: %w", err)
+	}
+	if crc32.Checksum(payload, crcTable) != binary.LittleEndian.Uint32(hdr[4:]) {
+		return 0, fmt.Errorf("record checksum mismatch")
+	}
+	if rec != nil {
+		if err := json.Unmarshal(payload, rec); err != nil {
+			return 0, fmt.Errorf("invalid record: %w", err)
+		}
+	}
+	return recordHeader + int64(n), nil
+}
+
+// encodeRecord encodes a message as a spool record.
+func encodeRecord(msg *pubsub.Message) ([]byte, error) {
+	payload, err := json.Marshal(spoolRecord{Attributes: msg.Attributes, Data: msg.Data, OrderingKey: msg.OrderingKey})
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, recordHeader, recordHeader+len(payload))
+	binary.LittleEndian.PutUint32(b[:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(b[4:], crc32.Checksum(payload, crcTable))
+	return append(b, payload...), nil
+}
+
+// len returns the number of unread messages.
+func (s *spool) len() int64 {
+	var n int64
+	for _, seg := range s.segs {
+		n += seg.pending
+	}
+	return n
+}
+
+// Len returns the number of unread messages.
+func (s *spool) Len() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.len()
+}
+
+// rotate starts a new segment.
+func (s *spool) rotate() error {
+	if err := s.w.Close(); err != nil {
+		return err
+	}
+	seg := &segment{seq: s.segs[len(s.segs)-1].seq + 1}
+	w, err := os.OpenFile(s.path(seg), os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return fmt.Errorf("unable to create spool segment: %w", err)
+	}
+	s.w = w
+	s.segs = append(s.segs, seg)
+	return nil
+}
+
+// evict makes room for n bytes, dropping the oldest segments or returning ErrSpoolFull, depending on the policy.
+func (s *spool) evict(n int64) error {
+	if n > s.cfg.MaxSize {
+		return ErrSpoolFull
+	}
+	for s.size+n > s.cfg.MaxSize {
+		if s.cfg.Full != SpoolFullDropOldest {
+			return ErrSpoolFull
+		}
+		if len(s.segs) == 1 {
+			if err := s.rotate(); err != nil {
+				return err
+			}
+		}
+		oldest := s.segs[0]
+		if err := os.Remove(s.path(oldest)); err != nil {
+			return fmt.Errorf("unable to remove spool segment: %w", err)
+		}
+		s.l.Warn().Str("segment", oldest.name()).Int64("messages", oldest.pending).
+			Msg("spool full, dropped oldest messages")
+		s.segs = s.segs[1:]
+		s.size -= oldest.size
+		if err := s.writeCursor(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Append adds msgs to the end of the spool, syncing them to disk. With the reject policy, either all or none of the
+// messages are added.
+func (s *spool) Append(msgs []*pubsub.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	recs := make([][]byte, len(msgs))
+	var total int64
+	for i, msg := range msgs {
+		rec, err := encodeRecord(msg)
+		if err != nil {
+			return fmt.Errorf("unable to encode spool record: %w", err)
+		}
+		recs[i] = rec
+		total += int64(len(rec))
+	}
+	// Rejected messages are retried by fluent-bit, so none of them are added.
+	if s.cfg.Full == SpoolFullReject && s.size+total > s.cfg.MaxSize {
+		return ErrSpoolFull
+	}
+	for _, rec := range recs {
+		n := int64(len(rec))
+		if err := s.evict(n); err != nil {
+			return err
+		}
+		tail := s.segs[len(s.segs)-1]
+		if tail.size > 0 && tail.size+n > s.cfg.SegmentSize {
+			if err := s.rotate(); err != nil {
+				return err
+			}
+			tail = s.segs[len(s.segs)-1]
+		}
+		if _, err := s.w.Write(rec); err != nil {
+			return fmt.Errorf("unable to write spool record: %w", err)
+		}
+		tail.size += n
+		tail.pending++
+		s.size += n
+	}
+	return s.w.Sync()
+}
+
+// Peek reads up to n messages from the read position, without removing them. The position after them is returned
+// to be passed to Commit once they are published.
+func (s *spool) Peek(n int) ([]*pubsub.Message, *spoolPos, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pos := &spoolPos{read: make(map[uint64]int64)}
+	var msgs []*pubsub.Message
+	for _, seg := range s.segs {
+		pos.seq, pos.off = seg.seq, seg.off
+		if seg.pending == 0 {
+			continue
+		}
+		f, err := os.Open(s.path(seg))
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to open spool segment: %w", err)
+		}
+		if _, err := f.Seek(seg.off, io.SeekStart); err != nil {
+			_ = f.Close()
+			return nil, nil, err
+		}
+		r := bufio.NewReader(io.LimitReader(f, seg.size-seg.off))
+		for read := int64(0); read < seg.pending && len(msgs) < n; read++ {
+			var rec spoolRecord
+			size, err := readRecord(r, &rec)
+			if err != nil {
+				_ = f.Close()
+				return nil, nil, fmt.Errorf("unable to read spool segment %s: %w", seg.name(), err)
+			}
+			pos.off += size
+			pos.read[seg.seq]++
+			msgs = append(msgs, &pubsub.Message{Attributes: rec.Attributes, Data: rec.Data,
+				OrderingKey: rec.OrderingKey})
+		}
+		_ = f.Close()
+		if len(msgs) >= n {
+			break
+		}
+	}
+	return msgs, pos, nil
+}
+
+// Commit removes the messages read by Peek up to pos. Segments that have been read completely are deleted, unless
+// they are still being appended to.
+func (s *spool) Commit(pos *spoolPos) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, seg := range s.segs {
+		n, ok := pos.read[seg.seq]
+		if !ok {
+			continue
+		}
+		seg.pending -= n
+		if seg.seq == pos.seq {
+			seg.off = pos.off
+		} else {
+			seg.off = seg.size
+		}
+	}
+	for len(s.segs) > 1 && s.segs[0].pending == 0 {
+		if err := os.Remove(s.path(s.segs[0])); err != nil {
+			return fmt.Errorf("unable to remove spool segment: %w", err)
+		}
+		s.size -= s.segs[0].size
+		s.segs = s.segs[1:]
+	}
+	return s.writeCursor()
+}
+
+// Close closes the segment being appended to.
+func (s *spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Close()
+}
+
+// spooled returns the number of spooled messages.
+func (p *OutputPlugin) spooled() int64 {
+	if p.spool == nil {
+		return 0
+	}
+	return p.spool.Len()
+}
+
+// spoolMessages adds msgs to the spool, returning the fluent-bit status code.
+func (p *OutputPlugin) spoolMessages(l *zerolog.Logger, msgs []*pubsub.Message, reason string) int {
+	if err := p.spool.Append(msgs); err != nil {
+		l.Warn().Err(err).Int("messages", len(msgs)).Msg("unable to spool messages. Will retry.")
+		return output.FLB_RETRY
+	}
+	l.Info().Int("messages", len(msgs)).Str("reason", reason).Msg("spooled messages")
+	return output.FLB_OK
+}
+
+// drainSpool publishes spooled messages in order, until ctx is cancelled.
+func (p *OutputPlugin) drainSpool(ctx context.Context, l *zerolog.Logger) {
+	t := time.NewTicker(p.config.Spool.DrainInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		for p.Ready() && p.spool.Len() > 0 && ctx.Err() == nil {
+			msgs, pos, err := p.spool.Peek(p.config.Spool.DrainBatch)
+			if err != nil {
+				l.Error().Err(err).Msg("unable to read spooled messages")
+				break
+			}
+			// Spooled messages also probe a half open circuit.
+			if !p.brk.allow() {
+				break
+			}
+			err = p.PublishMessages(ctx, msgs)
+			if errors.Is(err, ErrRateLimited) {
+				p.brk.release()
+			} else {
+				p.brk.done(err)
+			}
+			var perr *PublishError
+			if errors.As(err, &perr) && perr.Rejected == perr.Failed {
+				// Messages that can never be published would otherwise hold up the spool for good.
+				p.spool.rejected.Add(int64(perr.Rejected))
+				l.Error().Err(err).Int("rejected", perr.Rejected).Msg("discarding spooled messages that can't be " +
+					"published")
+			} else if err != nil {
+				l.Warn().Err(err).Int64("spooled", p.spool.Len()).Msg("unable to publish spooled messages")
+				break
+			}
+			if err := p.spool.Commit(pos); err != nil {
+				l.Error().Err(err).Msg("unable to remove published messages from the spool")
+				break
+			}
+			l.Debug().Int("messages", len(msgs)).Int64("spooled", p.spool.Len()).Msg("published spooled messages")
+		}
+	}
+}
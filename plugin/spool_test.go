@@ -0,0 +1,321 @@
+/*
+ * Copyright 2022  David MacKinnon (blaedd@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You may
+ * not use this file except in compliance with the License. A copy of the
+ * License is located at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0.txt
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/apiv1/pubsubpb"
+	"cloud.google.com/go/pubsub/pstest"
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func testMessages(from, n int) []*pubsub.Message {
+	msgs := make([]*pubsub.Message, n)
+	for i := range msgs {
+		msgs[i] = &pubsub.Message{Data: []byte(fmt.Sprintf("message %03d", from+i)),
+			Attributes: map[string]string{"tag": "test"}}
+	}
+	return msgs
+}
+
+func openTestSpool(t *testing.T, cfg SpoolConfig) *spool {
+	t.Helper()
+	l := zerolog.Nop()
+	s, err := openSpool(&cfg, &l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+	return s
+}
+
+// drain reads and commits all messages in s, returning their data.
+func drain(t *testing.T, s *spool, batch int) []string {
+	t.Helper()
+	var got []string
+	for s.Len() > 0 {
+		msgs, pos, err := s.Peek(batch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range msgs {
+			got = append(got, string(m.Data))
+		}
+		if err := s.Commit(pos); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return got
+}
+
+func wantData(from, n int) []string {
+	var want []string
+	for _, m := range testMessages(from, n) {
+		want = append(want, string(m.Data))
+	}
+	return want
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestSpool_order(t *testing.T) {
+	cfg := DefaultSpoolConfig
+	cfg.Dir = t.TempDir()
+	cfg.SegmentSize = 200
+	s := openTestSpool(t, cfg)
+	if err := s.Append(testMessages(0, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if len(segmentFiles(t, cfg.Dir)) < 3 {
+		t.Errorf("spool has %d segments, want rotation at spool_segment_size", len(segmentFiles(t, cfg.Dir)))
+	}
+	msgs, pos, err := s.Peek(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 4 || msgs[0].Attributes["tag"] != "test" || s.Len() != 10 {
+		t.Fatalf("Peek(4) = %d messages, spool has %d, want 4 and 10", len(msgs), s.Len())
+	}
+	// Messages appended while a batch is being published are kept after it.
+	if err := s.Append(testMessages(10, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Commit(pos); err != nil {
+		t.Fatal(err)
+	}
+	got := drain(t, s, 3)
+	if fmt.Sprint(got) != fmt.Sprint(wantData(4, 8)) {
+		t.Errorf("drained %v, want %v", got, wantData(4, 8))
+	}
+	if n := len(segmentFiles(t, cfg.Dir)); n != 1 {
+		t.Errorf("spool has %d segments after draining, want 1", n)
+	}
+}
+
+func TestSpool_recovery(t *testing.T) {
+	type testData struct {
+		corrupt func(t *testing.T, path string)
+		want    []string
+	}
+	testMap := map[string]testData{
+		"clean": {want: wantData(3, 5)},
+		"tornTail": {corrupt: func(t *testing.T, path string) {
+			fi, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Truncate(path, fi.Size()-3); err != nil {
+				t.Fatal(err)
+			}
+		}, want: wantData(3, 4)},
+		"badChecksum": {corrupt: func(t *testing.T, path string) {
+			b, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b[len(b)-2] ^= 0xff
+			if err := os.WriteFile(path, b, 0o600); err != nil {
+				t.Fatal(err)
+			}
+		}, want: wantData(3, 4)},
+		"garbageLength": {corrupt: func(t *testing.T, path string) {
+			f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _ = f.Write([]byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0})
+			_ = f.Close()
+		}, want: wantData(3, 5)},
+	}
+	for k, tt := range testMap {
+		t.Run(k, func(t *testing.T) {
+			cfg := DefaultSpoolConfig
+			cfg.Dir = t.TempDir()
+			s := openTestSpool(t, cfg)
+			if err := s.Append(testMessages(0, 8)); err != nil {
+				t.Fatal(err)
+			}
+			_, pos, err := s.Peek(3)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Commit(pos); err != nil {
+				t.Fatal(err)
+			}
+			_ = s.Close()
+			if tt.corrupt != nil {
+				files := segmentFiles(t, cfg.Dir)
+				tt.corrupt(t, files[len(files)-1])
+			}
+
+			s = openTestSpool(t, cfg)
+			if got := drain(t, s, 100); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("recovered %v, want %v", got, tt.want)
+			}
+			// The recovered spool can still be appended to.
+			if err := s.Append(testMessages(20, 1)); err != nil {
+				t.Fatal(err)
+			}
+			if got := drain(t, s, 100); fmt.Sprint(got) != fmt.Sprint(wantData(20, 1)) {
+				t.Errorf("drained %v after recovery, want %v", got, wantData(20, 1))
+			}
+		})
+	}
+}
+
+func TestSpool_full(t *testing.T) {
+	rec, err := encodeRecord(testMessages(0, 1)[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := int64(len(rec))
+	type testData struct {
+		full    string
+		wantErr error
+		want    []string
+	}
+	testMap := map[string]testData{
+		"dropOldest": {full: SpoolFullDropOldest, want: wantData(2, 6)},
+		"reject":     {full: SpoolFullReject, wantErr: ErrSpoolFull, want: wantData(0, 5)},
+	}
+	for k, tt := range testMap {
+		t.Run(k, func(t *testing.T) {
+			cfg := SpoolConfig{Dir: t.TempDir(), MaxSize: 6 * size, SegmentSize: 2 * size, Full: tt.full}
+			s := openTestSpool(t, cfg)
+			if err := s.Append(testMessages(0, 5)); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Append(testMessages(5, 3)); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Append() err = %v, want %v", err, tt.wantErr)
+			}
+			if got := drain(t, s, 100); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("drained %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOutputPlugin_drainSpool(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client, srv := newTestClient(t)
+	topic, err := client.CreateTopic(ctx, "logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(topic.Stop)
+
+	cfg := DefaultSpoolConfig
+	cfg.Dir = t.TempDir()
+	cfg.DrainInterval = time.Millisecond
+	cfg.DrainBatch = 3
+	p := &OutputPlugin{Topic: topic, Retry: NewRetryPolicy(DefaultRetryCodes, nil),
+		config: &OutputPluginConfig{Spool: cfg}, spool: openTestSpool(t, cfg)}
+	if err := p.spool.Append(testMessages(0, 7)); err != nil {
+		t.Fatal(err)
+	}
+	l := zerolog.Nop()
+	go p.drainSpool(ctx, &l)
+	deadline := time.Now().Add(5 * time.Second)
+	for p.spool.Len() > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := p.spool.Len(); n != 0 {
+		t.Fatalf("spool has %d messages, want 0", n)
+	}
+	var got []string
+	for _, m := range srv.Messages() {
+		got = append(got, string(m.Data))
+	}
+	if fmt.Sprint(got) != fmt.Sprint(wantData(0, 7)) {
+		t.Errorf("published %v, want %v", got, wantData(0, 7))
+	}
+}
+
+// poisonReactor fails publish requests holding a message with the poison data.
+type poisonReactor struct{ data string }
+
+func (r poisonReactor) React(req interface{}) (bool, interface{}, error) {
+	for _, m := range req.(*pubsubpb.PublishRequest).Messages {
+		if string(m.Data) == r.data {
+			return true, nil, status.Error(codes.InvalidArgument, "bad message")
+		}
+	}
+	return false, nil, nil
+}
+
+func TestOutputPlugin_drainSpoolPoison(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client, srv := newTestClient(t, pstest.ServerReactorOption{FuncName: "Publish",
+		Reactor: poisonReactor{data: "poison"}})
+	topic, err := client.CreateTopic(ctx, "logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(topic.Stop)
+
+	cfg := DefaultSpoolConfig
+	cfg.Dir = t.TempDir()
+	cfg.DrainInterval = time.Millisecond
+	cfg.DrainBatch = 1
+	p := &OutputPlugin{Topic: topic, Retry: NewRetryPolicy(DefaultRetryCodes, nil),
+		config: &OutputPluginConfig{Spool: cfg}, spool: openTestSpool(t, cfg)}
+	if err := p.spool.Append([]*pubsub.Message{{Data: []byte("poison")}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.spool.Append(testMessages(0, 3)); err != nil {
+		t.Fatal(err)
+	}
+	l := zerolog.Nop()
+	go p.drainSpool(ctx, &l)
+	deadline := time.Now().Add(5 * time.Second)
+	for p.spool.Len() > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := p.spool.Len(); n != 0 {
+		t.Fatalf("spool has %d messages behind the poison message, want 0", n)
+	}
+	var got []string
+	for _, m := range srv.Messages() {
+		got = append(got, string(m.Data))
+	}
+	if fmt.Sprint(got) != fmt.Sprint(wantData(0, 3)) {
+		t.Errorf("published %v, want %v", got, wantData(0, 3))
+	}
+	if n := p.spool.rejected.Load(); n != 1 {
+		t.Errorf("rejected = %d, want 1", n)
+	}
+}
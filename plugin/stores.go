@@ -0,0 +1,325 @@
+/*
+ * Copyright 2022  David MacKinnon (blaedd@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You may
+ * not use this file except in compliance with the License. A copy of the
+ * License is located at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0.txt
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package plugin
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultEnvPrefix is the prefix of environment variables holding plugin options, unless env_prefix is set.
+const DefaultEnvPrefix = "PUBSUB_OUT_"
+
+// EnvConfigStore reads options from environment variables named by the upper cased option name with a prefix, e.g.
+// PUBSUB_OUT_TOPIC_ID.
+//
+// EnvConfigStore is not a KeyLister, as variables with the prefix may be meant for other plugin instances, e.g. with
+// a longer prefix. Instead, variables with the prefix that aren't options are logged as warnings, unless they are an
+// option after a longer prefix, e.g. PUBSUB_OUT_AUDIT_TOPIC_ID.
+type EnvConfigStore struct {
+	lookupStore
+	prefix string
+}
+
+// NewEnvConfigStore creates an EnvConfigStore reading variables with the prefix.
+func NewEnvConfigStore(prefix string, l *zerolog.Logger) *EnvConfigStore {
+	s := &EnvConfigStore{prefix: prefix}
+	s.lookupStore = lookupStore{l: l, lookup: s.lookup}
+	if l != nil {
+		for _, k := range s.unknownKeys() {
+			e := l.Warn().Str("variable", prefix+strings.ToUpper(k))
+			if sug := suggestOption(k); sug != "" {
+				e = e.Str("did_you_mean", prefix+strings.ToUpper(sug))
+			}
+			e.Msg("environment variable with the option prefix is not a known option")
+		}
+	}
+	return s
+}
+
+// unknownKeys returns the names, in lower case without the prefix, of variables with the prefix that aren't
+// options, either directly or after a longer prefix.
+func (s *EnvConfigStore) unknownKeys() []string {
+	var keys []string
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		if !strings.HasPrefix(name, s.prefix) {
+			continue
+		}
+		if k := strings.ToLower(strings.TrimPrefix(name, s.prefix)); !isPrefixedOption(k) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// isPrefixedOption reports if k is an option, or an option following a prefix ending in an underscore.
+func isPrefixedOption(k string) bool {
+	for {
+		if LookupOption(k) != nil {
+			return true
+		}
+		i := strings.IndexByte(k, '_')
+		if i < 0 {
+			return false
+		}
+		k = k[i+1:]
+	}
+}
+
+func (s *EnvConfigStore) lookup(name string) (string, bool) {
+	v, ok := os.LookupEnv(s.prefix + strings.ToUpper(name))
+	return v, ok && v != ""
+}
+
+// MapConfigStore is a ConfigStore holding options in memory, mainly for tests. Keys are option names in lower case.
+type MapConfigStore map[string]string
+
+func (m MapConfigStore) store() lookupStore {
+	return lookupStore{lookup: func(name string) (string, bool) {
+		v, ok := m[strings.ToLower(name)]
+		return v, ok && v != ""
+	}}
+}
+
+func (m MapConfigStore) Bool(name string) (bool, bool)              { return m.store().Bool(name) }
+func (m MapConfigStore) Bytes(name string) (int64, bool)            { return m.store().Bytes(name) }
+func (m MapConfigStore) Map(name string) (map[string]string, bool)  { return m.store().Map(name) }
+func (m MapConfigStore) Duration(name string) (time.Duration, bool) { return m.store().Duration(name) }
+func (m MapConfigStore) Int(name string) (int, bool)                { return m.store().Int(name) }
+func (m MapConfigStore) String(name string) (string, bool)          { return m.store().String(name) }
+func (m MapConfigStore) Strings(name string) ([]string, bool)       { return m.store().Strings(name) }
+func (m MapConfigStore) ValueErr(name string) error                 { return m.store().ValueErr(name) }
+
+// Keys returns the option names in the store.
+func (m MapConfigStore) Keys() []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// FileConfigStore reads options from a YAML or JSON file holding a single object of option names to values.
+//
+// Lists are converted to comma seperated values, and objects to comma seperated key=value pairs, quoting items as
+// needed.
+type FileConfigStore struct {
+	lookupStore
+	path   string
+	values MapConfigStore
+}
+
+// NewFileConfigStore loads the options in the file at path.
+func NewFileConfigStore(path string, l *zerolog.Logger) (*FileConfigStore, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read config_file: %w", err)
+	}
+	var raw map[string]interface{}
+	if err := yaml.Unmarshal(b, &raw); err != nil {
+		return nil, fmt.Errorf("unable to parse config_file %s: %w", path, err)
+	}
+	values := make(MapConfigStore, len(raw))
+	for k, v := range raw {
+		sv, err := fileValue(v)
+		if err != nil {
+			return nil, fmt.Errorf("config_file %s: %s: %w", path, k, err)
+		}
+		values[strings.ToLower(k)] = sv
+	}
+	s := &FileConfigStore{path: path, values: values}
+	s.lookupStore = lookupStore{l: l, lookup: values.store().lookup}
+	return s, nil
+}
+
+// fileValue converts a value from a config file to the configuration file syntax.
+func fileValue(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			s, err := fileValue(item)
+			if err != nil {
+				return "", err
+			}
+			items[i] = quoteListItem(s)
+		}
+		return strings.Join(items, ","), nil
+	case map[string]interface{}:
+		kvs := make(map[string]string, len(v))
+		for k, item := range v {
+			s, err := fileValue(item)
+			if err != nil {
+				return "", err
+			}
+			kvs[k] = s
+		}
+		return formatKeyValues(kvs), nil
+	case string:
+		return v, nil
+	case bool, int, int64, uint64, float64:
+		return fmt.Sprint(v), nil
+	}
+	return "", fmt.Errorf("unsupported value %v", v)
+}
+
+// Keys returns the option names in the file.
+func (s *FileConfigStore) Keys() []string {
+	return s.values.Keys()
+}
+
+// LayeredConfigStore looks up options in a list of stores, using the value from the first store that has it.
+type LayeredConfigStore struct {
+	stores []ConfigStore
+}
+
+// NewLayeredConfigStore creates a LayeredConfigStore. Earlier stores take precedence.
+func NewLayeredConfigStore(stores ...ConfigStore) *LayeredConfigStore {
+	return &LayeredConfigStore{stores: stores}
+}
+
+// layer returns the first store with a value for name, or nil.
+//
+// Only the first store with a value is consulted for the typed accessors, so that an invalid value isn't replaced
+// by one from a later store.
+func (s *LayeredConfigStore) layer(name string) ConfigStore {
+	for _, cs := range s.stores {
+		if _, ok := cs.String(name); ok {
+			return cs
+		}
+	}
+	return nil
+}
+
+func (s *LayeredConfigStore) Bool(name string) (bool, bool) {
+	if cs := s.layer(name); cs != nil {
+		return cs.Bool(name)
+	}
+	return false, false
+}
+
+func (s *LayeredConfigStore) Bytes(name string) (int64, bool) {
+	if cs := s.layer(name); cs != nil {
+		return cs.Bytes(name)
+	}
+	return 0, false
+}
+
+func (s *LayeredConfigStore) Map(name string) (map[string]string, bool) {
+	if cs := s.layer(name); cs != nil {
+		return cs.Map(name)
+	}
+	return nil, false
+}
+
+func (s *LayeredConfigStore) Duration(name string) (time.Duration, bool) {
+	if cs := s.layer(name); cs != nil {
+		return cs.Duration(name)
+	}
+	return 0, false
+}
+
+func (s *LayeredConfigStore) Int(name string) (int, bool) {
+	if cs := s.layer(name); cs != nil {
+		return cs.Int(name)
+	}
+	return 0, false
+}
+
+func (s *LayeredConfigStore) String(name string) (string, bool) {
+	if cs := s.layer(name); cs != nil {
+		return cs.String(name)
+	}
+	return "", false
+}
+
+func (s *LayeredConfigStore) Strings(name string) ([]string, bool) {
+	if cs := s.layer(name); cs != nil {
+		return cs.Strings(name)
+	}
+	return nil, false
+}
+
+// ValueErr returns the error reading the value of name from the first store that has it, if any.
+func (s *LayeredConfigStore) ValueErr(name string) error {
+	if ve, ok := s.layer(name).(valueErrorer); ok {
+		return ve.ValueErr(name)
+	}
+	return nil
+}
+
+// Keys returns the option names of the layers that are KeyListers.
+func (s *LayeredConfigStore) Keys() []string {
+	seen := make(map[string]bool)
+	var keys []string
+	for _, cs := range s.stores {
+		kl, ok := cs.(KeyLister)
+		if !ok {
+			continue
+		}
+		for _, k := range kl.Keys() {
+			if !seen[k] {
+				seen[k] = true
+				keys = append(keys, k)
+			}
+		}
+	}
+	return keys
+}
+
+// NewPluginConfigStore layers the environment and the optional config_file under the [OUTPUT] section options.
+//
+// Options in the [OUTPUT] section take precedence over environment variables, which take precedence over the
+// config_file. env_prefix and config_file can be set in the [OUTPUT] section, and config_file can also be set in
+// the environment.
+func NewPluginConfigStore(flb ConfigStore, l *zerolog.Logger) (ConfigStore, error) {
+	if ve, ok := flb.(valueErrorer); ok {
+		if err := ve.ValueErr("env_prefix"); err != nil {
+			return nil, err
+		}
+	}
+	prefix, ok := flb.String("env_prefix")
+	if !ok {
+		prefix = DefaultEnvPrefix
+	}
+	cs := NewLayeredConfigStore(flb, NewEnvConfigStore(prefix, l))
+	if err := cs.ValueErr("config_file"); err != nil {
+		return nil, err
+	}
+	path, ok := cs.String("config_file")
+	if !ok {
+		return cs, nil
+	}
+	file, err := NewFileConfigStore(path, l)
+	if err != nil {
+		return nil, err
+	}
+	cs.stores = append(cs.stores, file)
+	return cs, nil
+}
@@ -0,0 +1,211 @@
+/*
+ * Copyright 2022  David MacKinnon (blaedd@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You may
+ * not use this file except in compliance with the License. A copy of the
+ * License is located at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0.txt
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package plugin
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestEnvConfigStore(t *testing.T) {
+	l := zerolog.Nop()
+	t.Setenv("TEST_PUBSUB_TOPIC_ID", "logs")
+	t.Setenv("TEST_PUBSUB_PUBLISH_TIMEOUT", "2m")
+	t.Setenv("TEST_PUBSUB_QUOTA_PROJECT", "")
+	s := NewEnvConfigStore("TEST_PUBSUB_", &l)
+
+	if v, ok := s.String("topic_id"); !ok || v != "logs" {
+		t.Errorf("String() = %q, %v", v, ok)
+	}
+	if v, ok := s.Duration("publish_timeout"); !ok || v != 2*time.Minute {
+		t.Errorf("Duration() = %v, %v", v, ok)
+	}
+	if _, ok := s.String("quota_project"); ok {
+		t.Errorf("String() found an empty variable")
+	}
+	if _, ok := s.String("gcp_project_id"); ok {
+		t.Errorf("String() found an unset variable")
+	}
+}
+
+func TestFileConfigStore(t *testing.T) {
+	l := zerolog.Nop()
+	dir := t.TempDir()
+	testMap := map[string]string{
+		"config.yaml": "topic_id: logs\npublish_count_threshold: 10\nlazy_init: true\n" +
+			"attribute_fields: [host, app]\nlabels_with_commas: [\"a, b\", c]\ntopic_labels:\n  team: core\n  env: prod\n",
+		"config.json": `{"topic_id": "logs", "publish_count_threshold": 10, "lazy_init": true,
+			"attribute_fields": ["host", "app"], "topic_labels": {"team": "core", "env": "prod"}}`,
+	}
+	for k, content := range testMap {
+		t.Run(k, func(t *testing.T) {
+			path := filepath.Join(dir, k)
+			if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			s, err := NewFileConfigStore(path, &l)
+			if err != nil {
+				t.Fatalf("NewFileConfigStore() err = %v", err)
+			}
+			if v, ok := s.String("topic_id"); !ok || v != "logs" {
+				t.Errorf("String() = %q, %v", v, ok)
+			}
+			if v, ok := s.Int("publish_count_threshold"); !ok || v != 10 {
+				t.Errorf("Int() = %d, %v", v, ok)
+			}
+			if v, ok := s.Bool("lazy_init"); !ok || !v {
+				t.Errorf("Bool() = %v, %v", v, ok)
+			}
+			if v, ok := s.Strings("attribute_fields"); !ok || !reflect.DeepEqual(v, []string{"host", "app"}) {
+				t.Errorf("Strings() = %v, %v", v, ok)
+			}
+			if v, ok := s.String("topic_labels"); !ok || v != "env=prod,team=core" {
+				t.Errorf("String() = %v, %v", v, ok)
+			}
+			wantKeys := 5
+			if k == "config.yaml" {
+				wantKeys++
+				if v, ok := s.Strings("labels_with_commas"); !ok || !reflect.DeepEqual(v, []string{"a, b", "c"}) {
+					t.Errorf("Strings() = %v, %v", v, ok)
+				}
+			}
+			if keys := s.Keys(); len(keys) != wantKeys {
+				t.Errorf("Keys() = %v", keys)
+			}
+		})
+	}
+
+	if _, err := NewFileConfigStore(filepath.Join(dir, "missing.yaml"), &l); err == nil {
+		t.Errorf("NewFileConfigStore() missing file err = nil")
+	}
+	bad := filepath.Join(dir, "bad.yaml")
+	if err := os.WriteFile(bad, []byte("- a list\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewFileConfigStore(bad, &l); err == nil {
+		t.Errorf("NewFileConfigStore() list err = nil")
+	}
+}
+
+func TestLayeredConfigStore(t *testing.T) {
+	s := NewLayeredConfigStore(
+		MapConfigStore{"topic_id": "flb", "publish_timeout": "soon"},
+		MapConfigStore{"topic_id": "env", "gcp_project_id": "env", "publish_timeout": "1m"},
+		MapConfigStore{"gcp_project_id": "file", "quota_project": "file"},
+	)
+	for name, want := range map[string]string{"topic_id": "flb", "gcp_project_id": "env", "quota_project": "file"} {
+		if v, ok := s.String(name); !ok || v != want {
+			t.Errorf("String(%q) = %q, %v, want %q", name, v, ok, want)
+		}
+	}
+	// An invalid value is not replaced by one from a later layer.
+	if _, ok := s.Duration("publish_timeout"); ok {
+		t.Errorf("Duration() ok with an invalid value in the first layer")
+	}
+	if _, ok := s.String("credentials_file"); ok {
+		t.Errorf("String() found a missing key")
+	}
+	if keys := s.Keys(); len(keys) != 4 {
+		t.Errorf("Keys() = %v", keys)
+	}
+}
+
+func TestNewPluginConfigStore(t *testing.T) {
+	l := zerolog.Nop()
+	path := filepath.Join(t.TempDir(), "pubsub.yaml")
+	if err := os.WriteFile(path, []byte("gcp_project_id: file\ntopic_id: file\npublish_retries: 3\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TEST_OUT_CONFIG_FILE", path)
+	t.Setenv("TEST_OUT_TOPIC_ID", "env")
+	t.Setenv("TEST_OUT_CREDENTIALS_JSON", "{}")
+
+	cs, err := NewPluginConfigStore(MapConfigStore{"env_prefix": "TEST_OUT_", "publish_retries": "1"}, &l)
+	if err != nil {
+		t.Fatalf("NewPluginConfigStore() err = %v", err)
+	}
+	cfg, err := BuildPluginConfig(0, cs)
+	if err != nil {
+		t.Fatalf("BuildPluginConfig() err = %v", err)
+	}
+	if cfg.PID != "file" || cfg.TID != "env" || cfg.Retry.Retries != 1 || cfg.CrdsJSON != "{}" {
+		t.Errorf("BuildPluginConfig() PID, TID, Retries, CrdsJSON = %s, %s, %d, %s", cfg.PID, cfg.TID,
+			cfg.Retry.Retries, cfg.CrdsJSON)
+	}
+	if cfg.ConfigFile != path {
+		t.Errorf("BuildPluginConfig() ConfigFile = %s", cfg.ConfigFile)
+	}
+
+	if err := os.WriteFile(path, []byte("topic_idd: file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cs, err = NewPluginConfigStore(MapConfigStore{"env_prefix": "TEST_OUT_"}, &l)
+	if err != nil {
+		t.Fatalf("NewPluginConfigStore() err = %v", err)
+	}
+	if _, err = BuildPluginConfig(0, cs); err == nil || !strings.Contains(err.Error(), `did you mean "topic_id"`) {
+		t.Errorf("BuildPluginConfig() err = %v, want unknown option", err)
+	}
+	t.Setenv("TEST_OUT_CONFIG_FILE", "@file:/nonexistent/config_path")
+	if _, err = NewPluginConfigStore(MapConfigStore{"env_prefix": "TEST_OUT_"}, &l); err == nil ||
+		!strings.Contains(err.Error(), "config_file") {
+		t.Errorf("NewPluginConfigStore() err = %v, want config_file expansion error", err)
+	}
+}
+
+func TestEnvConfigStore_unknownKeys(t *testing.T) {
+	t.Setenv("TEST_ENV_TOPIC_ID", "logs")
+	t.Setenv("TEST_ENV_TOPC_ID", "typo")
+	t.Setenv("TEST_ENV_FROBNICATE", "1")
+	t.Setenv("TEST_ENVX_TOPIC_ID", "other prefix")
+	t.Setenv("TEST_ENV_AUDIT_TOPIC_ID", "longer prefix")
+	t.Setenv("TEST_ENV_AUDIT_FROBNICATE", "longer prefix")
+
+	var b bytes.Buffer
+	l := zerolog.New(&b)
+	s := NewEnvConfigStore("TEST_ENV_", &l)
+	// Variables for an instance with a longer prefix, e.g. TEST_ENV_AUDIT_, aren't reported.
+	if keys := s.unknownKeys(); fmt.Sprint(keys) != "[audit_frobnicate frobnicate topc_id]" {
+		t.Errorf("unknownKeys() = %v, want [audit_frobnicate frobnicate topc_id]", keys)
+	}
+	for _, want := range []string{`"variable":"TEST_ENV_TOPC_ID","did_you_mean":"TEST_ENV_TOPIC_ID"`,
+		`"variable":"TEST_ENV_FROBNICATE"`} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("NewEnvConfigStore() logged %s, want a warning with %s", b.String(), want)
+		}
+	}
+	if strings.Contains(b.String(), "TEST_ENV_AUDIT_TOPIC_ID") {
+		t.Errorf("NewEnvConfigStore() logged %s, want no warning for TEST_ENV_AUDIT_TOPIC_ID", b.String())
+	}
+	// Unknown variables are only warned about, as they may be meant for another instance.
+	cfg, err := BuildPluginConfig(0, NewLayeredConfigStore(MapConfigStore{"gcp_project_id": "proj"}, s))
+	if err != nil {
+		t.Fatalf("BuildPluginConfig() err = %v", err)
+	}
+	if cfg.TID != "logs" {
+		t.Errorf("BuildPluginConfig() TID = %s, want logs", cfg.TID)
+	}
+}
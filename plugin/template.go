@@ -0,0 +1,133 @@
+/*
+ * Copyright 2022  David MacKinnon (blaedd@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You may
+ * not use this file except in compliance with the License. A copy of the
+ * License is located at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0.txt
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package plugin
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"text/template"
+	"time"
+)
+
+// RecordData is the data available to templates evaluated against a fluent-bit record.
+type RecordData struct {
+	Tag    string                 // The fluent-bit tag.
+	Time   time.Time              // The fluent-bit timestamp.
+	Record map[string]interface{} // The record fields.
+}
+
+// templateFuncs are the helper functions available in record templates.
+//
+//   - json VALUE: encodes VALUE as JSON.
+//   - field RECORD PATH: looks up a field by dotted path, e.g. field .Record "kubernetes.pod_name".
+//   - default DEFAULT VALUE: returns DEFAULT if VALUE is missing or empty.
+//   - formatTime LAYOUT TIME: formats TIME using a [time.Layout] style layout, or one of the names RFC3339,
+//     RFC3339Nano, Unix, UnixMilli, UnixMicro or UnixNano.
+//   - hash DATA: returns a hash of the tag, timestamp and record of DATA, e.g. hash ., which is the same each time
+//     the record is published.
+//   - uuid: returns a random UUID, which is different each time the record is published, including retries.
+var templateFuncs = template.FuncMap{
+	"json":       toJSON,
+	"field":      templateField,
+	"default":    defaultValue,
+	"formatTime": formatTime,
+	"hash":       templateHash,
+	"uuid":       newUUID,
+}
+
+// newRecordTemplate parses a template to be evaluated against [RecordData].
+func newRecordTemplate(name, text string) (*template.Template, error) {
+	t, err := template.New(name).Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s template: %w", name, err)
+	}
+	return t, nil
+}
+
+// execTemplate evaluates t against the provided RecordData and returns the output.
+func execTemplate(t *template.Template, data *RecordData) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func toJSON(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func templateField(record map[string]interface{}, path string) interface{} {
+	v, _ := lookupField(record, path)
+	return v
+}
+
+func templateHash(data *RecordData) string {
+	return recordHash(data.Time, data.Tag, "", data.Record)
+}
+
+func defaultValue(def, v interface{}) interface{} {
+	if v == nil {
+		return def
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map:
+		if rv.Len() == 0 {
+			return def
+		}
+	}
+	return v
+}
+
+func formatTime(layout string, t time.Time) string {
+	switch layout {
+	case "RFC3339":
+		return t.Format(time.RFC3339)
+	case "RFC3339Nano":
+		return t.Format(time.RFC3339Nano)
+	case "Unix":
+		return strconv.FormatInt(t.Unix(), 10)
+	case "UnixMilli":
+		return strconv.FormatInt(t.UnixMilli(), 10)
+	case "UnixMicro":
+		return strconv.FormatInt(t.UnixMicro(), 10)
+	case "UnixNano":
+		return strconv.FormatInt(t.UnixNano(), 10)
+	}
+	return t.Format(layout)
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() (string, error) {
+	var u [16]byte
+	if _, err := rand.Read(u[:]); err != nil {
+		return "", err
+	}
+	u[6] = (u[6] & 0x0f) | 0x40
+	u[8] = (u[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:]), nil
+}
@@ -0,0 +1,197 @@
+/*
+ * Copyright 2022  David MacKinnon (blaedd@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You may
+ * not use this file except in compliance with the License. A copy of the
+ * License is located at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0.txt
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package plugin
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+const (
+	tracerName = "github.com/blaedd/fluent-bit-pubsub-plugin"
+	// traceAttrPrefix is prepended to the trace context message attributes, as used by the PubSub client libraries.
+	traceAttrPrefix = "googclient_"
+)
+
+var noopTracer = noop.NewTracerProvider().Tracer(tracerName)
+
+// DefaultTracingConfig holds the default tracing settings.
+var DefaultTracingConfig = TracingConfig{ServiceName: "fluent-bit-pubsub"}
+
+// TracingConfig holds the OpenTelemetry tracing settings.
+type TracingConfig struct {
+	Endpoint      string // OTLP/gRPC collector endpoint. Tracing is disabled if empty.
+	Insecure      bool   // Connect to the collector without TLS.
+	ServiceName   string // The service.name resource attribute.
+	Propagate     bool   // Inject the trace context into message attributes.
+	LinkField     string // Record field holding the trace id of a span to link the publish span to.
+	LinkSpanField string // Record field holding the span id of the span to link to. Optional.
+}
+
+// Validate checks the TracingConfig settings.
+func (c *TracingConfig) Validate() error {
+	if c.Propagate && c.Endpoint == "" {
+		return fmt.Errorf("trace_propagate requires otel_endpoint")
+	}
+	if c.LinkSpanField != "" && c.LinkField == "" {
+		return fmt.Errorf("trace_link_span_field requires trace_link_field")
+	}
+	return nil
+}
+
+// flushTracer creates the spans for flushes. A nil flushTracer creates non-recording spans.
+type flushTracer struct {
+	cfg    TracingConfig
+	tracer trace.Tracer
+	tp     *sdktrace.TracerProvider
+}
+
+// newFlushTracer creates a flushTracer exporting spans to the configured collector.
+func newFlushTracer(ctx context.Context, c *TracingConfig, id int) (*flushTracer, error) {
+	if c.Endpoint == "" {
+		return nil, nil
+	}
+	opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(c.Endpoint)}
+	if c.Insecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+	exp, err := otlptracegrpc.New(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create OTLP exporter: %w", err)
+	}
+	res := resource.NewSchemaless(attribute.String("service.name", c.ServiceName),
+		attribute.Int("fluentbit.plugin.id", id))
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exp), sdktrace.WithResource(res))
+	return &flushTracer{cfg: *c, tracer: tp.Tracer(tracerName), tp: tp}, nil
+}
+
+func (t *flushTracer) start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	if t == nil {
+		return noopTracer.Start(ctx, name, opts...)
+	}
+	return t.tracer.Start(ctx, name, opts...)
+}
+
+// link returns a link to the span identified by the trace_link_field and trace_link_span_field of the record.
+//
+// Trace ids may be in the Cloud Logging projects/PROJECT/traces/TRACE_ID form. If trace_link_span_field isn't set,
+// or isn't in the record, the link only has a trace id.
+func (t *flushTracer) link(record map[string]interface{}) (trace.Link, bool) {
+	if t == nil || t.cfg.LinkField == "" {
+		return trace.Link{}, false
+	}
+	tv, ok := lookupField(record, t.cfg.LinkField)
+	if !ok {
+		return trace.Link{}, false
+	}
+	ts := fmt.Sprint(tv)
+	if i := strings.LastIndexByte(ts, '/'); i >= 0 {
+		ts = ts[i+1:]
+	}
+	var sc trace.SpanContextConfig
+	tb, err := hex.DecodeString(ts)
+	if err != nil || len(tb) != len(sc.TraceID) {
+		return trace.Link{}, false
+	}
+	copy(sc.TraceID[:], tb)
+	if !sc.TraceID.IsValid() {
+		return trace.Link{}, false
+	}
+	if sv, ok := lookupField(record, t.cfg.LinkSpanField); ok && t.cfg.LinkSpanField != "" {
+		sb, err := hex.DecodeString(fmt.Sprint(sv))
+		if err != nil || len(sb) != len(sc.SpanID) {
+			return trace.Link{}, false
+		}
+		copy(sc.SpanID[:], sb)
+		sc.TraceFlags = trace.FlagsSampled
+	}
+	return trace.Link{SpanContext: trace.NewSpanContext(sc)}, true
+}
+
+// linkOptions returns the span start options adding links to the publish span.
+//
+// The SDK drops links without a span id, so the trace ids of links with only a trace id are set as the
+// fluentbit.linked_trace_ids attribute instead.
+func linkOptions(links []trace.Link) []trace.SpanStartOption {
+	var (
+		valid    []trace.Link
+		traceIDs []string
+	)
+	for _, link := range links {
+		if link.SpanContext.HasSpanID() {
+			valid = append(valid, link)
+		} else {
+			traceIDs = append(traceIDs, link.SpanContext.TraceID().String())
+		}
+	}
+	opts := []trace.SpanStartOption{trace.WithLinks(valid...)}
+	if len(traceIDs) > 0 {
+		opts = append(opts, trace.WithAttributes(attribute.StringSlice("fluentbit.linked_trace_ids", traceIDs)))
+	}
+	return opts
+}
+
+// inject adds the W3C trace context of the span in ctx to the message attributes.
+func (t *flushTracer) inject(ctx context.Context, attrs map[string]string) {
+	if t == nil || !t.cfg.Propagate {
+		return
+	}
+	propagation.TraceContext{}.Inject(ctx, attrCarrier(attrs))
+}
+
+// shutdown exports any remaining spans.
+func (t *flushTracer) shutdown() error {
+	if t == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return t.tp.Shutdown(ctx)
+}
+
+// attrCarrier is a propagation.TextMapCarrier for message attributes, prefixing the keys with traceAttrPrefix.
+type attrCarrier map[string]string
+
+func (c attrCarrier) Get(key string) string {
+	return c[traceAttrPrefix+key]
+}
+
+func (c attrCarrier) Set(key, value string) {
+	c[traceAttrPrefix+key] = value
+}
+
+func (c attrCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		if strings.HasPrefix(k, traceAttrPrefix) {
+			keys = append(keys, strings.TrimPrefix(k, traceAttrPrefix))
+		}
+	}
+	return keys
+}
@@ -0,0 +1,160 @@
+/*
+ * Copyright 2022  David MacKinnon (blaedd@gmail.com)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"). You may
+ * not use this file except in compliance with the License. A copy of the
+ * License is located at
+ *
+ * https://www.apache.org/licenses/LICENSE-2.0.txt
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package plugin
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	testTraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	testSpanID  = "00f067aa0ba902b7"
+)
+
+func TestTracingConfig_Validate(t *testing.T) {
+	type testData struct {
+		cfg     TracingConfig
+		wantErr bool
+	}
+	testMap := map[string]testData{
+		"disabled":         {cfg: TracingConfig{}},
+		"endpoint":         {cfg: TracingConfig{Endpoint: "localhost:4317", Propagate: true}},
+		"propagateOnly":    {cfg: TracingConfig{Propagate: true}, wantErr: true},
+		"links":            {cfg: TracingConfig{LinkField: "trace_id", LinkSpanField: "span_id"}},
+		"linkNoSpanField":  {cfg: TracingConfig{LinkField: "trace_id"}},
+		"spanFieldNoField": {cfg: TracingConfig{LinkSpanField: "span_id"}, wantErr: true},
+	}
+	for k, tt := range testMap {
+		t.Run(k, func(t *testing.T) {
+			if err := tt.cfg.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestFlushTracer_link(t *testing.T) {
+	cfg := TracingConfig{LinkField: "trace", LinkSpanField: "span"}
+	noSpan := "0000000000000000"
+	type testData struct {
+		cfg      TracingConfig
+		record   map[string]interface{}
+		want     bool
+		wantSpan string
+	}
+	testMap := map[string]testData{
+		"hex": {cfg: cfg, record: map[string]interface{}{"trace": testTraceID, "span": testSpanID}, want: true,
+			wantSpan: testSpanID},
+		"cloudLogging": {cfg: cfg, record: map[string]interface{}{"trace": "projects/p/traces/" + testTraceID,
+			"span": testSpanID}, want: true, wantSpan: testSpanID},
+		"missingSpan": {cfg: cfg, record: map[string]interface{}{"trace": testTraceID}, want: true, wantSpan: noSpan},
+		"traceOnly": {cfg: TracingConfig{LinkField: "trace"},
+			record: map[string]interface{}{"trace": testTraceID, "span": testSpanID}, want: true, wantSpan: noSpan},
+		"missing":     {cfg: cfg, record: map[string]interface{}{"span": testSpanID}},
+		"shortTrace":  {cfg: cfg, record: map[string]interface{}{"trace": "4bf92f35", "span": testSpanID}},
+		"notHex":      {cfg: cfg, record: map[string]interface{}{"trace": strings.Repeat("z", 32), "span": testSpanID}},
+		"notHexSpan":  {cfg: cfg, record: map[string]interface{}{"trace": testTraceID, "span": "zz"}},
+		"zeroTraceID": {cfg: cfg, record: map[string]interface{}{"trace": strings.Repeat("0", 32), "span": testSpanID}},
+	}
+	for k, tt := range testMap {
+		t.Run(k, func(t *testing.T) {
+			tr := &flushTracer{cfg: tt.cfg}
+			link, ok := tr.link(tt.record)
+			if ok != tt.want {
+				t.Fatalf("link() ok = %v, want %v", ok, tt.want)
+			}
+			if !ok {
+				return
+			}
+			if got := link.SpanContext.TraceID().String(); got != testTraceID {
+				t.Errorf("link() trace id = %s, want %s", got, testTraceID)
+			}
+			if got := link.SpanContext.SpanID().String(); got != tt.wantSpan {
+				t.Errorf("link() span id = %s, want %s", got, tt.wantSpan)
+			}
+		})
+	}
+	var nilTracer *flushTracer
+	if _, ok := nilTracer.link(map[string]interface{}{"trace": testTraceID, "span": testSpanID}); ok {
+		t.Error("nil flushTracer link() ok = true, want false")
+	}
+}
+
+func TestLinkOptions(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+	defer func() { _ = tp.Shutdown(context.Background()) }()
+	tr := &flushTracer{cfg: TracingConfig{LinkField: "trace", LinkSpanField: "span"}}
+	full, _ := tr.link(map[string]interface{}{"trace": testTraceID, "span": testSpanID})
+	traceOnly, _ := tr.link(map[string]interface{}{"trace": testTraceID})
+
+	_, span := tp.Tracer(tracerName).Start(context.Background(), "publish", linkOptions([]trace.Link{full, traceOnly})...)
+	span.End()
+	got := rec.Ended()[0]
+	if links := got.Links(); len(links) != 1 || links[0].SpanContext.SpanID().String() != testSpanID {
+		t.Errorf("linkOptions() links = %v, want one link to span %s", links, testSpanID)
+	}
+	var ids []string
+	for _, kv := range got.Attributes() {
+		if kv.Key == "fluentbit.linked_trace_ids" {
+			ids = kv.Value.AsStringSlice()
+		}
+	}
+	if len(ids) != 1 || ids[0] != testTraceID {
+		t.Errorf("linkOptions() fluentbit.linked_trace_ids = %v, want [%s]", ids, testTraceID)
+	}
+}
+
+func TestFlushTracer_inject(t *testing.T) {
+	tp := sdktrace.NewTracerProvider()
+	defer func() { _ = tp.Shutdown(context.Background()) }()
+	ctx, span := tp.Tracer(tracerName).Start(context.Background(), "publish")
+	defer span.End()
+
+	type testData struct {
+		tracer *flushTracer
+		want   bool
+	}
+	testMap := map[string]testData{
+		"propagate":   {tracer: &flushTracer{cfg: TracingConfig{Propagate: true}}, want: true},
+		"noPropagate": {tracer: &flushTracer{}},
+		"nil":         {},
+	}
+	for k, tt := range testMap {
+		t.Run(k, func(t *testing.T) {
+			attrs := map[string]string{"tag": "test"}
+			tt.tracer.inject(ctx, attrs)
+			got, ok := attrs["googclient_traceparent"]
+			if ok != tt.want {
+				t.Fatalf("inject() attributes = %v, want traceparent %v", attrs, tt.want)
+			}
+			if ok && !strings.Contains(got, span.SpanContext().TraceID().String()) {
+				t.Errorf("inject() traceparent = %s, want trace id %s", got, span.SpanContext().TraceID())
+			}
+			if attrs["tag"] != "test" {
+				t.Errorf("inject() changed existing attributes: %v", attrs)
+			}
+		})
+	}
+}
@@ -20,19 +20,13 @@ package main
 import "C"
 import (
 	"context"
-	"io"
 	"os"
-	"strconv"
-	"time"
 	"unsafe"
 
-	"cloud.google.com/go/pubsub"
 	"github.com/blaedd/fluent-bit-pubsub-plugin/plugin"
 	"github.com/fluent/fluent-bit-go/output"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
-	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/status"
 )
 
 const (
@@ -43,40 +37,44 @@ var (
 	pluginInstances []*plugin.OutputPlugin
 )
 
-func init() {
-	zerolog.DisableSampling(true)
-
+// pluginInfo returns the plugin fields added to every log event.
+func pluginInfo() *zerolog.Event {
 	hostname, err := os.Hostname()
 	if err != nil {
 		hostname = "unknown"
 	}
-	zerolog.CallerMarshalFunc = func(file string, line int) string {
-		short := file
-		for i := len(file) - 1; i > 0; i-- {
-			if file[i] == '/' {
-				short = file[i+1:]
-				break
-			}
-		}
-		file = short
-		return file + ":" + strconv.Itoa(line)
-	}
-	pi := zerolog.Dict()
-	pi.Str("name", PluginName).Str("host", hostname)
-	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: time.RFC3339}).With().Timestamp().
-		Caller().Dict("plugin", pi).Logger()
+	return zerolog.Dict().Str("name", PluginName).Str("host", hostname)
+}
+
+func init() {
+	zerolog.CallerMarshalFunc = plugin.ShortCaller
+	// Used until an instance is configured, and for messages not specific to an instance.
+	logger, _ := plugin.DefaultLogConfig.NewLogger(false)
+	log.Logger = logger.With().Dict("plugin", pluginInfo()).Logger()
 }
 
 func addPluginInstance(ctx unsafe.Pointer) error {
-	logger := log.With().Uint("plugin_ctx", uint(uintptr(ctx))).Logger().Level(zerolog.InfoLevel)
+	logger := log.With().Uint("plugin_ctx", uint(uintptr(ctx))).Logger()
 	id := len(pluginInstances)
 	output.FLBPluginSetContext(ctx, id)
-	cs := plugin.NewFLBConfigStore(ctx, &logger)
-	cfg := plugin.BuildPluginConfig(id, &cs)
-	if cfg.D {
-		logger = logger.Level(zerolog.DebugLevel)
-		logger.Debug().Msg("debug logging enabled")
+	flb := plugin.NewFLBConfigStore(ctx, &logger)
+	cs, err := plugin.NewPluginConfigStore(&flb, &logger)
+	if err != nil {
+		logger.Error().Err(err).Msg("unable to load configuration")
+		return err
+	}
+	cfg, err := plugin.BuildPluginConfig(id, cs)
+	if err != nil {
+		logger.Error().Err(err).Msg("invalid configuration")
+		return err
 	}
+	il, err := cfg.Log.NewLogger(cfg.D)
+	if err != nil {
+		logger.Error().Err(err).Msg("unable to configure logging")
+		return err
+	}
+	logger = il.With().Dict("plugin", pluginInfo().Int("id", id)).Uint("plugin_ctx", uint(uintptr(ctx))).Logger()
+	logger.Debug().Msg("debug logging enabled")
 	reqCtx := context.Background()
 	reqCtx = logger.WithContext(reqCtx)
 	instance, err := plugin.NewPluginFromConfig(reqCtx, cfg)
@@ -116,63 +114,17 @@ func FLBPluginFlushCtx(ctx, data unsafe.Pointer, length C.int, tag *C.char) int
 	reqCtx := context.Background()
 	p := getPluginInstance(ctx)
 	fluentTag := C.GoString(tag)
-	logger := log.With().Str("tag", fluentTag).Logger()
-	if p.D {
-		logger = logger.Level(zerolog.DebugLevel)
-	} else {
-		logger = logger.Level(zerolog.InfoLevel)
-	}
+	logger := p.Logger().With().Str("tag", fluentTag).Logger()
 	reqCtx = logger.WithContext(reqCtx)
-	logger.Debug().Int("bytes", int(length)).Msg("receiving log entries")
-	p.R.ResetReader(data, int(length))
-	rb := make([]*pubsub.PublishResult, 0, 100)
-
-	for {
-		ts, record, err := p.R.ReadRecord()
-		if err == io.EOF {
-			logger.Info().Msg("End of File")
-			break
-		}
-		if err != nil {
-			logger.Error().Err(err).Time("log_ts", ts).Msg("error while reading a record")
-			continue
-		}
-		msg, err := p.CreateMessage(ts, fluentTag, record)
-		if err != nil {
-			logger.Error().Err(err).Time("log_ts", ts).Interface("record", record).Msg(
-				"error while creating pubsub.Message from record")
-		}
-		rb = append(rb, p.Publish(reqCtx, msg))
-	}
-
-	for _, res := range rb {
-		_, err := res.Get(reqCtx)
-		if err != nil {
-			if err == context.DeadlineExceeded {
-				logger.Warn().Msg("deadline exceeded. Will retry.")
-				return output.FLB_RETRY
-			}
-			if stts, ok := status.FromError(err); !ok {
-				logger.Error().Err(err).Msg("could not parse error to grpc.status.")
-				return output.FLB_ERROR
-			} else {
-				switch stts.Code() {
-				case codes.DeadlineExceeded, codes.Internal, codes.Unavailable:
-					logger.Warn().Err(err).Msg("retryable error.")
-					return output.FLB_RETRY
-				default:
-					logger.Warn().Err(stts.Err()).Msg("unrecoverable Publish error")
-					return output.FLB_ERROR
-				}
-			}
-		}
-	}
-	return output.FLB_OK
+	return p.Flush(reqCtx, data, int(length), fluentTag)
 }
 
 //export FLBPluginExit
 func FLBPluginExit() int {
 	log.Info().Msg("exiting")
+	for _, p := range pluginInstances {
+		p.Close()
+	}
 	return output.FLB_OK
 }
 